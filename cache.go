@@ -0,0 +1,171 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// A cache stores the output of previously run shell commands,
+// keyed by a hash of everything that can affect that output.
+type cache struct {
+	dir string
+}
+
+// openCache returns the user's gosh cache, creating it if necessary.
+func openCache() (*cache, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "gosh")
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &cache{dir}, nil
+}
+
+// cacheKey returns the cache key for running c in the current environment.
+// The key also covers the contents of the files matched by c.Deps.
+func cacheKey(c *gosh.Command) (string, error) {
+	wd := c.Dir
+	if wd == "" {
+		var err error
+		wd, err = os.Getwd()
+		if err != nil {
+			return "", err
+		}
+	}
+	env := c.Environ
+	if env == nil {
+		env = os.Environ()
+	}
+	env = slices.Clone(env)
+	slices.Sort(env)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "gosh cache 1\n")
+	fmt.Fprintf(h, "prompt %q\n", c.Prompt)
+	fmt.Fprintf(h, "dir %q\n", wd)
+	for _, kv := range env {
+		fmt.Fprintf(h, "env %q\n", kv)
+	}
+	for _, dep := range c.Deps {
+		if err := hashDep(h, dep); err != nil {
+			return "", err
+		}
+	}
+	fmt.Fprintf(h, "shell %q\n", c.Shell)
+	if c.Stderr {
+		fmt.Fprintf(h, "stderr\n")
+	}
+	if c.Host != "" {
+		fmt.Fprintf(h, "host %q\n", c.Host)
+	}
+	if c.Image != "" {
+		fmt.Fprintf(h, "image %q %q %q\n", c.Runtime, c.Image, c.ContainerArgs)
+	}
+	if *flagUser != "" {
+		fmt.Fprintf(h, "user %q\n", *flagUser)
+	}
+	if *flagNoNet {
+		fmt.Fprintf(h, "no-network\n")
+	}
+	if *flagRunner != "" {
+		fmt.Fprintf(h, "runner %q\n", *flagRunner)
+	}
+	if c.PTY {
+		// Programs format their output for the terminal's size.
+		fmt.Fprintf(h, "pty %d %d\n", c.PTYCols, c.PTYRows)
+	}
+	if c.Trim {
+		fmt.Fprintf(h, "trim\n")
+	}
+	if c.CPULimit > 0 || c.MemLimit > 0 || c.OutputLimit > 0 {
+		fmt.Fprintf(h, "limits %v %d %d\n", c.CPULimit, c.MemLimit, c.OutputLimit)
+	}
+	for _, kv := range c.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, "GOSH_OUT_") {
+			fmt.Fprintf(h, "env %q\n", kv)
+			continue
+		}
+		// The value names a temporary file holding another command's output.
+		data, err := os.ReadFile(value)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "output %q %x\n", name, sha256.Sum256(data))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashDep writes the contents of the files matched by dep to h.
+// If dep ends in "/...", it matches every file in that directory tree.
+func hashDep(h hash.Hash, dep string) error {
+	root, tree := strings.CutSuffix(filepath.ToSlash(dep), "/...")
+	if !tree {
+		return hashFile(h, dep)
+	}
+	return filepath.WalkDir(filepath.FromSlash(root), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		return hashFile(h, path)
+	})
+}
+
+func hashFile(h hash.Hash, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(h, "file %q %x\n", path, sha256.Sum256(data))
+	return nil
+}
+
+func (c *cache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// get returns the output stored under key, if any.
+func (c *cache) get(key string) ([]byte, bool) {
+	data, err := os.ReadFile(c.path(key))
+	return data, err == nil
+}
+
+// put stores output under key.
+// Concurrent readers never observe a partially written entry.
+func (c *cache) put(key string, output []byte) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), key+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(output)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
@@ -0,0 +1,150 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+func TestCacheKey(t *testing.T) {
+	base := gosh.Command{Prompt: "go version", Dir: "/src", Environ: []string{"HOME=/home/me", "GOOS=linux"}}
+	tests := []struct {
+		name   string
+		change func(c *gosh.Command)
+		same   bool
+	}{
+		{"nothing", func(c *gosh.Command) {}, true},
+		{"position", func(c *gosh.Command) { c.Pos.Line = 7 }, true},
+		{"environment order", func(c *gosh.Command) { c.Environ = []string{"GOOS=linux", "HOME=/home/me"} }, true},
+		{"prompt", func(c *gosh.Command) { c.Prompt = "go env" }, false},
+		{"dir", func(c *gosh.Command) { c.Dir = "/tmp" }, false},
+		{"environment", func(c *gosh.Command) { c.Environ = []string{"HOME=/home/me", "GOOS=darwin"} }, false},
+		{"env", func(c *gosh.Command) { c.Env = []string{"GOFLAGS=-mod=mod"} }, false},
+		{"shell", func(c *gosh.Command) { c.Shell = "bash" }, false},
+		{"stderr", func(c *gosh.Command) { c.Stderr = true }, false},
+		{"host", func(c *gosh.Command) { c.Host = "build01" }, false},
+		{"image", func(c *gosh.Command) { c.Image = "golang" }, false},
+		{"pty", func(c *gosh.Command) { c.PTY = true }, false},
+		{"trim", func(c *gosh.Command) { c.Trim = true }, false},
+		{"cpu", func(c *gosh.Command) { c.CPULimit = time.Second }, false},
+		{"mem", func(c *gosh.Command) { c.MemLimit = 1 << 30 }, false},
+		{"output limit", func(c *gosh.Command) { c.OutputLimit = 1 << 20 }, false},
+	}
+	baseKey, err := cacheKey(&base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		c := base
+		tt.change(&c)
+		key, err := cacheKey(&c)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if same := key == baseKey; same != tt.same {
+			t.Errorf("changing the %s: same key = %v, want %v", tt.name, same, tt.same)
+		}
+	}
+
+	// Commands in containers differ by runtime and isolation too.
+	img := base
+	img.Image = "golang"
+	imgKey, _ := cacheKey(&img)
+	for _, change := range []func(c *gosh.Command){
+		func(c *gosh.Command) { c.Runtime = "podman" },
+		func(c *gosh.Command) { c.ContainerArgs = []string{"--network=none"} },
+	} {
+		c := img
+		change(&c)
+		if key, _ := cacheKey(&c); key == imgKey {
+			t.Errorf("container settings %q %q don't change the key", c.Runtime, c.ContainerArgs)
+		}
+	}
+
+	defer func(old bool) { *flagNoNet = old }(*flagNoNet)
+	*flagNoNet = true
+	if key, _ := cacheKey(&base); key == baseKey {
+		t.Errorf("-no-network doesn't change the key")
+	}
+}
+
+func TestCacheKeyDeps(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("go.mod", "module m\n")
+	write("internal/a/a.go", "package a\n")
+	c := &gosh.Command{Prompt: "go list ./...", Dir: dir, Deps: []string{
+		filepath.Join(dir, "go.mod"),
+		filepath.Join(dir, "internal") + "/...",
+	}}
+	key := func() string {
+		t.Helper()
+		k, err := cacheKey(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		same   bool
+	}{
+		{"nothing", func() {}, true},
+		{"unrelated file", func() { write("README.md", "hi\n") }, true},
+		{"file", func() { write("go.mod", "module m\n\ngo 1.22\n") }, false},
+		{"file in tree", func() { write("internal/a/a.go", "package a // changed\n") }, false},
+		{"new file in tree", func() { write("internal/b/b.go", "package b\n") }, false},
+		{"file renamed in tree", func() {
+			os.Rename(filepath.Join(dir, "internal/b/b.go"), filepath.Join(dir, "internal/b/c.go"))
+		}, false},
+	}
+	prev := key()
+	for _, tt := range tests {
+		tt.change()
+		k := key()
+		if same := k == prev; same != tt.same {
+			t.Errorf("%s: same key = %v, want %v", tt.name, same, tt.same)
+		}
+		prev = k
+	}
+
+	// A missing dependency is an error, so the command doesn't run.
+	c.Deps = append(c.Deps, filepath.Join(dir, "missing.txt"))
+	if _, err := cacheKey(c); err == nil {
+		t.Errorf("cacheKey succeeded with a missing dependency")
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := &cache{dir: t.TempDir()}
+	const key = "0123456789abcdef"
+	if _, ok := c.get(key); ok {
+		t.Fatalf("get found an entry in an empty cache")
+	}
+	for _, output := range []string{"first\n", "", "second\n"} {
+		if err := c.put(key, []byte(output)); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok := c.get(key); !ok || string(got) != output {
+			t.Errorf("after put(%q), get = %q, %v", output, got, ok)
+		}
+	}
+}
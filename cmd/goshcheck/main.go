@@ -0,0 +1,16 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The goshcheck command runs the goshcheck analyzer,
+// which reports gosh commands with missing or stale output.
+//
+// It can be run directly, or with "go vet -vettool=$(which goshcheck)".
+package main
+
+import (
+	"github.com/mdempsky/gosh/pkg/goshcheck"
+	"golang.org/x/tools/go/analysis/singlechecker"
+)
+
+func main() { singlechecker.Main(goshcheck.Analyzer) }
@@ -0,0 +1,184 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ANSI escape sequences for coloring diffs.
+const (
+	ansiReset   = "\033[0m"
+	ansiBold    = "\033[1m"
+	ansiRed     = "\033[31m"
+	ansiGreen   = "\033[32m"
+	ansiCyan    = "\033[36m"
+	ansiReverse = "\033[7m"
+	ansiNoRev   = "\033[27m"
+)
+
+// useColor reports whether to color the output written to f.
+// It follows the NO_COLOR and CLICOLOR_FORCE conventions,
+// and otherwise colors output to terminals.
+func useColor(f *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if v := os.Getenv("CLICOLOR_FORCE"); v != "" && v != "0" {
+		return true
+	}
+	return isTerminal(f)
+}
+
+// colorize returns the unified diff d with ANSI colors.
+// When a run of removed lines is replaced by the same number
+// of added lines, the words that changed within each line
+// are highlighted too.
+func colorize(d []byte) []byte {
+	lines := strings.SplitAfter(string(d), "\n")
+	var buf bytes.Buffer
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "diff "), strings.HasPrefix(line, "--- "), strings.HasPrefix(line, "+++ "):
+			writeColored(&buf, ansiBold, line)
+			i++
+		case strings.HasPrefix(line, "@@"):
+			writeColored(&buf, ansiCyan, line)
+			i++
+		case strings.HasPrefix(line, "-"), strings.HasPrefix(line, "+"):
+			j := i
+			for j < len(lines) && strings.HasPrefix(lines[j], "-") {
+				j++
+			}
+			k := j
+			for k < len(lines) && strings.HasPrefix(lines[k], "+") {
+				k++
+			}
+			del, add := lines[i:j], lines[j:k]
+			if len(del) == len(add) {
+				news := make([]string, len(add))
+				for n := range del {
+					var old string
+					old, news[n] = wordDiff(del[n][1:], add[n][1:])
+					writeColored(&buf, ansiRed, "-"+old)
+				}
+				for _, new := range news {
+					writeColored(&buf, ansiGreen, "+"+new)
+				}
+			} else {
+				for _, line := range del {
+					writeColored(&buf, ansiRed, line)
+				}
+				for _, line := range add {
+					writeColored(&buf, ansiGreen, line)
+				}
+			}
+			i = k
+		default:
+			buf.WriteString(line)
+			i++
+		}
+	}
+	return buf.Bytes()
+}
+
+// writeColored writes line to buf in color,
+// keeping the trailing newline uncolored.
+func writeColored(buf *bytes.Buffer, color, line string) {
+	text, nl := strings.CutSuffix(line, "\n")
+	buf.WriteString(color)
+	buf.WriteString(text)
+	buf.WriteString(ansiReset)
+	if nl {
+		buf.WriteByte('\n')
+	}
+}
+
+// maxWordDiff is the most words in a line that wordDiff compares.
+// Longer lines are highlighted in their entirety.
+const maxWordDiff = 500
+
+// wordDiff returns old and new with the words that differ
+// between them highlighted, for use inside a colored line.
+func wordDiff(old, new string) (string, string) {
+	x, y := words(old), words(new)
+	if len(x) > maxWordDiff || len(y) > maxWordDiff {
+		return old, new
+	}
+
+	// Compute the longest common subsequence of words.
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var ob, nb strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			ob.WriteString(x[i])
+			nb.WriteString(y[j])
+			i++
+			j++
+		case j == len(y) || i < len(x) && lcs[i+1][j] >= lcs[i][j+1]:
+			highlight(&ob, x[i])
+			i++
+		default:
+			highlight(&nb, y[j])
+			j++
+		}
+	}
+	return ob.String(), nb.String()
+}
+
+// highlight writes word to b in reverse video.
+func highlight(b *strings.Builder, word string) {
+	if strings.HasSuffix(word, "\n") {
+		// Don't highlight past the end of the line.
+		highlight(b, strings.TrimSuffix(word, "\n"))
+		b.WriteByte('\n')
+		return
+	}
+	if word == "" {
+		return
+	}
+	b.WriteString(ansiReverse)
+	b.WriteString(word)
+	b.WriteString(ansiNoRev)
+}
+
+// words splits s into words, runs of spaces, and punctuation characters.
+func words(s string) []string {
+	var res []string
+	for s != "" {
+		r, n := utf8.DecodeRuneInString(s)
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_':
+			n = len(s) - len(strings.TrimLeftFunc(s, func(r rune) bool {
+				return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+			}))
+		case unicode.IsSpace(r):
+			n = len(s) - len(strings.TrimLeftFunc(s, unicode.IsSpace))
+		}
+		res = append(res, s[:n])
+		s = s[n:]
+	}
+	return res
+}
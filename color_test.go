@@ -0,0 +1,65 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUseColor(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tests := []struct {
+		noColor, force string
+		want           bool
+	}{
+		{"", "", false}, // not a terminal
+		{"", "1", true},
+		{"", "0", false},
+		{"1", "1", false},
+	}
+	for _, tt := range tests {
+		t.Setenv("NO_COLOR", tt.noColor)
+		t.Setenv("CLICOLOR_FORCE", tt.force)
+		if got := useColor(f); got != tt.want {
+			t.Errorf("NO_COLOR=%q CLICOLOR_FORCE=%q: useColor = %v, want %v", tt.noColor, tt.force, got, tt.want)
+		}
+	}
+}
+
+func TestColorize(t *testing.T) {
+	const (
+		red, green, bold, cyan = ansiRed, ansiGreen, ansiBold, ansiCyan
+		rev, norev, reset      = ansiReverse, ansiNoRev, ansiReset
+	)
+	tests := []struct {
+		diff, want string
+	}{
+		{
+			"--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n",
+			bold + "--- old" + reset + "\n" + bold + "+++ new" + reset + "\n" + cyan + "@@ -1,2 +1,2 @@" + reset + "\n a\n",
+		},
+		// Replaced lines highlight the words that changed.
+		{
+			"-a b c\n+a x c\n",
+			red + "-a " + rev + "b" + norev + " c" + reset + "\n" + green + "+a " + rev + "x" + norev + " c" + reset + "\n",
+		},
+		// Otherwise, whole lines are colored.
+		{
+			"-a\n+b\n+c\n",
+			red + "-a" + reset + "\n" + green + "+b" + reset + "\n" + green + "+c" + reset + "\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(colorize([]byte(tt.diff))); got != tt.want {
+			t.Errorf("colorize(%q) = %q, want %q", tt.diff, got, tt.want)
+		}
+	}
+}
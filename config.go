@@ -0,0 +1,397 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+	"gopkg.in/yaml.v3"
+)
+
+// configNames are the names of the project configuration file,
+// in order of preference.
+var configNames = []string{"gosh.yaml", ".gosh.yaml"}
+
+// A config is the project configuration,
+// read from a gosh.yaml or .gosh.yaml file at the module root.
+type config struct {
+	// Shell, Timeout, and Env configure how commands run.
+	// Shell and Timeout are defaults for -shell and -timeout.
+	Shell   string            `yaml:"shell"`
+	Timeout string            `yaml:"timeout"`
+	Env     map[string]string `yaml:"env"`
+
+	// Passthrough is an error: only the command line may pass
+	// environment variables, which may hold credentials, to commands.
+	Passthrough []string `yaml:"env-passthrough"`
+
+	// Exclude lists patterns, relative to the configuration file,
+	// of files to skip, as for -exclude.
+	Exclude []string `yaml:"exclude"`
+
+	// Redact lists regular expressions whose matches
+	// in command output are replaced by "[REDACTED]".
+	Redact []string `yaml:"redact"`
+
+	// Flags holds defaults for other command-line flags,
+	// like "refresh: true" or "format: sarif".
+	// Only the flags in configFlags may be set.
+	Flags map[string]string `yaml:"flags"`
+}
+
+// configFlags are the flags that the configuration may set.
+// They change how gosh finds files and reports what it does,
+// or further limit commands, but not which commands run or
+// what they can reach, so that the configuration in a freshly cloned
+// repository can't turn off the protections of the command line.
+// There's no -w, which would rewrite files without the user asking,
+// or -output-limit, which could raise the default limit.
+var configFlags = map[string]bool{
+	"allfiles":          true,
+	"buildvcs":          true,
+	"cache":             true,
+	"check":             true,
+	"cpu-limit":         true,
+	"d":                 true,
+	"dedupe":            true,
+	"empty":             true,
+	"file-jobs":         true,
+	"files":             true,
+	"format":            true,
+	"include-generated": true,
+	"jobs":              true,
+	"json":              true,
+	"keep-going":        true,
+	"lang":              true,
+	"log-format":        true,
+	"log-level":         true,
+	"mem-limit":         true,
+	"mod":               true,
+	"q":                 true,
+	"refresh":           true,
+	"tags":              true,
+	"tests":             true,
+	"timeout":           true,
+	"trailer":           true,
+	"trim":              true,
+	"v":                 true,
+}
+
+// checkConfig reports an error, naming path, if c, read from path,
+// has settings that only the command line may give.
+func checkConfig(path string, c *config) error {
+	if len(c.Passthrough) > 0 {
+		return fmt.Errorf("%s: env-passthrough can only be given on the command line", path)
+	}
+	names := make([]string, 0, len(c.Flags))
+	for name := range c.Flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil {
+			return fmt.Errorf("%s: unknown flag %q", path, name)
+		}
+		if !configFlags[name] {
+			return fmt.Errorf("%s: flag %q can only be given on the command line", path, name)
+		}
+	}
+	return nil
+}
+
+// conf is the project configuration, if any.
+var conf config
+
+// loadConfig reads the configuration file at the root of the module
+// containing the current directory, if there is one.
+// It returns the name of the file, or "" if there isn't one.
+func loadConfig() (string, *config, error) {
+	dir, err := moduleRoot()
+	if dir == "" {
+		return "", nil, err
+	}
+	for _, name := range configNames {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		c := new(config)
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return "", nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := checkConfig(path, c); err != nil {
+			return "", nil, err
+		}
+		return path, c, nil
+	}
+	return "", nil, nil
+}
+
+// policyName is the name of the repository policy file.
+const policyName = ".goshpolicy"
+
+// policy is the repository policy, if any.
+var policy *gosh.Policy
+
+// loadPolicy reads the policy file at the root of the module
+// containing the current directory, if there is one.
+func loadPolicy() (*gosh.Policy, error) {
+	dir, err := moduleRoot()
+	if dir == "" {
+		return nil, err
+	}
+	path := filepath.Join(dir, policyName)
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return gosh.ParsePolicy(path, data)
+}
+
+// moduleRoot returns the root directory of the module
+// containing the current directory, or "" if there isn't one.
+func moduleRoot() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil // not in a module
+		}
+		dir = parent
+	}
+}
+
+// cmdlineFlags records the flags given on the command line,
+// rather than set by the configuration.
+var cmdlineFlags map[string]bool
+
+// visitFlags records the flags given on the command line in cmdlineFlags.
+// It must be called before the configuration sets any.
+func visitFlags() {
+	cmdlineFlags = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { cmdlineFlags[f.Name] = true })
+}
+
+// applyConfig uses the settings in c, read from path,
+// as the defaults for flags not given on the command line.
+func applyConfig(path string, c *config) error {
+	set := cmdlineFlags
+
+	defaults := make(map[string]string)
+	for name, value := range c.Flags {
+		defaults[name] = value
+	}
+	if c.Shell != "" {
+		defaults["shell"] = c.Shell
+	}
+	if c.Timeout != "" {
+		defaults["timeout"] = c.Timeout
+	}
+
+	names := make([]string, 0, len(defaults))
+	for name := range defaults {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if set[name] {
+			continue
+		}
+		if err := flag.Set(name, defaults[name]); err != nil {
+			return fmt.Errorf("%s: flag %q: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// configEnv returns the environment variables set by c,
+// in the form "key=value".
+func configEnv(c *config) []string {
+	return envList(c.Env)
+}
+
+// envList returns the environment variables in m,
+// in the form "key=value".
+func envList(m map[string]string) []string {
+	var env []string
+	for k, v := range m {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// configRedact returns the patterns to redact from command output:
+// common secret formats, and those listed by c, read from path.
+func configRedact(path string, c *config) ([]*regexp.Regexp, error) {
+	patterns := slices.Clone(gosh.Secrets)
+	for _, expr := range c.Redact {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid redact pattern: %v", path, err)
+		}
+		patterns = append(patterns, re)
+	}
+	return patterns, nil
+}
+
+// A dirConfig is the configuration for the files in a directory
+// below the module root that has its own gosh.yaml or .goshpolicy file,
+// or is below one that does. Its settings start as the module's,
+// and each such file between the module root and the directory
+// then overrides them, nearer files last.
+type dirConfig struct {
+	shell   string
+	timeout time.Duration
+	env     map[string]string
+	redact  []*regexp.Regexp
+	policy  *gosh.Policy
+}
+
+var (
+	dirConfigsMu sync.Mutex
+	dirConfigs   = make(map[string]*dirConfig)
+)
+
+// configFor returns the configuration for the files in dir,
+// or nil if the module's configuration applies as is.
+func configFor(dir string) (*dirConfig, error) {
+	dirConfigsMu.Lock()
+	defer dirConfigsMu.Unlock()
+	return configForLocked(dir)
+}
+
+func configForLocked(dir string) (*dirConfig, error) {
+	rel, err := filepath.Rel(mountDir, dir)
+	if mountDir == "" || err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, nil
+	}
+	if dc, ok := dirConfigs[dir]; ok {
+		return dc, nil
+	}
+	parent, err := configForLocked(filepath.Dir(dir))
+	if err != nil {
+		return nil, err
+	}
+	dc, err := readDirConfig(dir, parent)
+	if err != nil {
+		return nil, err
+	}
+	dirConfigs[dir] = dc
+	return dc, nil
+}
+
+// readDirConfig returns the configuration for dir, given parent,
+// that of its parent directory, or nil for the module's.
+// If dir has no configuration files of its own, it returns parent.
+func readDirConfig(dir string, parent *dirConfig) (*dirConfig, error) {
+	var c *config
+	var path string
+	for _, name := range configNames {
+		p := filepath.Join(dir, name)
+		data, err := os.ReadFile(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		c = new(config)
+		if err := yaml.Unmarshal(data, c); err != nil {
+			return nil, fmt.Errorf("%s: %v", p, err)
+		}
+		if err := checkConfig(p, c); err != nil {
+			return nil, err
+		}
+		if len(c.Flags) > 0 || len(c.Exclude) > 0 {
+			return nil, fmt.Errorf("%s: flags and exclude are only supported at the module root", p)
+		}
+		path = p
+		break
+	}
+	var pol *gosh.Policy
+	policyPath := filepath.Join(dir, policyName)
+	if data, err := os.ReadFile(policyPath); err == nil {
+		if pol, err = gosh.ParsePolicy(policyPath, data); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if c == nil && pol == nil {
+		return parent, nil
+	}
+
+	dc := parent
+	if dc == nil {
+		dc = &dirConfig{
+			shell:   *flagShell,
+			timeout: *flagTimeout,
+			env:     conf.Env,
+			redact:  redactions,
+			policy:  policy,
+		}
+	}
+	dc = &dirConfig{
+		shell:   dc.shell,
+		timeout: dc.timeout,
+		env:     maps.Clone(dc.env),
+		redact:  dc.redact,
+		policy:  dc.policy.Merge(pol),
+	}
+	if c != nil {
+		// Flags given on the command line win.
+		if c.Shell != "" && !cmdlineFlags["shell"] {
+			dc.shell = c.Shell
+		}
+		if c.Timeout != "" && !cmdlineFlags["timeout"] {
+			d, err := time.ParseDuration(c.Timeout)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid timeout: %v", path, err)
+			}
+			dc.timeout = d
+		}
+		for k, v := range c.Env {
+			if dc.env == nil {
+				dc.env = make(map[string]string)
+			}
+			dc.env[k] = v
+		}
+		for _, expr := range c.Redact {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid redact pattern: %v", path, err)
+			}
+			dc.redact = append(slices.Clip(dc.redact), re)
+		}
+	}
+	return dc, nil
+}
@@ -0,0 +1,37 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	tests := []struct {
+		flags map[string]string
+		err   string // if set, the error contains it
+	}{
+		{map[string]string{"refresh": "true", "format": "sarif"}, ""},
+		{map[string]string{"cpu-limit": "10s", "mem-limit": "1G"}, ""},
+		{map[string]string{"output-limit": "1T"}, "can only be given on the command line"},
+		{map[string]string{"w": "true"}, "can only be given on the command line"},
+		{map[string]string{"trust-all": "true"}, "can only be given on the command line"},
+		{map[string]string{"user": "nobody"}, "can only be given on the command line"},
+		{map[string]string{"no-such-flag": "1"}, "unknown flag"},
+	}
+	for _, tt := range tests {
+		err := checkConfig("gosh.yaml", &config{Flags: tt.flags})
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("checkConfig(%v): %v", tt.flags, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("checkConfig(%v) = %v, want error containing %q", tt.flags, err, tt.err)
+		}
+	}
+	if err := checkConfig("gosh.yaml", &config{Passthrough: []string{"HOME"}}); err == nil {
+		t.Errorf("checkConfig allowed env-passthrough")
+	}
+}
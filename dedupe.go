@@ -0,0 +1,61 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// A deduper runs each distinct command only once,
+// sharing its output with every occurrence of the command.
+// Commands are the same if they have the same cache key,
+// which covers everything that can affect their output.
+// Only successful runs are shared, so that a command that fails
+// runs again for its next occurrence, or when it's retried.
+type deduper struct {
+	mu   sync.Mutex
+	runs map[string]*dedupeRun
+}
+
+type dedupeRun struct {
+	mu     sync.Mutex // held while the command runs
+	done   bool       // whether the command succeeded
+	output []byte
+}
+
+func newDeduper() *deduper {
+	return &deduper{runs: make(map[string]*dedupeRun)}
+}
+
+// do runs c with f, unless a command that's the same as c already ran
+// successfully, and returns the command's output.
+func (d *deduper) do(ctx context.Context, c *gosh.Command, f func(context.Context, *gosh.Command) ([]byte, error)) ([]byte, error) {
+	key, err := cacheKey(c)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	r := d.runs[key]
+	if r == nil {
+		r = new(dedupeRun)
+		d.runs[key] = r
+	}
+	d.mu.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done {
+		return r.output, nil
+	}
+	output, err := f(ctx, c)
+	if err == nil {
+		r.output, r.done = output, true
+	}
+	return output, err
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+func TestDedupe(t *testing.T) {
+	base := gosh.Command{Prompt: "date", Dir: "/src", Environ: []string{"HOME=/home/me"}}
+	tests := []struct {
+		name   string
+		change func(c *gosh.Command)
+		same   bool
+	}{
+		{"same", func(c *gosh.Command) {}, true},
+		{"position", func(c *gosh.Command) { c.Pos.Line = 10 }, true},
+		{"prompt", func(c *gosh.Command) { c.Prompt = "date -u" }, false},
+		{"dir", func(c *gosh.Command) { c.Dir = "/tmp" }, false},
+		{"shell", func(c *gosh.Command) { c.Shell = "bash" }, false},
+		{"environ", func(c *gosh.Command) { c.Environ = []string{"HOME=/root"} }, false},
+		{"env", func(c *gosh.Command) { c.Env = []string{"TZ=UTC"} }, false},
+		{"stderr", func(c *gosh.Command) { c.Stderr = true }, false},
+		{"pty", func(c *gosh.Command) { c.PTY = true }, false},
+		{"pty size", func(c *gosh.Command) { c.PTY, c.PTYCols = true, 120 }, false},
+		{"cpu", func(c *gosh.Command) { c.CPULimit = time.Second }, false},
+		{"mem", func(c *gosh.Command) { c.MemLimit = 1 << 20 }, false},
+		{"output limit", func(c *gosh.Command) { c.OutputLimit = 1 << 10 }, false},
+		{"image", func(c *gosh.Command) { c.Image = "alpine" }, false},
+		{"host", func(c *gosh.Command) { c.Host = "build01" }, false},
+	}
+	for _, tt := range tests {
+		d := newDeduper()
+		runs := 0
+		f := func(ctx context.Context, c *gosh.Command) ([]byte, error) {
+			runs++
+			return []byte(c.Prompt), nil
+		}
+		c := base
+		tt.change(&c)
+		for _, c := range []*gosh.Command{&base, &c} {
+			if _, err := d.do(context.Background(), c, f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if want := map[bool]int{true: 1, false: 2}[tt.same]; runs != want {
+			t.Errorf("%s: ran %d times, want %d", tt.name, runs, want)
+		}
+	}
+}
+
+func TestDedupeFailure(t *testing.T) {
+	d := newDeduper()
+	c := &gosh.Command{Prompt: "flaky", Dir: "/src"}
+	runs := 0
+	f := func(ctx context.Context, c *gosh.Command) ([]byte, error) {
+		runs++
+		if runs == 1 {
+			return nil, errors.New("failed")
+		}
+		return []byte("ok"), nil
+	}
+	tests := []struct {
+		output string
+		err    bool
+		runs   int
+	}{
+		{"", true, 1},    // the first run fails
+		{"ok", false, 2}, // so the retry runs again
+		{"ok", false, 2}, // and later occurrences reuse its output
+	}
+	for i, tt := range tests {
+		output, err := d.do(context.Background(), c, f)
+		if string(output) != tt.output || (err != nil) != tt.err || runs != tt.runs {
+			t.Errorf("run %d: got %q, %v after %d runs, want %q, error %v after %d runs", i, output, err, runs, tt.output, tt.err, tt.runs)
+		}
+	}
+}
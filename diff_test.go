@@ -0,0 +1,33 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestDiff(t *testing.T) {
+	tests := []struct {
+		old, new string
+		want     string
+	}{
+		{"a\nb\n", "a\nb\n", ""},
+		{
+			"a\nb\nc\n", "a\nB\nc\n",
+			"diff old new\n--- old\n+++ new\n@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			"1\n2\n3\n4\n5\n6\n7\n8\n9\n", "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n",
+			"diff old new\n--- old\n+++ new\n@@ -7,3 +7,4 @@\n 7\n 8\n 9\n+10\n",
+		},
+		{
+			"a\nb\n", "a\nb",
+			"diff old new\n--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+		},
+	}
+	for _, tt := range tests {
+		if got := string(diff("old", []byte(tt.old), "new", []byte(tt.new))); got != tt.want {
+			t.Errorf("diff(%q, %q):\n%s\nwant:\n%s", tt.old, tt.new, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/token"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+var dryRunMu sync.Mutex
+
+// dryRunFile prints each command in filePath, whether it would run,
+// and if so, how, without running anything.
+func dryRunFile(filePath string) error {
+	src, err := readFile(filePath)
+	if err != nil {
+		return err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
+	type line struct {
+		pos token.Position
+		msg string
+	}
+	var lines []line
+	reported := make(map[token.Position]bool)
+	sel := selector()
+	opts := gosh.Options{
+		Filename: filePath,
+		Lang:     *flagLang,
+		Refresh:  *flagRefresh,
+		Shell:    *flagShell,
+		Policy:   policy,
+		Select: func(c *gosh.Command) bool {
+			if reported[c.Pos] {
+				// Rejected, as reported by Warn.
+				return false
+			}
+			if sel != nil && !sel(c) {
+				lines = append(lines, line{c.Pos, fmt.Sprintf("command %q not run: not selected", c.Prompt)})
+				return false
+			}
+			lines = append(lines, line{c.Pos, fmt.Sprintf("command %q would run %s", c.Prompt, dryRunHow(c, wd))})
+			return false
+		},
+		Warn: func(pos token.Position, msg string) {
+			reported[pos] = true
+			lines = append(lines, line{pos, msg})
+		},
+	}
+	if err := applyDirConfig(&opts); err != nil {
+		return err
+	}
+	if _, _, err := gosh.Process(context.Background(), src, opts); err != nil {
+		return err
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].pos.Offset < lines[j].pos.Offset })
+
+	dryRunMu.Lock()
+	defer dryRunMu.Unlock()
+	for _, l := range lines {
+		fmt.Printf("%s: %s\n", l.pos, l.msg)
+	}
+	return nil
+}
+
+// dryRunHow describes how c would run: with which shell,
+// where, and in which directory, if not wd.
+func dryRunHow(c *gosh.Command, wd string) string {
+	shell := c.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+	how := []string{"with " + shell}
+	if *flagRunner != "" {
+		how = append(how, "by "+*flagRunner)
+	}
+	switch {
+	case c.Image != "":
+		how = append(how, fmt.Sprintf("in image %s", c.Image))
+	case c.Host != "":
+		how = append(how, fmt.Sprintf("on host %s", c.Host))
+	}
+	if c.Session {
+		how = append(how, "in the file's session")
+	}
+	dir := c.Dir
+	if dir == "" {
+		dir = wd
+	}
+	how = append(how, "in directory "+dir)
+	return strings.Join(how, " ")
+}
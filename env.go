@@ -0,0 +1,65 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// baseEnv lists the environment variables that commands
+// always inherit, which many programs need to work.
+var baseEnv = []string{
+	"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TMPDIR", "TERM", "TZ", "LANG", "LC_*",
+}
+
+// windowsEnv lists the environment variables that commands
+// also inherit on Windows.
+var windowsEnv = []string{
+	"SYSTEMROOT", "SYSTEMDRIVE", "COMSPEC", "PATHEXT", "WINDIR",
+	"TEMP", "TMP", "USERPROFILE", "APPDATA", "LOCALAPPDATA", "PROGRAMDATA",
+}
+
+// cleanEnviron returns the environment for commands: the variables
+// of this process named by baseEnv or passthrough, which may contain
+// patterns like "AWS_*", as for path.Match.
+func cleanEnviron(passthrough []string) []string {
+	patterns := append(baseEnv[:len(baseEnv):len(baseEnv)], passthrough...)
+	if runtime.GOOS == "windows" {
+		patterns = append(patterns, windowsEnv...)
+	}
+	env := []string{}
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if runtime.GOOS == "windows" {
+			name = strings.ToUpper(name)
+		}
+		for _, p := range patterns {
+			if runtime.GOOS == "windows" {
+				p = strings.ToUpper(p)
+			}
+			if ok, _ := path.Match(p, name); ok {
+				env = append(env, kv)
+				break
+			}
+		}
+	}
+	return env
+}
+
+// envPassthrough returns the -env-passthrough names.
+func envPassthrough() []string {
+	var names []string
+	for _, list := range flagPassthrough {
+		for _, name := range strings.Split(list, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,90 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A stringsFlag is a flag that may be repeated,
+// collecting each value.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringsFlag) Set(s string) error {
+	*f = append(*f, s)
+	return nil
+}
+
+// excludePatterns returns the -exclude patterns, and those from
+// the configuration file at configPath, as absolute patterns.
+func excludePatterns(configPath string) ([]string, error) {
+	var patterns []string
+	if configPath != "" {
+		dir := filepath.Dir(configPath)
+		for _, p := range conf.Exclude {
+			patterns = append(patterns, filepath.ToSlash(filepath.Join(dir, p)))
+		}
+	}
+	for _, p := range flagExclude {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, filepath.ToSlash(abs))
+	}
+	return patterns, nil
+}
+
+// excludeFiles returns the files from files that match none of patterns.
+func excludeFiles(files, patterns []string) []string {
+	if len(patterns) == 0 {
+		return files
+	}
+	var res []string
+Files:
+	for _, file := range files {
+		name := filepath.ToSlash(file)
+		for _, p := range patterns {
+			if matchGlob(p, name) {
+				continue Files
+			}
+		}
+		res = append(res, file)
+	}
+	return res
+}
+
+// matchGlob reports whether the slash-separated name matches pattern.
+// Pattern elements are matched as by path.Match, except that
+// a "**" element matches any number of elements, including none.
+// A pattern matching a directory matches everything within it.
+func matchGlob(pattern, name string) bool {
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// execCommand implements the "gosh exec" subcommand.
+// It runs command as if it were in a comment of a file
+// in the current directory, and prints the comment it would produce.
+func execCommand(args []string) error {
+	if len(args) != 1 || strings.TrimSpace(args[0]) == "" {
+		return usagef("usage: gosh exec command")
+	}
+
+	// The command goes in a file of its own, where it's enabled.
+	filename, leader := "exec.go", "//"
+	if *flagLang != "" {
+		filename, leader = "exec.txt", gosh.CommentLeader("", *flagLang)
+	}
+	var src strings.Builder
+	if filename == "exec.go" {
+		src.WriteString("package p\n\n")
+	}
+	fmt.Fprintf(&src, "%sgosh:ok\n\n", leader)
+	for i, line := range strings.Split(strings.TrimSpace(args[0]), "\n") {
+		if i == 0 {
+			line = "% " + line
+		}
+		fmt.Fprintf(&src, "%s %s\n", leader, line)
+	}
+
+	opts, err := options(filename)
+	if err != nil {
+		return err
+	}
+	_, results, err := gosh.Process(mainCtx, []byte(src.String()), opts)
+	if len(results) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no command in %q", args[0])
+		}
+		return err
+	}
+	r := results[0]
+	if r.Err != nil {
+		return r.Err
+	}
+	out := r.New
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	_, err = os.Stdout.WriteString(out)
+	return err
+}
@@ -0,0 +1,46 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// Exit statuses.
+const (
+	exitStale  = 1 // -check found files that need changes, or -lint found problems
+	exitFailed = 2 // a command failed, or gosh couldn't process a file
+	exitUsage  = 3 // the command line is invalid
+)
+
+// A usageError reports an invalid command line.
+type usageError struct{ msg string }
+
+func (e *usageError) Error() string { return e.msg }
+
+// usagef returns a usageError with the given message.
+func usagef(format string, args ...any) error {
+	return &usageError{fmt.Sprintf(format, args...)}
+}
+
+// fatal logs err and exits with exitUsage for a usageError,
+// or exitFailed otherwise.
+func fatal(err error) {
+	slog.Error(err.Error())
+	var ue *usageError
+	if errors.As(err, &ue) {
+		exit(exitUsage)
+	}
+	exit(exitFailed)
+}
+
+// exit stops profiling, if enabled, and exits with the given status.
+func exit(code int) {
+	stopProfiling()
+	os.Exit(code)
+}
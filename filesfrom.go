@@ -0,0 +1,71 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// readFileList returns the files listed in the file named name,
+// or standard input if name is "-", for -files-from.
+// The names are separated by newlines, or by NUL bytes if there are any,
+// as printed by commands like "git diff --name-only -z".
+// Relative names are relative to the current directory, as printed
+// with "git diff --relative", or else to the top of the git work tree,
+// as printed without it.
+// Files that don't exist, like those deleted in a diff, are skipped.
+func readFileList(name string) ([]string, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sep := "\n"
+	if bytes.IndexByte(data, 0) >= 0 {
+		sep = "\x00"
+	}
+	var files []string
+	top, topErr := "", error(nil)
+	for _, file := range strings.Split(string(data), sep) {
+		if sep == "\n" {
+			file = strings.TrimSuffix(file, "\r")
+		}
+		if file == "" {
+			continue
+		}
+		if _, err := os.Stat(file); err != nil && !filepath.IsAbs(file) {
+			if top == "" && topErr == nil {
+				var out []byte
+				out, topErr = git("rev-parse", "--show-toplevel")
+				top = strings.TrimSpace(string(out))
+			}
+			if top != "" {
+				file = filepath.Join(top, filepath.FromSlash(file))
+			}
+		}
+		fi, err := os.Stat(file)
+		if err != nil || !fi.Mode().IsRegular() {
+			slog.Debug("skipping missing file", "file", file)
+			continue
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, abs)
+	}
+	return files, nil
+}
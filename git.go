@@ -0,0 +1,117 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitChanged returns the set of files that git reports as changed,
+// as absolute paths. If staged is true, it reports files with
+// changes staged in the index. Otherwise, it reports files in the
+// working tree that differ from ref, including untracked files.
+func gitChanged(ref string, staged bool) (map[string]bool, error) {
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, err
+	}
+	root := strings.TrimSpace(string(top))
+
+	var lists [][]byte
+	if staged {
+		out, err := git("diff", "--cached", "--name-only", "-z", "--diff-filter=d")
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, out)
+	} else {
+		out, err := git("diff", "--name-only", "-z", "--diff-filter=d", ref, "--")
+		if err != nil {
+			return nil, err
+		}
+		untracked, err := git("ls-files", "--others", "--exclude-standard", "--full-name", "-z")
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, out, untracked)
+	}
+
+	changed := make(map[string]bool)
+	for _, list := range lists {
+		for _, name := range bytes.Split(list, []byte{0}) {
+			if len(name) > 0 {
+				changed[filepath.Join(root, filepath.FromSlash(string(name)))] = true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// overlayStaged adds the contents of files staged in git to the overlay,
+// for -staged, so that they're processed as they'll be committed,
+// not as they are in the working tree.
+func overlayStaged(files []string) error {
+	top, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	root := strings.TrimSpace(string(top))
+	if overlay == nil {
+		overlay = make(map[string][]byte)
+	}
+	for _, file := range files {
+		path := file
+		if real, err := filepath.EvalSymlinks(file); err == nil {
+			path = real
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		data, err := git("show", ":"+filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		overlay[abs] = data
+	}
+	return nil
+}
+
+// filterChanged returns the files from files that are in changed.
+func filterChanged(files []string, changed map[string]bool) []string {
+	var res []string
+	for _, file := range files {
+		path := file
+		if real, err := filepath.EvalSymlinks(file); err == nil {
+			path = real
+		}
+		if changed[path] {
+			res = append(res, file)
+		}
+	}
+	return res
+}
+
+// git runs git with args and returns its output.
+func git(args ...string) ([]byte, error) {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) && len(ee.Stderr) > 0 {
+			return nil, fmt.Errorf("git %s: %s", args[0], bytes.TrimSpace(ee.Stderr))
+		}
+		return nil, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return out, nil
+}
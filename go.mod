@@ -3,8 +3,11 @@ module github.com/mdempsky/gosh
 go 1.22.1
 
 require (
+	github.com/fsnotify/fsnotify v1.7.0
 	golang.org/x/sync v0.7.0
+	golang.org/x/sys v0.19.0
 	golang.org/x/tools v0.20.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/mod v0.17.0 // indirect
@@ -6,246 +6,848 @@
 //
 // Usage:
 //
-//	gosh [-w] [packages]
+//	gosh [-w | -d | -check] [-refresh] [-cache] [-watch] [-since ref | -staged] [-lang language] [packages] [files]
+//	gosh allow file|dir...
+//	gosh exec command
+//	gosh hook install|uninstall
+//	gosh lsp
 //
 // Gosh searches source files for comments that start with "// % " or "/* % ".
 // It then runs the first line of the comment as a shell command,
 // and replaces the remaining lines with the output of the command.
 // It also replaces the "%" with "#".
 // Shell commands are run concurrently.
+// With -w, gosh writes the rewritten files back; by default, it prints them.
 //
 // For security, shell commands are disabled by default.
 // The "//gosh:ok" directive enables commands,
 // and the "//gosh:deny" directive disables them again.
 // Both directives only apply to the end of their innermost scope.
+// Even then, gosh only runs the commands in a file once the user
+// trusts them, as with "gosh allow".
+//
+// See https://github.com/mdempsky/gosh#readme for the other directives,
+// the flags, the gosh.yaml configuration file, and the subcommands.
 package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"go/format"
-	"go/scanner"
+	"go/ast"
+	"go/parser"
 	"go/token"
-	"log"
+	"log/slog"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"github.com/mdempsky/gosh/pkg/gosh"
 	"golang.org/x/sync/errgroup"
 	"golang.org/x/tools/go/packages"
 )
 
-var flagWrite = flag.Bool("w", false, "write result back to source file instead of stdout")
+var (
+	flagWrite      = flag.Bool("w", false, "write result back to source file instead of stdout")
+	flagBackup     = flag.String("backup", "", "with -w, save the original contents of changed files to files with `suffix`, like .orig")
+	flagBkDir      = flag.String("backup-dir", "", "with -backup, save backup files in `dir` instead of next to the originals")
+	flagForce      = flag.Bool("force", false, "with -w, also overwrite read-only files")
+	flagSymlinks   = flag.String("symlinks", "follow", "how to treat symbolic links, by `mode`: follow (rewrite the target), replace (replace the link with a file), or skip")
+	flagDiff       = flag.Bool("d", false, "display diffs instead of rewriting files")
+	flagCheck      = flag.Bool("check", false, "display diffs and fail if any files need changes")
+	flagRefresh    = flag.Bool("refresh", false, "also rerun previously run commands")
+	flagCache      = flag.Bool("cache", false, "reuse cached output of previously run commands")
+	flagWatch      = flag.Bool("watch", false, "keep running and process files again when they change")
+	flagSince      = flag.String("since", "", "only process files changed since git `ref`")
+	flagStaged     = flag.Bool("staged", false, "only process files with changes staged in git")
+	flagGenerated  = flag.Bool("include-generated", false, "also process generated Go files")
+	flagVendor     = flag.Bool("include-vendor", false, "also process files in vendor directories")
+	flagDriver     = flag.Bool("driver-files", false, "use the file lists from the packages driver as is, without skipping missing files or vendor directories")
+	flagChdir      = flag.String("C", "", "change to `dir` before doing anything else")
+	flagMod        = flag.String("mod", "", "module download `mode` to use when loading packages, as for go build")
+	flagModfile    = flag.String("modfile", "", "use `file` instead of go.mod when loading packages, as for go build")
+	flagVCS        = flag.String("buildvcs", "", "whether to stamp version control information when loading packages, as for go build (`value`)")
+	flagTests      = flag.Bool("tests", true, "also process test files")
+	flagTags       = flag.String("tags", "", "comma-separated list of build `tags` to consider satisfied")
+	flagAll        = flag.Bool("allfiles", false, "process all Go files in each package directory, ignoring build constraints")
+	flagJSON       = flag.Bool("json", false, "print the edits for each file as JSON instead of rewriting files")
+	flagOverlay    = flag.String("overlay", "", "read overlay `file` replacing the contents of source files, as for go build")
+	flagQuiet      = flag.Bool("q", false, "don't report progress or print a summary")
+	flagVerbose    = flag.Bool("v", false, "also log each directive and command as it's processed")
+	flagShell      = flag.String("shell", "", "run commands with `shell` instead of sh")
+	flagTimeout    = flag.Duration("timeout", 0, "fail commands that run longer than `duration`")
+	flagCPU        = flag.Duration("cpu-limit", 0, "limit the CPU time of each process a command starts to `duration`")
+	flagUser       = flag.String("user", "", "run commands as `user`, a user name or ID optionally followed by :group")
+	flagNoNet      = flag.Bool("no-network", false, "run commands without network access")
+	flagTrustAll   = flag.Bool("trust-all", false, "run commands in files not trusted by \"gosh allow\", as in CI")
+	flagNext       = flag.Bool("next", false, "when run by go generate, only run the command after the go:generate line")
+	flagRuntime    = flag.String("runtime", "docker", "run commands with container images using `runtime`, like docker or podman")
+	flagSSHConfig  = flag.String("ssh-config", "", "run commands on remote hosts using ssh configuration `file`")
+	flagJobs       = flag.Int("jobs", 0, "run at most `n` commands at once, or any number if 0")
+	flagFileJobs   = flag.Int("file-jobs", 0, "process at most `n` files at once, or any number if 0")
+	flagFiles      = flag.Bool("files", false, "find Go files by walking directories instead of loading packages")
+	flagCPUProf    = flag.String("cpuprofile", "", "write a CPU profile to `file`")
+	flagMemProf    = flag.String("memprofile", "", "write a memory profile to `file` before exiting")
+	flagTrace      = flag.String("trace", "", "write an execution trace to `file`")
+	flagSlowest    = flag.Int("slowest", 0, "after the run, print the `n` slowest commands")
+	flagStats      = flag.String("stats", "", "after the run, write the running time of each command to `file` as JSON")
+	flagTrim       = flag.Bool("trim", false, "normalize white space in the output of every command, as for gosh:trim")
+	flagEmpty      = flag.String("empty", "", "insert `text` as the output of commands that print nothing")
+	flagFilesFrom  = flag.String("files-from", "", "process the files listed in `file`, one per line or separated by NUL bytes, or standard input if -")
+	flagSrcdir     = flag.String("srcdir", "", "process standard input as if it were the file at `path`, printing the result")
+	flagSaveHook   = flag.Bool("save-hook", false, "with -srcdir, only fill in cached output, printing the source unchanged on any problem, for editors")
+	flagSaveBudget = flag.Duration("save-budget", 500*time.Millisecond, "with -save-hook, print the source unchanged if processing takes longer than `duration`")
+	flagServe      = flag.String("serve", "", "run as a daemon, processing the files requested on the unix `socket`")
+	flagPostRun    = flag.String("post-run", "", "after the run, run the shell `command`, with a summary of the run in its environment")
+	flagRunner     = flag.String("runner", "", "run commands by giving them as JSON to `program`, instead of running them with the shell")
+	flagVersion    = flag.Bool("version", false, "print the gosh version and exit")
+	flagLogFmt     = flag.String("log-format", "", "log in `format` (text or json) instead of plain messages")
+	flagLogLvl     = flag.String("log-level", "", "log messages at `level` (debug, info, warn, or error) and above")
+	flagLang       = flag.String("lang", "", "process other files as `language`, or with the given line comment leader")
+	flagDedupe     = flag.Bool("dedupe", false, "run identical commands only once, reusing their output")
+	flagRun        = flag.String("run", "", "only run commands whose name or text matches `regexp`")
+	flagTrailer    = flag.Bool("trailer", false, "append each command's exit status and running time to its output")
+	flagLint       = flag.Bool("lint", false, "report problems like commands that aren't allowed to run, without running anything")
+	flagDryRun     = flag.Bool("n", false, "print the commands that would run, without running anything")
+	flagKeep       = flag.Bool("keep-going", false, "keep going after commands fail, rewriting the rest, and report all failures at the end")
+	flagFormat     = flag.String("format", "", "print a report in `format` (junit, sarif, or quickfix) instead of rewriting files")
+)
+
+// flagExclude holds the -exclude patterns.
+var flagExclude stringsFlag
+
+// flagMem holds the -mem-limit size.
+var flagMem sizeFlag
+
+// flagOutput holds the -output-limit size.
+var flagOutput sizeFlag
+
+// flagPassthrough holds the -env-passthrough variable names.
+var flagPassthrough stringsFlag
+
+func init() {
+	flag.Var(&flagExclude, "exclude", "skip files matching `pattern`, which may contain \"**\"; may be repeated")
+	flag.Var(&flagPassthrough, "env-passthrough", "let commands inherit the environment variables `names`, a comma-separated list of names or patterns like AWS_*; may be repeated")
+	flag.Var(&flagMem, "mem-limit", "limit the virtual memory of each process a command starts to `size`, like 512M")
+	flag.Var(&flagOutput, "output-limit", "fail commands whose output is longer than `size`, like 10M")
+}
+
+// prog tracks the progress of the run, unless -q is given.
+var prog *progress
+
+// outputCache is the command output cache, if enabled by -cache.
+var outputCache *cache
+
+// dedupe runs identical commands only once, if enabled by -dedupe.
+var dedupe *deduper
+
+// jobSlots holds a value for each command that's running,
+// if their number is limited by -jobs.
+var jobSlots chan struct{}
+
+// runFilter selects the commands to run, if set by -run.
+var runFilter *regexp.Regexp
+
+// mountDir is the directory mounted in containers: the module root, if any.
+var mountDir string
+
+// mainCtx is canceled when gosh is interrupted,
+// killing the commands that are running.
+var mainCtx = context.Background()
+
+// nextLine is the line of the go:generate directive that ran gosh,
+// if -next is given.
+var nextLine int
+
+// redactions are the patterns to redact from command output.
+var redactions []*regexp.Regexp
+
+// environ is the environment that commands start with.
+var environ []string
+
+// procAttr holds the attributes for command processes,
+// if set by -user or -no-network.
+var procAttr *syscall.SysProcAttr
+
+// netEnv holds environment variables for commands set by -no-network.
+var netEnv []string
+
+// containerArgs holds the container runtime arguments that apply
+// -user and -no-network to commands run in containers.
+var containerArgs []string
+
+// stale reports whether -check found a file that needs changes.
+var stale atomic.Bool
 
 func main() {
-	flag.Parse()
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if err == flag.ErrHelp {
+			return
+		}
+		os.Exit(exitUsage)
+	}
+	var stop context.CancelFunc
+	mainCtx, stop = signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		// Let another interrupt stop gosh at once.
+		<-mainCtx.Done()
+		stop()
+	}()
+	if *flagVersion {
+		fmt.Println(version())
+		return
+	}
+	if *flagChdir != "" {
+		if err := os.Chdir(*flagChdir); err != nil {
+			fatal(err)
+		}
+	}
+	visitFlags()
+	configPath, c, err := loadConfig()
+	if err != nil {
+		fatal(err)
+	}
+	if c != nil {
+		if err := applyConfig(configPath, c); err != nil {
+			fatal(usagef("%v", err))
+		}
+		conf = *c
+	}
+	if *flagVerbose && *flagQuiet {
+		fatal(usagef("-v and -q are mutually exclusive"))
+	}
+	if err := setupLogging(); err != nil {
+		fatal(err)
+	}
+	redactions, err = configRedact(configPath, &conf)
+	if err != nil {
+		fatal(usagef("%v", err))
+	}
+	environ = cleanEnviron(envPassthrough())
+	policy, err = loadPolicy()
+	if err != nil {
+		fatal(err)
+	}
+	mountDir, err = moduleRoot()
+	if err != nil {
+		fatal(err)
+	}
+	if *flagRunner != "" && (*flagUser != "" || *flagNoNet) {
+		fatal(usagef("-runner can't be used with -user or -no-network"))
+	}
+	if *flagUser != "" {
+		procAttr, err = userProcAttr(*flagUser)
+		if err != nil {
+			fatal(usagef("invalid -user: %v", err))
+		}
+		containerArgs = append(containerArgs, userContainerArgs(procAttr)...)
+	}
+	if *flagNoNet {
+		procAttr, netEnv = isolateNetwork(procAttr)
+		containerArgs = append(containerArgs, "--network=none")
+	}
 
 	args := flag.Args()
-	if len(args) == 0 {
-		args = []string{"."}
+	if len(args) > 0 {
+		var sub func([]string) error
+		switch args[0] {
+		case "allow":
+			sub = allow
+		case "exec":
+			sub = execCommand
+		case "hook":
+			sub = hook
+		case "lsp":
+			sub = lsp
+		}
+		if sub != nil {
+			if err := sub(args[1:]); err != nil {
+				fatal(err)
+			}
+			return
+		}
+	}
+	if err := startProfiling(); err != nil {
+		fatal(err)
+	}
+	if !*flagTrustAll && !*flagLint && !*flagDryRun && !*flagSaveHook {
+		var err error
+		trust, err = openTrust()
+		if err != nil {
+			fatal(err)
+		}
+	}
+	if *flagCache {
+		var err error
+		outputCache, err = openCache()
+		if err != nil {
+			fatal(err)
+		}
 	}
 
-	cfg := packages.Config{
-		Mode: packages.NeedFiles,
+	if *flagOverlay != "" {
+		var err error
+		overlay, err = loadOverlay(*flagOverlay)
+		if err != nil {
+			fatal(err)
+		}
 	}
-	pkgs, err := packages.Load(&cfg, args...)
-	if err != nil {
-		log.Fatal(err)
+
+	if *flagFileJobs < 0 || *flagJobs < 0 {
+		fatal(usagef("-file-jobs and -jobs can't be negative"))
+	}
+	if *flagJobs > 0 {
+		jobSlots = make(chan struct{}, *flagJobs)
 	}
 
-	var g errgroup.Group
-	for _, pkg := range pkgs {
-		for _, filePath := range pkg.GoFiles {
-			g.Go(func() error {
-				return gosh(filePath)
-			})
+	if *flagRun != "" {
+		var err error
+		runFilter, err = regexp.Compile(*flagRun)
+		if err != nil {
+			fatal(usagef("invalid -run: %v", err))
 		}
 	}
-	if err := g.Wait(); err != nil {
-		log.Fatal(err)
+	if !validSymlinks(*flagSymlinks) {
+		fatal(usagef("unknown -symlinks mode %q", *flagSymlinks))
+	}
+	if *flagFormat != "" && !validFormat(*flagFormat) {
+		fatal(usagef("unknown report format %q", *flagFormat))
 	}
-}
 
-func gosh(filePath string) error {
-	fileData, err := os.ReadFile(filePath)
+	if *flagServe != "" {
+		if len(args) > 0 {
+			fatal(usagef("-serve takes files to process in requests, not arguments"))
+		}
+		if err := serve(*flagServe); err != nil {
+			fatal(err)
+		}
+		exit(0)
+	}
+	if *flagSaveHook && *flagSrcdir == "" {
+		fatal(usagef("-save-hook requires -srcdir"))
+	}
+	if *flagSrcdir != "" {
+		if len(args) > 0 || *flagFilesFrom != "" {
+			fatal(usagef("-srcdir reads standard input, and can't be used with files to process"))
+		}
+		if *flagSaveHook {
+			saveHook(*flagSrcdir)
+		}
+		if err := processStdin(*flagSrcdir); err != nil {
+			fatal(err)
+		}
+		exit(0)
+	}
+	if len(args) == 0 && os.Getenv("GOFILE") != "" {
+		// Run by go generate: process just the file that ran gosh.
+		args = []string{os.Getenv("GOFILE")}
+	}
+	if *flagNext {
+		line, err := strconv.Atoi(os.Getenv("GOLINE"))
+		if err != nil {
+			fatal(usagef("-next requires running gosh with go generate"))
+		}
+		nextLine = line
+	}
+	var files []string
+	if *flagFilesFrom != "" {
+		if len(args) > 0 {
+			fatal(usagef("-files-from can't be used with package or file arguments"))
+		}
+		files, err = readFileList(*flagFilesFrom)
+	} else {
+		files, err = loadFiles(args)
+	}
 	if err != nil {
-		return err
+		fatal(err)
+	}
+	excludes, err := excludePatterns(configPath)
+	if err != nil {
+		fatal(err)
+	}
+	files = excludeFiles(files, excludes)
+	if *flagSymlinks == "skip" {
+		files = skipSymlinks(files)
 	}
 
-	fset := token.NewFileSet()
-	file := fset.AddFile(filePath, -1, len(fileData))
-
-	var s scanner.Scanner
-	s.Init(file, fileData, nil, scanner.ScanComments)
-
-	allowed := stack[bool]{false}
-
-	type edit struct {
-		pos, end token.Pos
-		text     string
-	}
-	var asyncEdits asyncSlice[edit]
-Outer:
-	for {
-		switch pos, tok, lit := s.Scan(); tok {
-		case token.EOF:
-			break Outer
-
-		case token.LBRACE:
-			allowed.push(allowed.top())
-
-		case token.RBRACE:
-			allowed.pop()
-
-		case token.COMMENT:
-			// Process directives.
-			const prefix = "//gosh:"
-			if cmd, ok := strings.CutPrefix(lit, prefix); ok {
-				pos := pos + token.Pos(len(prefix))
-				switch cmd {
-				case "ok":
-					// fmt.Printf("%s: ok\n", fset.Position(pos))
-					allowed.setTop(true)
-				case "deny":
-					// fmt.Printf("%s: deny\n", fset.Position(pos))
-					allowed.setTop(false)
-				default:
-					log.Fatalf("%s: unknown command: %s\n", fset.Position(pos), cmd)
-				}
-				continue
+	if *flagSince != "" || *flagStaged {
+		changed, err := gitChanged(*flagSince, *flagStaged)
+		if err != nil {
+			fatal(err)
+		}
+		files = filterChanged(files, changed)
+		if *flagStaged && !*flagWrite {
+			if err := overlayStaged(files); err != nil {
+				fatal(err)
 			}
+		}
+	}
 
-			// Unit testing logic.
-			if false {
-				want := func(ok bool) {
-					if allowed.top() != ok {
-						log.Fatalf("%s: want ok=%v, but allowed=%v", fset.Position(pos), ok, allowed)
-					}
-				}
-				switch text := lit; {
-				case strings.Contains(text, "% ok"):
-					want(true)
-				case strings.Contains(text, "% FAIL"):
-					want(false)
-				}
+	if *flagWatch {
+		if !*flagWrite {
+			*flagDiff = true
+		}
+		fatal(watch(files, excludes))
+	}
+
+	if *flagDedupe {
+		dedupe = newDeduper()
+	}
+	if !*flagQuiet && *flagFormat != "quickfix" {
+		prog = startProgress(len(files))
+	}
+
+	var (
+		g      errgroup.Group
+		errsMu sync.Mutex
+		errs   []error
+	)
+	if *flagFileJobs > 0 {
+		g.SetLimit(*flagFileJobs)
+	}
+	for _, filePath := range files {
+		g.Go(func() error {
+			defer prog.fileDone()
+			err := processFile(filePath)
+			if err != nil && *flagKeep {
+				errsMu.Lock()
+				errs = append(errs, err)
+				errsMu.Unlock()
+				return nil
 			}
+			return err
+		})
+	}
+	err = g.Wait()
+	prog.finish()
+	if serr := reportStats(); serr != nil {
+		fatal(serr)
+	}
+	if len(errs) > 0 {
+		slices.SortFunc(errs, func(a, b error) int { return strings.Compare(a.Error(), b.Error()) })
+		err = errors.Join(errs...)
+	}
+	if *flagFormat != "" {
+		if err := writeReport(); err != nil {
+			fatal(err)
+		}
+	}
+	code := 0
+	switch {
+	case err != nil:
+		if *flagFormat != "quickfix" { // which reports the errors itself
+			slog.Error(err.Error())
+		}
+		code = exitFailed
+	case stale.Load() || warned.Load():
+		code = exitStale
+	}
+	if err := postRun(code); err != nil {
+		slog.Error(err.Error())
+		if code == 0 {
+			code = exitFailed
+		}
+	}
+	exit(code)
+}
 
-			if !allowed.top() {
-				continue
+// loadFiles returns the files named by the command-line arguments.
+// Arguments naming files are used directly,
+// and the rest are loaded as package patterns,
+// or walked as directories with -files.
+func loadFiles(args []string) ([]string, error) {
+	var files, patterns []string
+	for _, arg := range args {
+		if isFileArg(arg) {
+			abs, err := filepath.Abs(arg)
+			if err != nil {
+				return nil, err
 			}
+			files = append(files, abs)
+			continue
+		}
+		patterns = append(patterns, arg)
+	}
+	if len(args) == 0 {
+		patterns = []string{"."}
+	}
+	if len(patterns) == 0 {
+		return files, nil
+	}
+	if *flagFiles {
+		walked, err := walkFiles(patterns)
+		for _, file := range walked {
+			pkgDirs[filepath.Dir(file)] = true
+		}
+		return append(files, walked...), err
+	}
 
-			prompt, ok := strings.CutPrefix(lit[2:], " % ")
-			if !ok {
-				continue
+	patterns, err := workspacePatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := packages.Config{
+		Mode:    packages.NeedFiles | packages.NeedModule,
+		Tests:   *flagTests,
+		Overlay: overlay,
+	}
+	if *flagTags != "" {
+		cfg.BuildFlags = append(cfg.BuildFlags, "-tags="+*flagTags)
+	}
+	if *flagMod != "" {
+		cfg.BuildFlags = append(cfg.BuildFlags, "-mod="+*flagMod)
+	}
+	if *flagModfile != "" {
+		cfg.BuildFlags = append(cfg.BuildFlags, "-modfile="+*flagModfile)
+	}
+	if *flagVCS != "" {
+		cfg.BuildFlags = append(cfg.BuildFlags, "-buildvcs="+*flagVCS)
+	}
+	pkgs, err := packages.Load(&cfg, patterns...)
+	if err != nil {
+		return nil, err
+	}
+
+	// With -tests, a file can belong to several package variants.
+	seen := make(map[string]bool)
+	for _, pkg := range pkgs {
+		// Packages with errors may still list their files,
+		// which gosh can process anyway.
+		for _, err := range pkg.Errors {
+			slog.Warn(err.Error(), "package", pkg.ID)
+		}
+		if strings.HasSuffix(pkg.ID, ".test") {
+			continue // generated test main package
+		}
+		pkgFiles := pkg.GoFiles
+		if *flagAll {
+			for _, file := range pkg.IgnoredFiles {
+				if strings.HasSuffix(file, ".go") {
+					pkgFiles = append(pkgFiles, file)
+				}
 			}
-			prompt, _, _ = strings.Cut(prompt, "\n")
-			prompt = strings.TrimSpace(prompt)
-
-			asyncEdits.append(func() (edit, error) {
-				cmd := exec.Command("sh", "-c", prompt)
-				output, err := cmd.Output()
-				if err != nil {
-					return edit{}, fmt.Errorf("%s: %v", fset.Position(pos), err)
+		}
+		for _, file := range pkgFiles {
+			if !*flagDriver {
+				if !*flagVendor && inVendor(file) {
+					continue
+				}
+				if _, err := os.Stat(file); err != nil {
+					continue // reported by the driver, but not on disk
 				}
-				text := fmt.Sprintf("/* # %s\n%s*/", prompt, output)
-				return edit{pos, pos + token.Pos(len(lit)), text}, nil
-			})
+			}
+			if !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+				pkgDirs[filepath.Dir(file)] = true
+				if pkg.Module != nil {
+					fileModules[file] = pkg.Module.Path
+					slog.Debug("loaded", "file", file, "module", pkg.Module.Path)
+				}
+			}
 		}
 	}
+	return files, nil
+}
 
-	edits, err := asyncEdits.wait()
-	if err != nil {
-		return err
+// inVendor reports whether file is within a vendor directory.
+func inVendor(file string) bool {
+	for _, elem := range strings.Split(filepath.ToSlash(filepath.Dir(file)), "/") {
+		if elem == "vendor" {
+			return true
+		}
 	}
+	return false
+}
 
-	base := token.Pos(file.Base())
-	var buf bytes.Buffer
-	pos := base
-	for _, edit := range edits {
-		buf.Write(fileData[pos-base : edit.pos-base])
-		buf.WriteString(edit.text)
-		pos = edit.end
+// isFileArg reports whether the command-line argument arg
+// names a file to process directly, rather than a package pattern.
+func isFileArg(arg string) bool {
+	switch filepath.Ext(arg) {
+	case ".go":
+		// Like gofmt, process existing Go files directly,
+		// even if they aren't part of a loadable package.
+		fi, err := os.Stat(arg)
+		return err == nil && fi.Mode().IsRegular()
+	case ".md", ".txtar":
+		return true
+	}
+	if *flagLang != "" {
+		fi, err := os.Stat(arg)
+		return err == nil && fi.Mode().IsRegular()
 	}
-	buf.Write(fileData[pos-base:])
+	return gosh.CommentLeader(arg, "") != ""
+}
 
-	out, err := format.Source(buf.Bytes())
+// processFile processes the source file at filePath
+// and writes or prints the result.
+func processFile(filePath string) error {
+	if *flagLint {
+		return lintFile(filePath)
+	}
+	if *flagDryRun {
+		return dryRunFile(filePath)
+	}
+	fileData, err := readFile(filePath)
 	if err != nil {
 		return err
 	}
-
-	if *flagWrite {
-		return os.WriteFile(filePath, out, 0666)
+	out, results, err := process(filePath, fileData)
+	recordRun(filePath, fileData, out, results)
+	if *flagJSON {
+		return emitJSON(filePath, results, err)
+	}
+	if *flagFormat != "" {
+		// As with the diffs, the file is stale if it changes.
+		changed := out != nil && !bytes.Equal(out, fileData)
+		addReport(filePath, results, changed, err)
+		if *flagCheck && changed {
+			stale.Store(true)
+		}
+		return err
+	}
+	if out == nil || len(results) == 0 {
+		// There are no edits to write or print.
+		return err
+	}
+	if err := emit(filePath, fileData, out); err != nil {
+		return err
+	}
+	if err := emitOutputs(results); err != nil {
+		return err
 	}
+	return err
+}
 
-	fmt.Printf("-- %s --\n%s", filePath, out)
+// emit writes or prints out, the processed form of filePath's contents src,
+// as selected by the command-line flags.
+func emit(filePath string, src, out []byte) error {
+	switch {
+	case *flagWrite:
+		return writeFile(filePath, src, out)
+	case *flagDiff, *flagCheck:
+		d := diff(filePath+".orig", src, filePath, out)
+		if d != nil && *flagCheck {
+			stale.Store(true)
+		}
+		if d != nil && useColor(os.Stdout) {
+			d = colorize(d)
+		}
+		os.Stdout.Write(d)
+	default:
+		fmt.Printf("-- %s --\n%s", filePath, out)
+	}
 	return nil
 }
 
-func _testdata() {
-	// By default, shell commands should not run.
-	// This is necessary for security.
-	//
-	// % FAIL
-
-	{
-		// Even within a block where commands are later allowed,
-		// we don't allow them before the directive.
-		// This is simpler to implement, and also encourages
-		// keeping the directives near the top.
-		//
-		// % FAIL
+// process runs the shell commands embedded in fileData,
+// the contents of filePath, and returns the rewritten source
+// and the results of each command.
+func process(filePath string, fileData []byte) ([]byte, []gosh.Result, error) {
+	if !*flagGenerated && isGenerated(filePath, fileData) {
+		slog.Debug("skipping generated file", "file", filePath)
+		return fileData, nil, nil
+	}
+	if trust != nil {
+		if err := trust.check(filePath, fileData); err != nil {
+			return nil, nil, err
+		}
+	}
+	opts, err := options(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	opts.Select = selector()
+	out, results, err := gosh.Process(mainCtx, fileData, opts)
+	if opts.Warn == nil {
+		warnBestEffort(results)
+	}
+	return out, results, err
+}
 
-		//gosh:ok
+// options returns the options for processing filePath,
+// as set by the command-line flags and the configuration
+// for its directory.
+func options(filePath string) (gosh.Options, error) {
+	opts := gosh.Options{
+		Filename:      filePath,
+		Lang:          *flagLang,
+		Refresh:       *flagRefresh,
+		Run:           run,
+		Shell:         *flagShell,
+		Timeout:       *flagTimeout,
+		CPULimit:      *flagCPU,
+		MemLimit:      int64(flagMem),
+		OutputLimit:   int64(flagOutput),
+		SysProcAttr:   procAttr,
+		Environ:       environ,
+		Policy:        policy,
+		Runtime:       *flagRuntime,
+		Mount:         mountDir,
+		SSHConfig:     *flagSSHConfig,
+		ContainerArgs: containerArgs,
+		Env:           append(configEnv(&conf), netEnv...),
+		Trailer:       *flagTrailer,
+		Trim:          *flagTrim,
+		Empty:         *flagEmpty,
+		KeepGoing:     *flagKeep,
+		Redact:        redactions,
+	}
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		// Unused directives and commands not enabled by gosh:ok
+		// are only worth hearing about with -v (or -lint).
+		opts.Trace = trace
+		opts.Warn = warn
+	}
+	err := applyDirConfig(&opts)
+	return opts, err
+}
 
-		// Within a block marked with "gosh:ok",
-		// shell commands are allowed.
-		//
-		// % echo ok
+// applyDirConfig applies the configuration for the directory
+// of opts.Filename to opts, if it has one of its own.
+func applyDirConfig(opts *gosh.Options) error {
+	abs, err := filepath.Abs(opts.Filename)
+	if err != nil {
+		return err
+	}
+	dc, err := configFor(filepath.Dir(abs))
+	if dc == nil || err != nil {
+		return err
+	}
+	opts.Shell = dc.shell
+	opts.Timeout = dc.timeout
+	opts.Env = append(envList(dc.env), netEnv...)
+	opts.Redact = dc.redact
+	opts.Policy = dc.policy
+	return nil
+}
 
-		{
-			// This includes nested blocks too.
-			//
-			// % echo ok
+// selector returns a function that selects the commands in a file
+// to run, as chosen by -run and -next, or nil to run them all.
+func selector() func(c *gosh.Command) bool {
+	if runFilter == nil && nextLine == 0 {
+		return nil
+	}
+	found := false
+	return func(c *gosh.Command) bool {
+		if nextLine > 0 {
+			// Only the first command after the go:generate line runs.
+			if found || c.Pos.Line <= nextLine {
+				return false
+			}
+			found = true
 		}
+		return runFilter == nil || c.Name != "" && runFilter.MatchString(c.Name) || runFilter.MatchString(c.Prompt)
+	}
+}
 
-		// And multiline comments.
-		//
-		/* % echo ok
-		really, it's fine
-		  foo
-		bar
-		*/
+// run runs c, once -jobs allows, reusing cached output if -cache is enabled.
+func run(ctx context.Context, c *gosh.Command) (output []byte, err error) {
+	if err := checkRunner(c); err != nil {
+		return nil, err
+	}
+	if jobSlots != nil {
+		select {
+		case jobSlots <- struct{}{}:
+			defer func() { <-jobSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
 	}
+	done := prog.command()
+	start := time.Now()
+	defer func() {
+		done(err)
+		logCommand(c, time.Since(start), err)
+		recordStat(c, time.Since(start), err)
+	}()
+
+	if c.Session {
+		// The output depends on the commands run before it.
+		return c.Run(ctx)
+	}
+	if dedupe != nil {
+		return dedupe.do(ctx, c, runCached)
+	}
+	return runCached(ctx, c)
+}
 
-	// But back to the outer scope,
-	// it should be denied again.
-	//
-	// % FAIL
+// isGenerated reports whether fileData, the contents of filePath,
+// is a generated Go source file, with a "// Code generated ... DO NOT EDIT."
+// comment before its package clause.
+func isGenerated(filePath string, fileData []byte) bool {
+	if filepath.Ext(filePath) != ".go" {
+		return false
+	}
+	f, err := parser.ParseFile(token.NewFileSet(), filePath, fileData, parser.PackageClauseOnly|parser.ParseComments)
+	return err == nil && ast.IsGenerated(f)
 }
 
-type stack[T any] []T
+// trace logs msg, describing a directive at pos, at debug level.
+func trace(pos token.Position, msg string) {
+	slog.Debug("directive", "pos", pos.String(), "directive", msg)
+}
 
-func (s *stack[T]) push(t T)  { *s = append(*s, t) }
-func (s *stack[T]) pop()      { *s = (*s)[:len(*s)-1] }
-func (s stack[T]) top() T     { return s[len(s)-1] }
-func (s stack[T]) setTop(t T) { s[len(s)-1] = t }
+// warn logs msg, a problem with the file at pos, as a warning.
+func warn(pos token.Position, msg string) {
+	slog.Warn(fmt.Sprintf("%s: %s", pos, msg))
+}
 
-type asyncSlice[T any] struct {
-	g errgroup.Group
-	s []T
+// warnBestEffort warns about the commands in results run with "%?"
+// that failed and kept their previous output, as Warn would with -v.
+func warnBestEffort(results []gosh.Result) {
+	for _, r := range results {
+		if !r.BestEffort || r.ExitCode == 0 {
+			continue
+		}
+		msg := fmt.Sprintf("command %q failed, keeping its previous output", r.Prompt)
+		if r.ExitCode > 0 {
+			msg += fmt.Sprintf(": exit status %d", r.ExitCode)
+		}
+		warn(r.Pos, msg)
+	}
 }
 
-func (s *asyncSlice[T]) append(fn func() (T, error)) {
-	i := len(s.s)
-	s.s = append(s.s, *new(T))
-	s.g.Go(func() error {
-		var err error
-		s.s[i], err = fn()
-		return err
-	})
+// logCommand logs that c finished running after d, with the error err.
+func logCommand(c *gosh.Command, d time.Duration, err error) {
+	attrs := []any{"pos", c.Pos.String(), "command", c.Prompt, "duration", d}
+	if err != nil {
+		attrs = append(attrs, "err", err)
+	}
+	slog.Debug("command finished", attrs...)
 }
 
-func (s *asyncSlice[T]) wait() ([]T, error) {
-	return s.s, s.g.Wait()
+// runCached runs c, or reuses its output from the cache if enabled.
+func runCached(ctx context.Context, c *gosh.Command) ([]byte, error) {
+	if outputCache == nil {
+		return runCommand(ctx, c)
+	}
+
+	key, err := cacheKey(c)
+	if err != nil {
+		return nil, err
+	}
+	if output, ok := outputCache.get(key); ok {
+		return output, nil
+	}
+	output, err := runCommand(ctx, c)
+	if err != nil {
+		return nil, err
+	}
+	if err := outputCache.put(key, output); err != nil {
+		return nil, err
+	}
+	return output, nil
 }
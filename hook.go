@@ -0,0 +1,68 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hookMarker identifies pre-commit hooks installed by gosh.
+const hookMarker = "# Installed by \"gosh hook install\"."
+
+// hookScript is the pre-commit hook installed by "gosh hook install".
+// It fails the commit, printing diffs, if any staged file
+// has stale command output.
+const hookScript = `#!/bin/sh
+` + hookMarker + `
+# Remove it with "gosh hook uninstall".
+exec gosh -check -refresh -staged ./...
+`
+
+// hook implements the "gosh hook" subcommand.
+func hook(args []string) error {
+	if len(args) != 1 {
+		return usagef("usage: gosh hook install|uninstall")
+	}
+
+	out, err := git("rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(strings.TrimSpace(string(out)), "pre-commit")
+
+	old, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	exists := err == nil
+	ours := bytes.Contains(old, []byte(hookMarker))
+
+	switch args[0] {
+	case "install":
+		if exists && !ours {
+			return fmt.Errorf("%s already exists; not overwriting", path)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return err
+		}
+		return os.WriteFile(path, []byte(hookScript), 0777)
+
+	case "uninstall":
+		if !exists {
+			return nil
+		}
+		if !ours {
+			return fmt.Errorf("%s was not installed by gosh; not removing", path)
+		}
+		return os.Remove(path)
+	}
+	return usagef("unknown hook command %q", args[0])
+}
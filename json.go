@@ -0,0 +1,76 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// jsonFile and jsonEdit are the -json output format.
+type jsonFile struct {
+	File   string
+	Module string `json:",omitempty"`
+	Edits  []jsonEdit
+	Error  string `json:",omitempty"`
+}
+
+// Each edit replaces Old, the text from Offset to End in the file,
+// with New. In Go files, New is formatted with gofmt in place,
+// so that it equals Old if the command's output is up to date.
+type jsonEdit struct {
+	Offset, End int
+	Old, New    string
+	Command     string
+	Name        string `json:",omitempty"`
+	ExitStatus  int
+	Duration    float64
+}
+
+var jsonMu sync.Mutex
+
+// emitJSON prints the edits that results made to filePath, as JSON.
+// It's a no-op if there were no commands and no errors.
+// It returns err, the error from processing the file.
+func emitJSON(filePath string, results []gosh.Result, err error) error {
+	if len(results) == 0 && err == nil {
+		return nil
+	}
+	f := jsonFileOf(filePath, results, err)
+
+	jsonMu.Lock()
+	defer jsonMu.Unlock()
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "\t")
+	if encErr := enc.Encode(f); encErr != nil {
+		return encErr
+	}
+	return err
+}
+
+// jsonFileOf returns the edits that results made to filePath,
+// and err, the error from processing the file, in the -json format.
+func jsonFileOf(filePath string, results []gosh.Result, err error) jsonFile {
+	f := jsonFile{File: filePath, Module: fileModules[filePath], Edits: []jsonEdit{}}
+	for _, r := range results {
+		f.Edits = append(f.Edits, jsonEdit{
+			Offset:     r.Offset,
+			End:        r.End,
+			Old:        r.Old,
+			New:        r.New,
+			Command:    r.Prompt,
+			Name:       r.Name,
+			ExitStatus: r.ExitCode,
+			Duration:   r.Duration.Seconds(),
+		})
+	}
+	if err != nil {
+		f.Error = err.Error()
+	}
+	return f
+}
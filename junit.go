@@ -0,0 +1,105 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"path/filepath"
+)
+
+// The -format=junit report has a test suite for each file,
+// and a test case for each command in it.
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Name     string       `xml:"name,attr"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Errors   int          `xml:"errors,attr"`
+	Time     float64      `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure"`
+	Error     *junitProblem `xml:"error"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes a JUnit XML report of files to w.
+// A command fails if it exits unsuccessfully, or, with -check,
+// if its output is stale.
+func writeJUnit(w io.Writer, files []reportFile) error {
+	report := junitSuites{Name: "gosh"}
+	for _, f := range files {
+		suite := junitSuite{Name: f.name}
+		for _, r := range f.results {
+			c := junitCase{
+				Name:      r.Prompt,
+				Classname: f.name,
+				File:      f.name,
+				Line:      r.Pos.Line,
+				Time:      r.Duration.Seconds(),
+			}
+			switch {
+			case r.Err != nil:
+				c.Failure = &junitProblem{Message: r.Err.Error(), Text: failureText(&r)}
+			case *flagCheck && isStale(&f, &r):
+				c.Failure = &junitProblem{Message: "command output is stale", Text: r.New}
+			}
+			if c.Failure != nil {
+				suite.Failures++
+			}
+			suite.Time += c.Time
+			suite.Cases = append(suite.Cases, c)
+		}
+		if f.err != nil {
+			suite.Errors++
+			suite.Cases = append(suite.Cases, junitCase{
+				Name:      filepath.Base(f.name),
+				Classname: f.name,
+				File:      f.name,
+				Error:     &junitProblem{Message: f.err.Error()},
+			})
+		}
+		suite.Tests = len(suite.Cases)
+
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Errors += suite.Errors
+		report.Time += suite.Time
+		report.Suites = append(report.Suites, suite)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"go/token"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// testReportFiles returns the files of a report, with results
+// that are fresh, stale, and failed, and a file that couldn't be processed.
+func testReportFiles() []reportFile {
+	return []reportFile{
+		{name: "a.go", changed: true, results: []gosh.Result{
+			{Command: gosh.Command{Prompt: "echo ok", Pos: token.Position{Line: 3}}, Old: "ok\n", New: "ok\n", Duration: time.Second},
+			{Command: gosh.Command{Prompt: "echo new", Pos: token.Position{Line: 7}}, Old: "old\n", New: "new\n"},
+			{Command: gosh.Command{Prompt: "false", Pos: token.Position{Line: 9}}, Output: []byte("partial\n"), Err: errors.New("exit status 1")},
+		}},
+		{name: "b.txt", err: errors.New("b.txt: unknown file type")},
+	}
+}
+
+func TestJUnit(t *testing.T) {
+	defer func(old bool) { *flagCheck = old }(*flagCheck)
+	for _, check := range []bool{false, true} {
+		*flagCheck = check
+		var buf bytes.Buffer
+		if err := writeJUnit(&buf, testReportFiles()); err != nil {
+			t.Fatal(err)
+		}
+		var report junitSuites
+		if err := xml.Unmarshal(buf.Bytes(), &report); err != nil {
+			t.Fatalf("-check=%v: %v\n%s", check, err, buf.Bytes())
+		}
+
+		// Stale output only fails with -check.
+		failures := 1
+		if check {
+			failures = 2
+		}
+		if report.Tests != 4 || report.Failures != failures || report.Errors != 1 || len(report.Suites) != 2 {
+			t.Fatalf("-check=%v: %d tests, %d failures, %d errors in %d suites; want 4, %d, 1 in 2:\n%s",
+				check, report.Tests, report.Failures, report.Errors, len(report.Suites), failures, buf.Bytes())
+		}
+		cases := report.Suites[0].Cases
+		if c := cases[0]; c.Name != "echo ok" || c.File != "a.go" || c.Line != 3 || c.Time != 1 || c.Failure != nil {
+			t.Errorf("-check=%v: fresh command reported as %+v", check, c)
+		}
+		if c := cases[1]; check != (c.Failure != nil) || check && c.Failure.Text != "new\n" {
+			t.Errorf("-check=%v: stale command reported with failure %+v", check, c.Failure)
+		}
+		if c := cases[2]; c.Failure == nil || c.Failure.Message != "exit status 1" || c.Failure.Text != "partial\n" {
+			t.Errorf("-check=%v: failed command reported with failure %+v", check, c.Failure)
+		}
+		if c := report.Suites[1].Cases[0]; c.Error == nil || c.Error.Message != "b.txt: unknown file type" {
+			t.Errorf("-check=%v: file error reported as %+v", check, c)
+		}
+	}
+}
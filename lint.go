@@ -0,0 +1,48 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"go/token"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// warned reports whether -lint reported any problems.
+var warned atomic.Bool
+
+var lintMu sync.Mutex
+
+// lintFile reports the problems that gosh finds in filePath,
+// like commands that aren't allowed to run, without running anything.
+func lintFile(filePath string) error {
+	src, err := readFile(filePath)
+	if err != nil {
+		return err
+	}
+	opts := gosh.Options{
+		Filename: filePath,
+		Lang:     *flagLang,
+		Refresh:  *flagRefresh,
+		Policy:   policy,
+		Select:   func(*gosh.Command) bool { return false },
+		Warn: func(pos token.Position, msg string) {
+			warned.Store(true)
+			lintMu.Lock()
+			defer lintMu.Unlock()
+			fmt.Fprintf(os.Stderr, "%s: %s\n", pos, msg)
+		},
+	}
+	if err := applyDirConfig(&opts); err != nil {
+		return err
+	}
+	_, _, err = gosh.Process(context.Background(), src, opts)
+	return err
+}
@@ -0,0 +1,43 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+)
+
+// setupLogging configures the default logger for the -log-format
+// and -log-level flags. With neither, messages are written to
+// standard error by the log package, as usual.
+// With -q or -format=quickfix, only errors are logged by default.
+func setupLogging() error {
+	var level slog.Level
+	if *flagLogLvl != "" {
+		if err := level.UnmarshalText([]byte(*flagLogLvl)); err != nil {
+			return usagef("invalid -log-level: %v", err)
+		}
+	}
+	if *flagVerbose {
+		level = slog.LevelDebug
+	}
+	if (*flagQuiet || *flagFormat == "quickfix") && !*flagVerbose && level < slog.LevelError {
+		// The report, if any, is all that's wanted on standard error.
+		level = slog.LevelError
+	}
+
+	hopts := &slog.HandlerOptions{Level: level}
+	switch *flagLogFmt {
+	case "":
+		slog.SetLogLoggerLevel(level)
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, hopts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, hopts)))
+	default:
+		return usagef("unknown log format %q", *flagLogFmt)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer func(quiet, verbose bool, format, level string) {
+		*flagQuiet, *flagVerbose, *flagFormat, *flagLogLvl = quiet, verbose, format, level
+		slog.SetLogLoggerLevel(slog.LevelInfo)
+	}(*flagQuiet, *flagVerbose, *flagFormat, *flagLogLvl)
+
+	tests := []struct {
+		quiet, verbose bool
+		format, level  string
+		want           slog.Level // the least level logged
+	}{
+		{false, false, "", "", slog.LevelInfo},
+		{true, false, "", "", slog.LevelError},
+		{false, true, "", "", slog.LevelDebug},
+		{false, false, "quickfix", "", slog.LevelError},
+		{false, true, "quickfix", "", slog.LevelDebug},
+		{false, false, "", "warn", slog.LevelWarn},
+		{true, false, "", "warn", slog.LevelError},
+		{true, false, "", "error", slog.LevelError},
+	}
+	for _, tt := range tests {
+		*flagQuiet, *flagVerbose, *flagFormat, *flagLogLvl = tt.quiet, tt.verbose, tt.format, tt.level
+		if err := setupLogging(); err != nil {
+			t.Fatal(err)
+		}
+		ctx := context.Background()
+		if !slog.Default().Enabled(ctx, tt.want) || slog.Default().Enabled(ctx, tt.want-1) {
+			t.Errorf("-q=%v -v=%v -format=%q -log-level=%q: least level logged isn't %v", tt.quiet, tt.verbose, tt.format, tt.level, tt.want)
+		}
+	}
+}
+
+func TestDefaultWarnings(t *testing.T) {
+	defer func(old *slog.Logger) { slog.SetDefault(old) }(slog.Default())
+	defer func(old bool) { *flagRefresh = old }(*flagRefresh)
+	*flagRefresh = true
+
+	// The prompt outside gosh:ok is an example, not worth a warning
+	// by default, but the failed "%?" command is.
+	file := filepath.Join(t.TempDir(), "run.sh")
+	src := "# % echo example\n#gosh:ok\n# %? exit 3\n"
+	if err := os.WriteFile(file, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for _, verbose := range []bool{false, true} {
+		level := slog.LevelInfo
+		if verbose {
+			level = slog.LevelDebug
+		}
+		var buf bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: level})))
+		if _, _, err := process(file, []byte(src)); err != nil {
+			t.Fatal(err)
+		}
+		log := buf.String()
+		if got := strings.Contains(log, "not enabled by gosh:ok"); got != verbose {
+			t.Errorf("verbose=%v: warned about the example: %v\n%s", verbose, got, log)
+		}
+		if n := strings.Count(log, `command \"exit 3\" failed`); n != 1 {
+			t.Errorf("verbose=%v: warned %d times about the failure, want once:\n%s", verbose, n, log)
+		}
+	}
+}
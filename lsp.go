@@ -0,0 +1,424 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// This file implements just enough of the Language Server Protocol
+// to offer a "Run gosh command" code action on command comments.
+//
+// Code actions are requested whenever the cursor moves,
+// so they don't run anything. Instead, they refer to the
+// "gosh.run" command, which runs the selected command when
+// the client executes it, and sends the client the resulting edit.
+
+const lspRunCommand = "gosh.run"
+
+// lspServer is a language server communicating over r and w.
+type lspServer struct {
+	r *bufio.Reader
+
+	mu     sync.Mutex
+	w      io.Writer
+	nextID int
+	docs   map[string][]byte // open documents, by URI
+}
+
+// lsp implements the "gosh lsp" subcommand,
+// serving the Language Server Protocol on stdin and stdout.
+func lsp(args []string) error {
+	if len(args) != 0 {
+		return usagef("usage: gosh lsp")
+	}
+	serving = true // standard input is the client's
+	s := &lspServer{
+		r:    bufio.NewReader(os.Stdin),
+		w:    os.Stdout,
+		docs: make(map[string][]byte),
+	}
+	return s.serve()
+}
+
+type lspMessage struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspCommand struct {
+	Title     string `json:"title"`
+	Command   string `json:"command"`
+	Arguments []any  `json:"arguments,omitempty"`
+}
+
+// serve reads and handles messages until the client sends "exit".
+func (s *lspServer) serve() error {
+	for {
+		msg, err := s.read()
+		if err != nil {
+			return err
+		}
+		if msg.Method == "exit" {
+			return nil
+		}
+		if msg.Method == "" {
+			continue // response to one of our requests
+		}
+		if msg.Method == "workspace/executeCommand" {
+			// Commands may take a while to run.
+			go s.handle(msg)
+			continue
+		}
+		s.handle(msg)
+	}
+}
+
+// handle handles msg, and replies if it's a request.
+func (s *lspServer) handle(msg *lspMessage) {
+	result, err := s.dispatch(msg.Method, msg.Params)
+	if msg.ID == nil {
+		if err != nil {
+			slog.Error(err.Error(), "method", msg.Method)
+		}
+		return
+	}
+	reply := map[string]any{"jsonrpc": "2.0", "id": msg.ID}
+	if err != nil {
+		reply["error"] = map[string]any{"code": -32603, "message": err.Error()}
+	} else {
+		reply["result"] = result
+	}
+	s.write(reply)
+}
+
+func (s *lspServer) dispatch(method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				"textDocumentSync":       1, // full
+				"codeActionProvider":     true,
+				"executeCommandProvider": map[string]any{"commands": []string{lspRunCommand}},
+			},
+			"serverInfo": map[string]any{"name": "gosh"},
+		}, nil
+
+	case "shutdown":
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var p struct {
+			TextDocument struct {
+				URI  string `json:"uri"`
+				Text string `json:"text"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		s.setDoc(p.TextDocument.URI, []byte(p.TextDocument.Text))
+		return nil, nil
+
+	case "textDocument/didChange":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			ContentChanges []struct {
+				Text string `json:"text"`
+			} `json:"contentChanges"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			s.setDoc(p.TextDocument.URI, []byte(p.ContentChanges[n-1].Text))
+		}
+		return nil, nil
+
+	case "textDocument/didClose":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		s.mu.Lock()
+		delete(s.docs, p.TextDocument.URI)
+		s.mu.Unlock()
+		return nil, nil
+
+	case "textDocument/codeAction":
+		var p struct {
+			TextDocument struct {
+				URI string `json:"uri"`
+			} `json:"textDocument"`
+			Range lspRange `json:"range"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		return s.codeActions(p.TextDocument.URI, p.Range)
+
+	case "workspace/executeCommand":
+		var p struct {
+			Command   string            `json:"command"`
+			Arguments []json.RawMessage `json:"arguments"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, err
+		}
+		if p.Command != lspRunCommand || len(p.Arguments) != 2 {
+			return nil, fmt.Errorf("unknown command %q", p.Command)
+		}
+		var uri string
+		var offset int
+		if err := json.Unmarshal(p.Arguments[0], &uri); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(p.Arguments[1], &offset); err != nil {
+			return nil, err
+		}
+		return nil, s.runCommand(uri, offset)
+	}
+
+	return nil, fmt.Errorf("method not supported: %s", method)
+}
+
+// codeActions returns the code actions for the commands
+// whose comments overlap rng in the document uri.
+func (s *lspServer) codeActions(uri string, rng lspRange) (any, error) {
+	src, filename, err := s.doc(uri)
+	if err != nil {
+		return nil, err
+	}
+	start, end := lspOffset(src, rng.Start), lspOffset(src, rng.End)
+
+	opts, err := options(filename)
+	if err != nil {
+		return nil, err
+	}
+	opts.Refresh = true
+	opts.Run = nil
+	opts.Trace = nil
+	actions := []any{}
+	opts.Select = func(c *gosh.Command) bool {
+		if opts.Policy != nil && opts.Policy.Check(c) != nil {
+			return false // it would only fail
+		}
+		if c.Pos.Offset <= end && start <= c.End.Offset {
+			actions = append(actions, map[string]any{
+				"title": "Run gosh command",
+				"kind":  "refactor.rewrite",
+				"command": lspCommand{
+					Title:     "Run gosh command",
+					Command:   lspRunCommand,
+					Arguments: []any{uri, c.Pos.Offset},
+				},
+			})
+		}
+		return false
+	}
+	gosh.Process(context.Background(), src, opts)
+	return actions, nil
+}
+
+// runCommand runs the command whose comment starts at offset
+// in the document uri, and asks the client to apply the edit.
+func (s *lspServer) runCommand(uri string, offset int) error {
+	src, filename, err := s.doc(uri)
+	if err != nil {
+		return err
+	}
+	if !*flagTrustAll {
+		// Read the store each time, as "gosh allow" may have changed it.
+		t, err := openTrust()
+		if err != nil {
+			return err
+		}
+		if err := t.check(filename, src); err != nil {
+			return err
+		}
+	}
+	opts, err := options(filename)
+	if err != nil {
+		return err
+	}
+	opts.Refresh = true
+	opts.Select = func(c *gosh.Command) bool {
+		return c.Pos.Offset == offset
+	}
+	_, results, err := gosh.Process(mainCtx, src, opts)
+	if len(results) == 0 {
+		if err == nil {
+			err = errors.New("no gosh command at the given position")
+		}
+		return err
+	}
+	r := results[0]
+	if r.Err != nil {
+		return r.Err
+	}
+
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.mu.Unlock()
+	s.write(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      id,
+		"method":  "workspace/applyEdit",
+		"params": map[string]any{
+			"label": "Run gosh command",
+			"edit": map[string]any{
+				"changes": map[string][]lspTextEdit{
+					uri: {{
+						Range:   lspRange{lspPos(src, r.Offset), lspPos(src, r.End)},
+						NewText: r.New,
+					}},
+				},
+			},
+		},
+	})
+	return nil
+}
+
+func (s *lspServer) setDoc(uri string, text []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.docs[uri] = text
+}
+
+// doc returns the contents and file name of the document uri.
+// It reads the file if the document isn't open.
+func (s *lspServer) doc(uri string) ([]byte, string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme != "file" {
+		return nil, "", fmt.Errorf("unsupported URI %q", uri)
+	}
+	s.mu.Lock()
+	src, ok := s.docs[uri]
+	s.mu.Unlock()
+	if !ok {
+		src, err = os.ReadFile(u.Path)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return src, u.Path, nil
+}
+
+// read reads the next message from the client.
+func (s *lspServer) read() (*lspMessage, error) {
+	header, err := textproto.NewReader(s.r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("bad Content-Length: %v", err)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(s.r, body); err != nil {
+		return nil, err
+	}
+	var msg lspMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// write sends msg to the client.
+func (s *lspServer) write(msg any) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+// lspOffset returns the byte offset in src of pos,
+// whose character is measured in UTF-16 code units.
+func lspOffset(src []byte, pos lspPosition) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		i := bytes.IndexByte(src[offset:], '\n')
+		if i < 0 {
+			return len(src)
+		}
+		offset += i + 1
+	}
+	for units := 0; units < pos.Character && offset < len(src) && src[offset] != '\n'; {
+		r, size := utf8.DecodeRune(src[offset:])
+		units += utf16Len(r)
+		offset += size
+	}
+	return offset
+}
+
+// lspPos returns the LSP position of the byte offset in src.
+func lspPos(src []byte, offset int) lspPosition {
+	var pos lspPosition
+	for i := 0; i < offset; {
+		r, size := utf8.DecodeRune(src[i:])
+		if r == '\n' {
+			pos.Line++
+			pos.Character = 0
+		} else {
+			pos.Character += utf16Len(r)
+		}
+		i += size
+	}
+	return pos
+}
+
+// utf16Len returns the number of UTF-16 code units encoding r.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,29 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// isolateNetwork returns attr, or new attributes if attr is nil,
+// changed to run commands in a new network namespace with no
+// network access, and any environment variables needed to do so.
+// Unless gosh runs as root, the namespace is created in a new user
+// namespace, with the same user and group IDs as gosh.
+func isolateNetwork(attr *syscall.SysProcAttr) (*syscall.SysProcAttr, []string) {
+	if attr == nil {
+		attr = new(syscall.SysProcAttr)
+	}
+	attr.Cloneflags |= syscall.CLONE_NEWNET
+	if os.Geteuid() != 0 {
+		uid, gid := os.Getuid(), os.Getgid()
+		attr.Cloneflags |= syscall.CLONE_NEWUSER
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}}
+	}
+	return attr, nil
+}
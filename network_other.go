@@ -0,0 +1,28 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import "syscall"
+
+// isolateNetwork returns attr unchanged, with environment variables
+// that send network requests from commands to an unused local
+// proxy, since there are no network namespaces here. This only
+// stops programs that honor the proxy variables, like curl and go.
+func isolateNetwork(attr *syscall.SysProcAttr) (*syscall.SysProcAttr, []string) {
+	const proxy = "http://127.0.0.1:9"
+	return attr, []string{
+		"ALL_PROXY=" + proxy,
+		"HTTPS_PROXY=" + proxy,
+		"HTTP_PROXY=" + proxy,
+		"NO_PROXY=",
+		"all_proxy=" + proxy,
+		"https_proxy=" + proxy,
+		"http_proxy=" + proxy,
+		"no_proxy=",
+		"GOPROXY=off",
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// emitOutputs writes or prints the output of the commands in results
+// that belong in separate files, as given by "gosh:output",
+// as selected by the command-line flags.
+func emitOutputs(results []gosh.Result) error {
+	for _, r := range results {
+		if r.Err != nil || r.Command.Output == "" {
+			continue
+		}
+		path := r.Command.Output
+		old, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			if *flagWrite {
+				if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+					return err
+				}
+				if err := os.WriteFile(path, r.Output, 0666); err != nil {
+					return err
+				}
+				continue
+			}
+		} else if err != nil {
+			return err
+		}
+		if *flagWrite && bytes.Equal(old, r.Output) {
+			continue
+		}
+		if err := emit(path, old, r.Output); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// overlay maps absolute file names to contents that replace
+// the files on disk, as configured by -overlay.
+var overlay map[string][]byte
+
+// loadOverlay reads the overlay file at path,
+// which uses the same format as "go build -overlay".
+func loadOverlay(path string) (map[string][]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg struct {
+		Replace map[string]string
+	}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	m := make(map[string][]byte)
+	for from, to := range cfg.Replace {
+		from, err := filepath.Abs(from)
+		if err != nil {
+			return nil, err
+		}
+		if to == "" {
+			continue // deleted file; gosh has nothing to process
+		}
+		m[from], err = os.ReadFile(to)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// readFile returns the contents of the file at path,
+// from the overlay if it replaces the file.
+func readFile(path string) ([]byte, error) {
+	if abs, err := filepath.Abs(path); err == nil {
+		if data, ok := overlay[abs]; ok {
+			return data, nil
+		}
+	}
+	return os.ReadFile(path)
+}
+
+// inOverlay reports whether the overlay replaces the file at path.
+func inOverlay(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	_, ok := overlay[abs]
+	return ok
+}
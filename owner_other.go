@@ -0,0 +1,12 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package main
+
+import "os"
+
+// chown does nothing on systems without Unix file ownership.
+func chown(f *os.File, fi os.FileInfo) error { return nil }
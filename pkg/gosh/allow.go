@@ -0,0 +1,229 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// checkPrograms reports an error if the shell command prompt
+// may run a program that isn't in allowed, as for "gosh:allow".
+func checkPrograms(prompt string, allowed []string) error {
+	names, ok := programs(prompt)
+	if !ok {
+		return fmt.Errorf("gosh:allow can't tell which programs it runs")
+	}
+	for _, name := range names {
+		if !slices.Contains(allowed, name) {
+			return fmt.Errorf("%s isn't allowed by gosh:allow", name)
+		}
+	}
+	return nil
+}
+
+// programs returns the names of the programs that the shell command
+// prompt runs: the first word of each simple command in it, or for
+// the wrappers env, command, and exec, the program they run.
+// It reports false if it can't tell, such as if prompt uses
+// command substitution, names a program with a variable,
+// gives a wrapper options, or assigns a variable like PATH
+// that changes which program a name runs.
+func programs(prompt string) ([]string, bool) {
+	if strings.Contains(prompt, "`") || strings.Contains(prompt, "$(") ||
+		strings.Contains(prompt, "<(") || strings.Contains(prompt, ">(") {
+		return nil, false
+	}
+	words, ok := shellWords(prompt)
+	if !ok {
+		return nil, false
+	}
+	var names []string
+	start := true   // expecting the first word of a command
+	target := false // expecting the target of a redirection
+	wrapper := ""   // wrapper whose program is expected, if any
+	for _, w := range append(words, ";") {
+		switch {
+		case target:
+			target = false
+		case w == ";" || w == "&" || w == "|" || w == "&&" || w == "||" || w == "\n" || w == "(" || w == ")":
+			if wrapper != "" {
+				// A wrapper alone, like "env", runs itself.
+				names = append(names, wrapper)
+				wrapper = ""
+			}
+			start = true
+		case !start:
+		case isRedirect(w):
+			// Still expecting the command's first word.
+			target = true
+		case isAssignment(w):
+			name, _, _ := strings.Cut(w, "=")
+			if unsafeVar(name) {
+				return nil, false
+			}
+			// Still expecting the command's first word.
+		case wrapper != "" && strings.HasPrefix(w, "-"):
+			return nil, false
+		case w == "env" || w == "command" || w == "exec":
+			wrapper = w
+		case w == "if" || w == "then" || w == "else" || w == "elif" || w == "fi" ||
+			w == "while" || w == "until" || w == "do" || w == "done" ||
+			w == "!" || w == "{" || w == "}":
+			// Reserved words that precede a command.
+		case w == "for" || w == "case" || w == "select" || w == "function" || strings.ContainsAny(w, "$*?[]"):
+			return nil, false
+		default:
+			names = append(names, w)
+			start, wrapper = false, ""
+		}
+	}
+	return names, true
+}
+
+// unsafeVar reports whether setting the environment variable name
+// for a command can change which programs it runs, or make
+// the shell or dynamic linker run other code first.
+func unsafeVar(name string) bool {
+	switch name {
+	case "PATH", "BASH_ENV", "ENV", "IFS", "SHELLOPTS", "BASHOPTS", "CDPATH":
+		return true
+	}
+	return strings.HasPrefix(name, "LD_") || strings.HasPrefix(name, "DYLD_")
+}
+
+// isRedirect reports whether the shell word w is a redirection operator,
+// like ">", "2>>", or "&>", as split by shellWords.
+func isRedirect(w string) bool {
+	switch strings.TrimLeft(w, "0123456789") {
+	case "<", "<<", "<<<", "<<-", "<>", "<&", ">", ">>", ">|", ">&", "&>", "&>>":
+		return true
+	}
+	return false
+}
+
+// isOperator reports whether the shell word w is an operator,
+// as split by shellWords.
+func isOperator(w string) bool {
+	switch w {
+	case ";", "&", "|", "&&", "||", "\n", "(", ")":
+		return true
+	}
+	return isRedirect(w)
+}
+
+// isDigits reports whether s is a nonempty string of decimal digits.
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// isAssignment reports whether the shell word w
+// is a variable assignment, like "FOO=bar".
+func isAssignment(w string) bool {
+	name, _, ok := strings.Cut(w, "=")
+	if !ok || name == "" {
+		return false
+	}
+	for i, r := range name {
+		if !(r == '_' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || i > 0 && '0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// shellWords splits the shell command s into words and operators,
+// removing quotes. Newlines are returned as operators, and so are
+// redirections, like ">" or "2>&", even when attached to words,
+// as in "echo hi>out". It reports false if s has an unterminated quote.
+func shellWords(s string) ([]string, bool) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	flush := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\'':
+			inWord = true
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				return nil, false
+			}
+			word.WriteString(s[i+1 : i+1+j])
+			i += j + 1
+		case c == '"':
+			inWord = true
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				word.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, false
+			}
+		case c == '\\' && i+1 < len(s):
+			inWord = true
+			i++
+			if s[i] != '\n' {
+				word.WriteByte(s[i])
+			}
+		case c == '#' && !inWord:
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+			i--
+		case c == ' ' || c == '\t':
+			flush()
+		case c == '\n' || c == ';' || c == '(' || c == ')':
+			flush()
+			words = append(words, string(c))
+		case c == '<' || c == '>' || c == '&' && strings.HasPrefix(s[i+1:], ">"):
+			// A redirection, with the file descriptor before it, if any.
+			fd := ""
+			if inWord && isDigits(word.String()) {
+				fd = word.String()
+				word.Reset()
+				inWord = false
+			}
+			flush()
+			op := redirectOp(s[i:])
+			words = append(words, fd+op)
+			i += len(op) - 1
+		case c == '&' || c == '|':
+			flush()
+			if i+1 < len(s) && s[i+1] == c {
+				i++
+				words = append(words, string(c)+string(c))
+			} else {
+				words = append(words, string(c))
+			}
+		default:
+			inWord = true
+			word.WriteByte(c)
+		}
+	}
+	flush()
+	return words, true
+}
+
+// redirectOp returns the redirection operator at the start of s,
+// which starts with "<", ">", or "&>".
+func redirectOp(s string) string {
+	for _, op := range []string{"&>>", "&>", "<<<", "<<-", "<<", "<>", "<&", "<", ">>", ">|", ">&", ">"} {
+		if strings.HasPrefix(s, op) {
+			return op
+		}
+	}
+	return s[:1]
+}
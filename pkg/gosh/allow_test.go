@@ -0,0 +1,145 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPrograms(t *testing.T) {
+	tests := []struct {
+		prompt string
+		names  []string
+		ok     bool
+	}{
+		{"go version", []string{"go"}, true},
+		{"go list ./... | grep foo && jq .", []string{"go", "grep", "jq"}, true},
+		{"go version; git log\nls", []string{"go", "git", "ls"}, true},
+		{"'go' version", []string{"go"}, true},
+		{`"git" log`, []string{"git"}, true},
+		{"./bin/go version", []string{"./bin/go"}, true},
+		{">out go version", []string{"go"}, true},
+		{"go version 2>&1 >out", []string{"go"}, true},
+		{"if go vet; then echo ok; fi", []string{"go", "echo"}, true},
+		{"! go vet", []string{"go"}, true},
+
+		// Assignments.
+		{"GOOS=linux go build", []string{"go"}, true},
+		{"A=1 B=2 go env", []string{"go"}, true},
+		{"PATH=./bin go version", nil, false},
+		{"PATH=$PATH:./bin go version", nil, false},
+		{"BASH_ENV=./evil.sh bash -c true", nil, false},
+		{"ENV=./evil.sh sh -c true", nil, false},
+		{"IFS=/ go version", nil, false},
+		{"LD_PRELOAD=./evil.so go version", nil, false},
+		{"DYLD_INSERT_LIBRARIES=./evil.dylib go version", nil, false},
+		{"go version; PATH=./bin go version", nil, false},
+
+		// Wrappers.
+		{"env go version", []string{"go"}, true},
+		{"env GOOS=linux go build", []string{"go"}, true},
+		{"env PATH=./bin go version", nil, false},
+		{"env -i go version", nil, false},
+		{"env -S 'evil arg'", nil, false},
+		{"env", []string{"env"}, true},
+		{"env | sort", []string{"env", "sort"}, true},
+		{"command go version", []string{"go"}, true},
+		{"command -p evil", nil, false},
+		{"exec go version", []string{"go"}, true},
+		{"exec -a go evil", nil, false},
+		{"exec >out", []string{"exec"}, true},
+		{"command env exec go", []string{"go"}, true},
+
+		// Subshells and groups.
+		{"(cd testdata && go test)", []string{"cd", "go"}, true},
+		{"{ go vet; go test; }", []string{"go", "go"}, true},
+		{"(PATH=./bin; go version)", nil, false},
+
+		// Things gosh can't tell.
+		{"$GO version", nil, false},
+		{"echo $(evil)", nil, false},
+		{"echo `evil`", nil, false},
+		{"diff <(evil) x", nil, false},
+		{"for f in *; do go vet $f; done", nil, false},
+		{"go* version", nil, false},
+		{"echo 'unterminated", nil, false},
+	}
+	for _, tt := range tests {
+		names, ok := programs(tt.prompt)
+		if ok != tt.ok || !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("programs(%q) = %q, %v, want %q, %v", tt.prompt, names, ok, tt.names, tt.ok)
+		}
+	}
+}
+
+func TestCheckPrograms(t *testing.T) {
+	allowed := []string{"go", "git"}
+	tests := []struct {
+		prompt string
+		err    string
+	}{
+		{"go version", ""},
+		{"git log | go run ./cmd/x", ""},
+		{"env go version", ""},
+		{"jq . x.json", "jq isn't allowed"},
+		{"go version; rm -rf /", "rm isn't allowed"},
+		{"env", "env isn't allowed"},
+		{"PATH=./bin go version", "can't tell which programs it runs"},
+		{"$(evil)", "can't tell which programs it runs"},
+	}
+	for _, tt := range tests {
+		err := checkPrograms(tt.prompt, allowed)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("checkPrograms(%q): %v", tt.prompt, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("checkPrograms(%q): error %v, want %q", tt.prompt, err, tt.err)
+		}
+	}
+}
+
+func TestAllowEnv(t *testing.T) {
+	tests := []struct {
+		src string
+		env []string // as given by Options.Env
+		err string
+	}{
+		{"package p\n\n//gosh:allow echo\n\n//gosh:env GOOS=linux\n// % echo a\n", nil, ""},
+		{"package p\n\n//gosh:allow echo\n\n//gosh:env PATH=./bin\n// % echo a\n", nil, "gosh:env can't set PATH under gosh:allow"},
+		{"package p\n\n//gosh:allow echo\n\n//gosh:env LD_PRELOAD=./evil.so\n// % echo a\n", nil, "gosh:env can't set LD_PRELOAD"},
+		{"package p\n\n//gosh:ok\n\n//gosh:env PATH=./bin\n// % echo a\n", nil, ""},
+		{"package p\n\n//gosh:allow echo\n\n// % echo a\n", []string{"GOOS=linux"}, ""},
+		{"package p\n\n//gosh:allow echo\n\n// % echo a\n", []string{"PATH=./bin"}, "the configured environment can't set PATH under gosh:allow"},
+		{"package p\n\n//gosh:allow echo\n\n//gosh:env GOOS=linux\n// % echo a\n", []string{"LD_PRELOAD=./evil.so"}, "the configured environment can't set LD_PRELOAD"},
+		{"package p\n\n//gosh:ok\n\n// % echo a\n", []string{"PATH=./bin"}, ""},
+	}
+	for _, tt := range tests {
+		_, results, err := Process(context.Background(), []byte(tt.src), Options{
+			Filename: "p.go",
+			Env:      tt.env,
+			Run:      echoRun,
+		})
+		for _, r := range results {
+			if err == nil {
+				err = r.Err
+			}
+		}
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("Process(%q): %v", tt.src, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Process(%q): error %v, want %q", tt.src, err, tt.err)
+		}
+	}
+}
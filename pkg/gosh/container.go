@@ -0,0 +1,55 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runtime returns the container runtime that runs c.
+func (c *Command) runtime() string {
+	if c.Runtime == "" {
+		return "docker"
+	}
+	return c.Runtime
+}
+
+// containerArgs returns the arguments to c's container runtime
+// that run script with c's shell in a container from c.Image.
+// The container has c.Mount, or else c's working directory, mounted
+// at the same path, and runs in c's working directory.
+// It also has the files named by GOSH_OUT variables mounted, read-only,
+// and c.ContainerArgs.
+func (c *Command) containerArgs(script string) ([]string, error) {
+	dir := c.Dir
+	if dir == "" {
+		var err error
+		if dir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	mount := c.Mount
+	if mount == "" {
+		mount = dir
+	}
+	args := []string{"run", "--rm", "--init", "-v", mount + ":" + mount, "-w", dir}
+	if c.PTY {
+		args = append(args, "-t")
+	}
+	args = append(args, c.ContainerArgs...)
+	for _, kv := range c.Env {
+		if name, value, _ := strings.Cut(kv, "="); strings.HasPrefix(name, "GOSH_OUT_") {
+			args = append(args, "-v", value+":"+value+":ro")
+		}
+		args = append(args, "-e", kv)
+	}
+	return append(args, c.Image, c.shell(), "-c", script), nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestContainerArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		cmd  Command
+		want []string
+	}{
+		{
+			name: "plain",
+			cmd:  Command{Image: "alpine", Dir: "/src"},
+			want: []string{"run", "--rm", "--init", "-v", "/src:/src", "-w", "/src", "alpine", "sh", "-c", "date"},
+		},
+		{
+			name: "mount",
+			cmd:  Command{Image: "alpine", Dir: "/src/sub", Mount: "/src", Shell: "bash"},
+			want: []string{"run", "--rm", "--init", "-v", "/src:/src", "-w", "/src/sub", "alpine", "bash", "-c", "date"},
+		},
+		{
+			name: "isolated",
+			cmd:  Command{Image: "alpine", Dir: "/src", ContainerArgs: []string{"--user=65534:65534", "--network=none"}},
+			want: []string{"run", "--rm", "--init", "-v", "/src:/src", "-w", "/src", "--user=65534:65534", "--network=none", "alpine", "sh", "-c", "date"},
+		},
+		{
+			name: "env",
+			cmd:  Command{Image: "alpine", Dir: "/src", PTY: true, Env: []string{"A=1", "GOSH_OUT_x=/tmp/x"}},
+			want: []string{"run", "--rm", "--init", "-v", "/src:/src", "-w", "/src", "-t", "-e", "A=1", "-v", "/tmp/x:/tmp/x:ro", "-e", "GOSH_OUT_x=/tmp/x", "alpine", "sh", "-c", "date"},
+		},
+	}
+	for _, tt := range tests {
+		args, err := tt.cmd.containerArgs("date")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(args, tt.want) {
+			t.Errorf("%s: containerArgs = %q, want %q", tt.name, args, tt.want)
+		}
+	}
+}
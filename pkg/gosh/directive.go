@@ -0,0 +1,454 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"go/token"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A state tracks the directives in effect while scanning a file.
+type state struct {
+	opts *Options
+
+	// allowed records whether commands may run,
+	// for each enclosing scope.
+	allowed stack[bool]
+
+	// enabled records the "gosh:ok" directive that enabled commands,
+	// or nil, for each enclosing scope.
+	enabled stack[*okDirective]
+
+	// programs records the programs that commands may run,
+	// as limited by "gosh:allow", or nil if they may run any,
+	// for each enclosing scope.
+	programs stack[[]string]
+
+	// filters records the commands given by "gosh:filter",
+	// for each enclosing scope.
+	filters stack[[]string]
+
+	// serial records the serial group set by "gosh:serial",
+	// or nil, for each enclosing scope.
+	serial stack[*serialGroup]
+
+	// next holds the settings from directives
+	// that apply to the next command.
+	next Command
+
+	// session is the file's shell session, if enabled by "gosh:session".
+	session *session
+
+	// okNext is the "gosh:ok-next" directive that enables
+	// just the next command, or nil, and okNextDepth is the depth
+	// of the scope it was given in, beyond which it doesn't apply.
+	okNext      *okDirective
+	okNextDepth int
+
+	// skip records whether the next command is skipped.
+	skip bool
+
+	// redact lists the patterns given by "gosh:redact" so far.
+	redact []*regexp.Regexp
+}
+
+func newState(opts *Options) *state {
+	return &state{
+		opts:     opts,
+		allowed:  stack[bool]{false},
+		enabled:  stack[*okDirective]{nil},
+		serial:   stack[*serialGroup]{nil},
+		programs: stack[[]string]{nil},
+		filters:  stack[[]string]{nil},
+	}
+}
+
+// An okDirective records whether a "gosh:ok" directive
+// enabled any commands.
+type okDirective struct {
+	pos  token.Position
+	used bool
+}
+
+// A serialGroup is a set of commands that run one after another.
+type serialGroup struct {
+	last *Command // most recently added command
+}
+
+// push enters a nested scope.
+func (st *state) push() {
+	st.allowed.push(st.allowed.top())
+	st.enabled.push(st.enabled.top())
+	st.serial.push(st.serial.top())
+	st.programs.push(st.programs.top())
+	st.filters.push(st.filters.top())
+}
+
+// pop leaves the innermost scope.
+func (st *state) pop() {
+	st.checkUnused(len(st.enabled) - 1)
+	if st.okNext != nil && st.okNextDepth >= len(st.enabled)-1 {
+		st.warn(st.okNext.pos, "unused gosh:ok-next: no command follows it in its scope")
+		st.okNext = nil
+	}
+	st.allowed.pop()
+	st.enabled.pop()
+	st.serial.pop()
+	st.programs.pop()
+	st.filters.pop()
+}
+
+// finish reports problems found at the end of the file.
+func (st *state) finish() {
+	for i := len(st.enabled) - 1; i >= 0; i-- {
+		st.checkUnused(i)
+	}
+	if st.okNext != nil {
+		st.warn(st.okNext.pos, "unused gosh:ok-next: no command follows it")
+	}
+}
+
+// checkUnused warns if the "gosh:ok" directive in effect
+// at the end of the scope at depth i was given in that scope
+// and enabled no commands.
+func (st *state) checkUnused(i int) {
+	d := st.enabled[i]
+	if d == nil || d.used || i > 0 && st.enabled[i-1] == d {
+		return
+	}
+	st.warn(d.pos, "unused gosh:ok: it enables no commands")
+}
+
+// warn reports a problem that doesn't stop processing.
+func (st *state) warn(pos token.Position, format string, args ...any) {
+	if st.opts.Warn != nil {
+		st.opts.Warn(pos, fmt.Sprintf(format, args...))
+	}
+}
+
+// directive processes the directive text, which followed "gosh:" at pos.
+func (st *state) directive(text string, pos token.Position) error {
+	name, arg := cutDirective(text)
+	if st.opts.Trace != nil {
+		st.opts.Trace(pos, "gosh:"+text)
+	}
+	switch name {
+	case "ok":
+		if st.allowed.top() && st.programs.top() == nil {
+			st.warn(pos, "redundant gosh:ok: commands are already enabled")
+			break
+		}
+		st.allowed.setTop(true)
+		st.enabled.setTop(&okDirective{pos: pos})
+		st.programs.setTop(nil)
+	case "ok-next":
+		if st.allowed.top() && st.programs.top() == nil {
+			st.warn(pos, "redundant gosh:ok-next: commands are already enabled")
+			break
+		}
+		st.okNext = &okDirective{pos: pos}
+		st.okNextDepth = len(st.enabled) - 1
+	case "allow":
+		var programs []string
+		for _, name := range strings.Split(arg, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				programs = append(programs, name)
+			}
+		}
+		if len(programs) == 0 {
+			return fmt.Errorf("%s: gosh:allow: no programs listed", pos)
+		}
+		st.allowed.setTop(true)
+		st.enabled.setTop(&okDirective{pos: pos})
+		st.programs.setTop(programs)
+	case "deny":
+		if !st.allowed.top() {
+			st.warn(pos, "redundant gosh:deny: commands are already disabled")
+			break
+		}
+		st.checkUnused(len(st.enabled) - 1)
+		st.allowed.setTop(false)
+		st.enabled.setTop(nil)
+		st.programs.setTop(nil)
+	case "session":
+		if st.session == nil {
+			st.session = &session{dir: st.opts.Dir, shell: st.opts.Shell, sysProcAttr: st.opts.SysProcAttr, environ: st.opts.Environ}
+		}
+	case "serial":
+		st.serial.setTop(new(serialGroup))
+	case "skip":
+		// The argument is an optional reason, for readers.
+		st.skip = true
+	case "freeze":
+		// The argument is an optional reason, for readers.
+		st.next.Frozen = true
+	case "only":
+		if !matchPlatform(arg) {
+			st.skip = true
+		}
+	case "skip-on":
+		if matchPlatform(arg) {
+			st.skip = true
+		}
+	case "name":
+		st.next.Name = arg
+	case "after":
+		for _, name := range strings.Split(arg, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				st.next.After = append(st.next.After, name)
+			}
+		}
+	case "retry":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s: invalid retry count: %q", pos, arg)
+		}
+		st.next.Retry = n
+	case "lines":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%s: invalid line count: %q", pos, arg)
+		}
+		st.next.MaxLines = n
+	case "wrap":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 2 {
+			return fmt.Errorf("%s: invalid wrap column: %q", pos, arg)
+		}
+		st.next.Wrap = n
+	case "limit":
+		if err := parseLimits(&st.next, arg); err != nil {
+			return fmt.Errorf("%s: gosh:limit: %v", pos, err)
+		}
+	case "filter":
+		if arg == "" {
+			return fmt.Errorf("%s: gosh:filter: no command given", pos)
+		}
+		st.filters.setTop(append(slices.Clip(st.filters.top()), arg))
+	case "trim":
+		st.next.Trim = true
+	case "trailer":
+		st.next.Trailer = true
+	case "redact":
+		re, err := regexp.Compile(arg)
+		if err != nil || arg == "" {
+			return fmt.Errorf("%s: invalid redact pattern: %q", pos, arg)
+		}
+		st.redact = append(st.redact, re)
+	case "env":
+		for _, kv := range strings.Split(arg, ",") {
+			kv = strings.TrimSpace(kv)
+			if kv == "" {
+				continue
+			}
+			// A variable listed again replaces its earlier value.
+			name, _, literal := strings.Cut(kv, "=")
+			st.next.Env = slices.DeleteFunc(st.next.Env, func(kv string) bool { return strings.HasPrefix(kv, name+"=") })
+			st.next.Passthrough = slices.DeleteFunc(st.next.Passthrough, func(p string) bool { return p == name })
+			if !literal {
+				// Pass the variable through from this process.
+				st.next.Passthrough = append(st.next.Passthrough, name)
+				value, ok := os.LookupEnv(kv)
+				if !ok {
+					continue
+				}
+				kv += "=" + value
+			}
+			st.next.Env = append(st.next.Env, kv)
+		}
+	case "output":
+		if arg == "" {
+			return fmt.Errorf("%s: gosh:output: no file named", pos)
+		}
+		// The file may be anywhere within the repository,
+		// or without one, within the source file's directory.
+		root := st.opts.Mount
+		if root == "" {
+			root = st.opts.dir()
+		}
+		root, err := filepath.Abs(root)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(st.opts.dir(), arg)
+		if filepath.IsAbs(arg) || !within(root, path, "") {
+			return fmt.Errorf("%s: gosh:output: %s is outside %s", pos, arg, root)
+		}
+		st.next.Output = path
+	case "const":
+		if ext := filepath.Ext(st.opts.Filename); ext != ".go" && ext != "" {
+			return fmt.Errorf("%s: gosh:const is only supported in Go files", pos)
+		}
+		if !token.IsIdentifier(arg) {
+			return fmt.Errorf("%s: gosh:const: invalid constant name %q", pos, arg)
+		}
+		st.next.Const = arg
+	case "code":
+		if ext := filepath.Ext(st.opts.Filename); ext != ".go" && ext != "" {
+			return fmt.Errorf("%s: gosh:code is only supported in Go files", pos)
+		}
+		st.next.Code = true
+	case "example":
+		if !strings.HasSuffix(st.opts.Filename, "_test.go") {
+			return fmt.Errorf("%s: gosh:example is only supported in Go test files", pos)
+		}
+		name := "Example" + arg
+		if arg != "" && !unicode.IsUpper(rune(arg[0])) {
+			name = "Example_" + arg
+		}
+		if !token.IsIdentifier(name) {
+			return fmt.Errorf("%s: gosh:example: invalid example name %q", pos, arg)
+		}
+		st.next.Example = name
+	case "image":
+		if arg == "" {
+			return fmt.Errorf("%s: gosh:image: no image named", pos)
+		}
+		if strings.HasPrefix(arg, "-") {
+			return fmt.Errorf("%s: gosh:image: invalid image %q", pos, arg)
+		}
+		st.next.Image = arg
+	case "host":
+		if arg == "" {
+			return fmt.Errorf("%s: gosh:host: no host named", pos)
+		}
+		if strings.HasPrefix(arg, "-") {
+			return fmt.Errorf("%s: gosh:host: invalid host %q", pos, arg)
+		}
+		st.next.Host = arg
+	case "pty":
+		st.next.PTY = true
+		if err := parsePTYSize(&st.next, arg); err != nil {
+			return fmt.Errorf("%s: gosh:pty: %v", pos, err)
+		}
+	case "stderr":
+		st.next.Stderr = true
+	case "deps":
+		st.next.Deps = nil
+		for _, dep := range strings.Split(arg, ",") {
+			if dep = strings.TrimSpace(dep); dep != "" {
+				st.next.Deps = append(st.next.Deps, filepath.Join(st.opts.dir(), dep))
+			}
+		}
+	default:
+		return fmt.Errorf("%s: unknown command: %s", pos, name)
+	}
+	return nil
+}
+
+// matchPlatform reports whether the current platform matches list,
+// a comma-separated list of operating systems, architectures,
+// or os/arch pairs, like "linux,darwin/arm64".
+func matchPlatform(list string) bool {
+	for _, p := range strings.Split(list, ",") {
+		switch strings.TrimSpace(p) {
+		case runtime.GOOS, runtime.GOARCH, runtime.GOOS + "/" + runtime.GOARCH:
+			return true
+		}
+	}
+	return false
+}
+
+// command returns the command for prompt, found in the comment
+// from pos to end, and reports whether it's allowed to run.
+// Directives for the next command apply to it
+// even if it's not allowed to run.
+func (st *state) command(prompt string, pos, end token.Position) (*Command, bool) {
+	c := st.next
+	st.next = Command{}
+	skip := st.skip
+	st.skip = false
+	c.Prompt = prompt
+	c.Pos = pos
+	c.End = end
+	c.Dir = st.opts.Dir
+	c.Shell = st.opts.Shell
+	c.Timeout = st.opts.Timeout
+	if c.CPULimit == 0 {
+		c.CPULimit = st.opts.CPULimit
+	}
+	if c.MemLimit == 0 {
+		c.MemLimit = st.opts.MemLimit
+	}
+	if c.OutputLimit == 0 {
+		c.OutputLimit = st.opts.OutputLimit
+	}
+	c.Environ = st.opts.Environ
+	setEnv := c.Env // set by "gosh:env"
+	c.Env = append(slices.Clip(st.opts.Env), c.Env...)
+	c.SysProcAttr = st.opts.SysProcAttr
+	c.Runtime = st.opts.Runtime
+	c.Mount = st.opts.Mount
+	c.ContainerArgs = st.opts.ContainerArgs
+	c.SSHConfig = st.opts.SSHConfig
+	c.Redact = append(slices.Clip(st.opts.Redact), st.redact...)
+	c.Filters = st.filters.top()
+	allowed, programs := st.allowed.top(), st.programs.top()
+	if d := st.okNext; d != nil {
+		// "gosh:ok-next" enables this command alone, like "gosh:ok".
+		st.okNext = nil
+		d.used = true
+		allowed, programs = true, nil
+	} else if allowed {
+		st.enabled.top().used = true
+	} else {
+		st.warn(pos, "command %q not run: not enabled by gosh:ok", prompt)
+	}
+	ok := allowed && !skip
+	if ok && programs != nil {
+		if err := checkPrograms(prompt, programs); err != nil {
+			c.reject = fmt.Errorf("%s: command %q rejected: %v", pos, prompt, err)
+			st.warn(pos, "command %q rejected: %v", prompt, err)
+		}
+		for i, kv := range c.Env {
+			if name, _, _ := strings.Cut(kv, "="); c.reject == nil && unsafeVar(name) {
+				how := "gosh:env"
+				if i < len(c.Env)-len(setEnv) {
+					how = "the configured environment"
+				}
+				c.reject = fmt.Errorf("%s: command %q rejected: %s can't set %s under gosh:allow", pos, prompt, how, name)
+				st.warn(pos, "command %q rejected: %s can't set %s under gosh:allow", prompt, how, name)
+			}
+		}
+		for _, f := range c.Filters {
+			if c.reject != nil {
+				break
+			}
+			if err := checkPrograms(f, programs); err != nil {
+				c.reject = fmt.Errorf("%s: command %q rejected: gosh:filter: %v", pos, prompt, err)
+				st.warn(pos, "command %q rejected: gosh:filter: %v", prompt, err)
+			}
+		}
+	}
+	if ok && c.reject == nil && st.opts.Policy != nil {
+		if err := st.opts.Policy.Check(&c); err != nil {
+			c.reject = fmt.Errorf("%s: command %q rejected: %v", pos, prompt, err)
+			st.warn(pos, "command %q rejected: %v", prompt, err)
+		}
+	}
+	if g := st.serial.top(); g != nil && ok {
+		if g.last != nil {
+			c.after = append(c.after, g.last)
+		}
+		g.last = &c
+	}
+	if s := st.session; s != nil && ok {
+		if s.last != nil {
+			c.after = append(c.after, s.last)
+		}
+		s.last = &c
+		c.Session = true
+		c.session = s
+	}
+	return &c, ok
+}
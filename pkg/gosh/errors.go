@@ -0,0 +1,86 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// A CommandError reports that a command failed.
+type CommandError struct {
+	Command *Command
+	Err     error  // error from running the command
+	Stderr  []byte // the command's standard error, if available
+	Excerpt string // the start of the comment containing the command
+}
+
+// Limits on the text included in command errors.
+const (
+	maxExcerptLines = 3
+	maxStderrLines  = 20
+)
+
+// An ExitError reports that a command exited unsuccessfully.
+// Options.Run functions that don't run commands with os/exec
+// return it to report the command's exit status.
+type ExitError struct {
+	Code   int    // the command's exit status
+	Stderr []byte // the command's standard error, if available
+}
+
+func (e *ExitError) Error() string { return fmt.Sprintf("exit status %d", e.Code) }
+
+func newCommandError(src []byte, c *Command, err error) *CommandError {
+	e := &CommandError{Command: c, Err: err}
+
+	var ee *exec.ExitError
+	var se *sessionExitError
+	var xe *ExitError
+	switch {
+	case errors.As(err, &ee):
+		e.Stderr = ee.Stderr
+	case errors.As(err, &se):
+		e.Stderr = se.stderr
+	case errors.As(err, &xe):
+		e.Stderr = xe.Stderr
+	}
+
+	if 0 <= c.Pos.Offset && c.Pos.Offset <= c.End.Offset && c.End.Offset <= len(src) {
+		text := string(src[c.Pos.Offset:c.End.Offset])
+		lines := strings.SplitAfter(text, "\n")
+		if len(lines) > maxExcerptLines {
+			lines = append(lines[:maxExcerptLines], "...\n")
+		}
+		e.Excerpt = strings.Join(lines, "")
+	}
+	return e
+}
+
+func (e *CommandError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: command %q failed: %v", e.Command.Pos, e.Command.Prompt, e.Err)
+	if stderr := strings.TrimRight(string(e.Stderr), "\n"); stderr != "" {
+		lines := strings.Split(stderr, "\n")
+		if len(lines) > maxStderrLines {
+			lines = append([]string{"..."}, lines[len(lines)-maxStderrLines:]...)
+		}
+		b.WriteString("\n\tstderr:")
+		for _, line := range lines {
+			b.WriteString("\n\t\t" + line)
+		}
+	}
+	if excerpt := strings.TrimRight(e.Excerpt, "\n"); excerpt != "" {
+		b.WriteString("\n\tin comment:")
+		for _, line := range strings.Split(excerpt, "\n") {
+			b.WriteString("\n\t\t" + line)
+		}
+	}
+	return b.String()
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
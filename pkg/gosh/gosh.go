@@ -0,0 +1,884 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gosh runs shell commands embedded in source file comments,
+// and rewrites the comments to include the commands' output.
+//
+// See the gosh command for a description of the comment syntax.
+package gosh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// Options configures Process.
+type Options struct {
+	// Filename is the name of the file being processed.
+	// Its extension selects the comment syntax,
+	// and relative paths in directives are resolved against its directory,
+	// or for a file within a txtar archive, that of the archive.
+	Filename string
+
+	// Lang, if set, selects the line comment syntax for files
+	// other than Go, Markdown, and txtar files.
+	// It's either a language name like "sh", or the comment leader itself.
+	Lang string
+
+	// Refresh reruns commands whose output was previously generated.
+	Refresh bool
+
+	// Dir is the working directory for commands.
+	// If empty, commands run in the current directory.
+	Dir string
+
+	// Shell is the shell that runs commands, like "bash".
+	// If empty, commands run with "sh".
+	Shell string
+
+	// Timeout, if positive, limits how long each command may run.
+	Timeout time.Duration
+
+	// CPULimit and MemLimit, if positive, limit the CPU time
+	// and virtual memory in bytes of each process a command starts.
+	// They're applied with the shell's ulimit command,
+	// so they require a POSIX shell.
+	CPULimit time.Duration
+	MemLimit int64
+
+	// OutputLimit, if positive, limits how many bytes of output
+	// each command may produce. Longer output is an error.
+	// Otherwise, or if it's higher, the limit is 64MB.
+	OutputLimit int64
+
+	// Environ, if non-nil, is the environment that commands start with,
+	// in the form "key=value", instead of the environment of the process.
+	Environ []string
+
+	// Env lists additional environment variables for commands.
+	Env []string
+
+	// Runtime is the container runtime that runs commands
+	// with a container image given by "gosh:image", like "podman".
+	// If empty, they run with "docker".
+	Runtime string
+
+	// Mount is the directory mounted in containers, at the same path,
+	// like the root of the repository. If empty, each command's
+	// working directory is mounted.
+	Mount string
+
+	// ContainerArgs lists additional arguments for the container
+	// runtime's run command, like "--network=none", since containers
+	// don't share SysProcAttr's restrictions.
+	ContainerArgs []string
+
+	// SSHConfig, if set, is the ssh configuration file used to run
+	// commands on remote hosts given by "gosh:host".
+	SSHConfig string
+
+	// SysProcAttr, if non-nil, holds operating system specific
+	// attributes for the shells that run commands, like the
+	// credentials of an unprivileged user to run them as.
+	SysProcAttr *syscall.SysProcAttr
+
+	// Run, if non-nil, is called to run each command
+	// instead of Command.Run. It reports unsuccessful exits
+	// with an *exec.ExitError or an *ExitError.
+	// It's called concurrently for commands that run at once.
+	//
+	// The other callbacks, Select, Trace, and Warn, are never
+	// called concurrently, even for the files of a txtar archive,
+	// so they needn't guard the state they share.
+	Run func(ctx context.Context, c *Command) ([]byte, error)
+
+	// Select, if non-nil, is called for each command that's allowed
+	// to run. Only commands for which it returns true are run.
+	Select func(c *Command) bool
+
+	// Trace, if non-nil, is called to describe each directive
+	// as it's processed, for debugging.
+	Trace func(pos token.Position, msg string)
+
+	// KeepGoing makes Process return the rewritten source
+	// even if some commands fail, leaving their text unchanged,
+	// along with an error reporting every failure.
+	KeepGoing bool
+
+	// Policy, if non-nil, forbids running some commands,
+	// even if directives enable them. Such commands fail.
+	Policy *Policy
+
+	// Warn, if non-nil, is called to report problems that
+	// don't stop processing, like commands that are skipped
+	// because they aren't allowed to run.
+	Warn func(pos token.Position, msg string)
+
+	// Trailer appends a line like "(exit 0, 1.2s)" to each command's
+	// output, recording its exit status and running time,
+	// unless the output becomes Go code or goes to a file.
+	Trailer bool
+
+	// Trim normalizes the white space in each command's output,
+	// as for "gosh:trim", so that insignificant differences
+	// between environments don't change it.
+	Trim bool
+
+	// Empty, if non-empty, is inserted as the output of commands
+	// that succeed but print nothing, like "(no output)",
+	// so that they can be told apart from commands that haven't run.
+	// It isn't used for output that goes into code or a file.
+	Empty string
+
+	// Redact lists patterns whose matches in commands' output
+	// are replaced by Redacted, like Secrets.
+	Redact []*regexp.Regexp
+
+	archive string // the txtar archive holding the file, if any
+}
+
+// dir returns the directory against which relative paths in directives
+// are resolved: that of the file, or of the txtar archive holding it.
+func (opts *Options) dir() string {
+	if opts.archive != "" {
+		return filepath.Dir(opts.archive)
+	}
+	return filepath.Dir(opts.Filename)
+}
+
+// A Command is a shell command embedded in a source file.
+type Command struct {
+	Prompt      string         // shell command text
+	Name        string         // name given by "gosh:name", if any
+	Pos         token.Position // position of the comment containing the command
+	End         token.Position // position just after the comment and any previous output
+	Dir         string         // working directory, or "" for the current directory
+	Shell       string         // shell that runs the command, or "" for "sh"
+	Timeout     time.Duration  // time limit for the command, if positive
+	CPULimit    time.Duration  // CPU time limit for each process, if positive
+	MemLimit    int64          // virtual memory limit in bytes for each process, if positive
+	OutputLimit int64          // limit on the length of the output in bytes, if positive
+	Deps        []string       // files the command depends on, from "gosh:deps"
+	After       []string       // names of commands that must succeed first, from "gosh:after"
+	Retry       int            // number of times to retry the command if it fails, from "gosh:retry"
+	Trailer     bool           // append the exit status and running time to the output, from "gosh:trailer"
+	Frozen      bool           // keep the output once the command has run, from "gosh:freeze"
+	MaxLines    int            // number of lines of output to keep, if positive, from "gosh:lines"
+	Wrap        int            // column to wrap long lines of output at, if positive, from "gosh:wrap"
+	Trim        bool           // normalize white space in the output, from "gosh:trim"
+	Filters     []string       // commands the output is piped through, from "gosh:filter"
+
+	// Image is the container image that the command runs in,
+	// with Runtime, as given by "gosh:image", or "" to run it directly.
+	// Runtime, Mount, and ContainerArgs are from the corresponding Options.
+	Image         string
+	Runtime       string
+	Mount         string
+	ContainerArgs []string
+
+	// Host is the remote host that the command runs on with ssh,
+	// as given by "gosh:host", or "" to run it locally.
+	// SSHConfig is from Options.SSHConfig.
+	Host      string
+	SSHConfig string
+
+	// PTY reports whether the command runs with a pseudo-terminal
+	// as its standard input, output, and error, as enabled by "gosh:pty",
+	// so that its output is what a user would see in a terminal.
+	// PTYCols and PTYRows give its size, if set.
+	PTY     bool
+	PTYCols int
+	PTYRows int
+
+	// Stderr reports whether the command's standard error is part of
+	// its output, interleaved with its standard output in the order
+	// they were written, as enabled by "gosh:stderr".
+	Stderr bool
+
+	// Output is the name of the file that the command's output belongs in,
+	// instead of in the source, as given by "gosh:output". The source then
+	// keeps only the command. Process doesn't write the file itself:
+	// Result.Output holds its new contents. The file must be within
+	// Options.Mount, if set, or else the source file's directory.
+	Output string
+
+	// Const is the name of a Go string constant, declared after the comment,
+	// that holds the command's output instead of the comment, as given
+	// by "gosh:const". The declaration is added if it's missing.
+	Const string
+
+	// Code reports whether the command's output is Go code that belongs
+	// in the source after the comment, instead of in the comment,
+	// as enabled by "gosh:code".
+	Code bool
+
+	// Example is the name of an Example function, declared after
+	// the comment, that runs the command and expects its output,
+	// as given by "gosh:example". The function is added if it's missing.
+	Example string
+
+	// Environ is the environment that the command starts with,
+	// from Options.Environ, or nil for the environment of the process.
+	Environ []string
+
+	// Env lists additional environment variables for the command.
+	// In addition to those from Options.Env and "gosh:env" directives,
+	// for each command it runs after by name, GOSH_OUT_name
+	// holds the name of a file containing that command's output,
+	// with characters other than letters and digits in name replaced by "_".
+	Env []string
+
+	// Passthrough lists the names of the variables that "gosh:env"
+	// passes through from the environment of the process, whose values,
+	// if they're set, are in Env but aren't part of the file.
+	Passthrough []string
+
+	// ExitStatus reports whether the command's output ends with
+	// a line like "exit status 1", as for a command written with "%!".
+	// Then the command's exit status is part of its output,
+	// and a command that exits unsuccessfully doesn't fail.
+	ExitStatus bool
+
+	// BestEffort reports whether a failure of the command is only
+	// a warning, as for a command written with "%?". Then the text
+	// the output would replace is left as it was.
+	BestEffort bool
+
+	// Session reports whether the command runs in the file's
+	// persistent shell session, as enabled by "gosh:session".
+	// Its output may depend on the commands run before it.
+	Session bool
+
+	// SysProcAttr holds the attributes for the shell that runs the command,
+	// from Options.SysProcAttr.
+	SysProcAttr *syscall.SysProcAttr
+
+	// Redact lists patterns whose matches in the command's output
+	// are replaced by Redacted. In addition to those from Options.Redact,
+	// it includes those given by earlier "gosh:redact" directives.
+	Redact []*regexp.Regexp
+
+	after   []*Command // commands that must finish first
+	session *session
+	reject  error // reason the command may not run, if any
+}
+
+// Run runs c with "sh -c", or c.Shell, and returns its standard output.
+// If c.Session is set, it runs c in the file's shell session instead.
+// If c.Image is set, it runs the shell in a container from the image,
+// and if c.Host is set, it runs the shell on that host with ssh.
+// The shell first sets c's resource limits, if any, with ulimit.
+func (c *Command) Run(ctx context.Context) ([]byte, error) {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	if c.session != nil {
+		if c.Image != "" || c.Host != "" || c.PTY {
+			return nil, errors.New("gosh:image, gosh:host, and gosh:pty aren't supported in sessions")
+		}
+		out, err := c.session.run(ctx, c)
+		return out, c.timeoutErr(ctx, err)
+	}
+	cmd := exec.CommandContext(ctx, c.shell(), "-c", c.limitScript()+c.Prompt)
+	switch {
+	case c.Image != "" && c.Host != "":
+		return nil, errors.New("gosh:image and gosh:host can't be used together")
+	case c.Image != "":
+		args, err := c.containerArgs(c.limitScript() + c.Prompt)
+		if err != nil {
+			return nil, err
+		}
+		cmd = exec.CommandContext(ctx, c.runtime(), args...)
+	case c.Host != "":
+		cmd = exec.CommandContext(ctx, "ssh", c.sshArgs(c.limitScript()+c.Prompt)...)
+	}
+	cmd.Dir = c.Dir
+	cmd.SysProcAttr = c.SysProcAttr
+	killGroup(cmd)
+	cmd.Env = c.environ()
+	var out []byte
+	var err error
+	if c.PTY {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cols, rows := c.ptySize()
+		cmd.Env = append(cmd.Env, fmt.Sprintf("COLUMNS=%d", cols), fmt.Sprintf("LINES=%d", rows))
+		out, err = c.runPTY(cmd)
+	} else {
+		out, err = c.runSpill(cmd)
+	}
+	return out, c.timeoutErr(ctx, err)
+}
+
+// timeoutErr returns err, the error from running c with ctx,
+// or an error reporting that c timed out, if that's why it failed.
+func (c *Command) timeoutErr(ctx context.Context, err error) error {
+	if err != nil && c.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", c.Timeout)
+	}
+	return err
+}
+
+// environ returns the environment to run c with,
+// or nil for the environment of the process.
+func (c *Command) environ() []string {
+	if c.Environ == nil && len(c.Env) == 0 {
+		return nil
+	}
+	env := c.Environ
+	if env == nil {
+		env = os.Environ()
+	}
+	return append(slices.Clip(env), c.Env...)
+}
+
+// filter returns output, the output of c,
+// piped through each of c.Filters in turn.
+// The filters run locally, with c's shell, directory, and environment.
+func (c *Command) filter(ctx context.Context, output []byte) ([]byte, error) {
+	for _, f := range c.Filters {
+		cmd := exec.CommandContext(ctx, c.shell(), "-c", f)
+		cmd.Dir = c.Dir
+		cmd.SysProcAttr = c.SysProcAttr
+		killGroup(cmd)
+		cmd.Env = c.environ()
+		cmd.Stdin = bytes.NewReader(output)
+		out, err := cmd.Output()
+		if err != nil {
+			var ee *exec.ExitError
+			if errors.As(err, &ee) && len(ee.Stderr) > 0 {
+				err = fmt.Errorf("%v: %s", err, bytes.TrimSpace(ee.Stderr))
+			}
+			return nil, fmt.Errorf("gosh:filter %q: %v", f, err)
+		}
+		output = out
+	}
+	return output, nil
+}
+
+// runSpill runs cmd, and returns its output, collected in a spillBuffer
+// so that long output doesn't have to be held in memory.
+// Like exec.Cmd.Output, it includes the end of the standard error
+// in the error it returns, if any.
+func (c *Command) runSpill(cmd *exec.Cmd) ([]byte, error) {
+	stdout := &spillBuffer{limit: c.outputLimit()}
+	defer stdout.Close()
+	stderr := &tailBuffer{limit: maxStderr}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if c.Stderr {
+		cmd.Stderr = stdout
+	}
+	err := cmd.Run()
+	out, oerr := stdout.Bytes()
+	if ee, ok := err.(*exec.ExitError); ok && !c.Stderr {
+		ee.Stderr = stderr.buf
+	}
+	if err == nil {
+		err = oerr
+	}
+	return out, err
+}
+
+// cutPrompt reports whether text starts with a command after mark,
+// which is "%", or "#" for a command that already ran, and returns
+// the rest of text. It also returns the variant of the command:
+// "!" for "%!", "?" for "%?", or "" for a plain command.
+func cutPrompt(text, mark string) (rest, variant string, ok bool) {
+	for _, variant := range []string{"", "!", "?"} {
+		if rest, ok := strings.CutPrefix(text, mark+variant+" "); ok {
+			return rest, variant, true
+		}
+	}
+	return "", "", false
+}
+
+// setVariant sets the fields of c for a command of the given variant,
+// as returned by cutPrompt.
+func (c *Command) setVariant(variant string) {
+	c.ExitStatus = variant == "!"
+	c.BestEffort = variant == "?"
+}
+
+// continues reports whether line, a line of a command,
+// ends in a backslash, continuing the command on the next line.
+func continues(line string) bool {
+	return strings.HasSuffix(strings.TrimRight(line, " \t\r\n"), `\`)
+}
+
+// shell returns the shell that runs c.
+func (c *Command) shell() string {
+	if c.Shell == "" {
+		return "sh"
+	}
+	return c.Shell
+}
+
+// A Result describes a command that Process ran,
+// and the edit it made to the source file.
+type Result struct {
+	Command
+
+	// Offset and End are the byte offsets of the text replaced
+	// in the original source. Old is that text, and New is its replacement.
+	// In Go files, New is as gofmt formats it in place, unless formatting
+	// would change other parts of the file too, so that it's the same
+	// as Old if the output is up to date.
+	// If the command failed, New is the same as Old.
+	Offset, End int
+	Old, New    string
+
+	Output   []byte        // the command's output
+	Err      error         // error running the command, if any
+	ExitCode int           // the command's exit status, or -1 if it didn't exit
+	Duration time.Duration // how long the command took
+}
+
+// Process runs the shell commands embedded in src,
+// the contents of the file opts.Filename,
+// and returns the rewritten source and the results of each command.
+func Process(ctx context.Context, src []byte, opts Options) ([]byte, []Result, error) {
+	ext := filepath.Ext(opts.Filename)
+	leader := ""
+	if ext != ".go" && ext != "" && ext != ".md" && ext != ".txtar" {
+		leader = CommentLeader(opts.Filename, opts.Lang)
+		if leader == "" {
+			return nil, nil, fmt.Errorf("%s: unknown file type", opts.Filename)
+		}
+	}
+	if !mayHaveWork(src, &opts) {
+		return src, nil, nil
+	}
+	serializeCallbacks(&opts)
+	switch ext {
+	case ".go", "":
+		return processGo(ctx, src, &opts)
+	case ".md":
+		return processMarkdown(ctx, src, &opts)
+	case ".txtar":
+		return processTxtar(ctx, src, &opts)
+	}
+	return processLines(ctx, src, &opts, leader)
+}
+
+// serializeCallbacks makes the Select, Trace, and Warn callbacks
+// of opts take turns, as documented: warnings come from commands
+// running concurrently, and the files of a txtar archive are processed
+// concurrently.
+func serializeCallbacks(opts *Options) {
+	var mu sync.Mutex
+	if f := opts.Select; f != nil {
+		opts.Select = func(c *Command) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return f(c)
+		}
+	}
+	if f := opts.Trace; f != nil {
+		opts.Trace = func(pos token.Position, msg string) {
+			mu.Lock()
+			defer mu.Unlock()
+			f(pos, msg)
+		}
+	}
+	if f := opts.Warn; f != nil {
+		opts.Warn = func(pos token.Position, msg string) {
+			mu.Lock()
+			defer mu.Unlock()
+			f(pos, msg)
+		}
+	}
+}
+
+// mayHaveWork reports whether src might contain commands or directives.
+// Most files contain neither, and this is much cheaper than scanning them.
+func mayHaveWork(src []byte, opts *Options) bool {
+	return bytes.Contains(src, []byte("% ")) ||
+		bytes.Contains(src, []byte("gosh:")) ||
+		opts.Refresh && bytes.Contains(src, []byte("# "))
+}
+
+// A job is a command found while scanning a file,
+// along with the text its output replaces.
+type job struct {
+	cmd        *Command
+	start, end int // byte offsets of the text to replace
+
+	// transform, if non-nil, checks and transforms
+	// the command's output before it's rendered.
+	transform func(output []byte) ([]byte, error)
+
+	// render returns the replacement text for the command's output.
+	render func(output []byte) string
+}
+
+// execute runs jobs concurrently, and returns src
+// with each job's text replaced by its rendered output.
+func execute(ctx context.Context, src []byte, jobs []*job, opts *Options) ([]byte, []Result, error) {
+	if err := resolveAfter(jobs); err != nil {
+		return nil, nil, err
+	}
+	if opts.Select != nil {
+		var selected []*job
+		for _, j := range jobs {
+			if opts.Select(j.cmd) {
+				selected = append(selected, j)
+			}
+		}
+		jobs = selected
+	}
+
+	defer func() {
+		for _, j := range jobs {
+			if j.cmd.session != nil {
+				j.cmd.session.close()
+			}
+		}
+	}()
+
+	// The outputs of named commands are saved
+	// for the commands that run after them.
+	var outDir string
+	for _, j := range jobs {
+		if len(j.cmd.After) > 0 {
+			dir, err := os.MkdirTemp("", "gosh-out")
+			if err != nil {
+				return nil, nil, err
+			}
+			defer os.RemoveAll(dir)
+			if opts.SysProcAttr != nil {
+				// Commands may run as another user, who must be able to
+				// read the output files, but not list or change them.
+				if err := os.Chmod(dir, 0711); err != nil {
+					return nil, nil, err
+				}
+			}
+			outDir = dir
+			break
+		}
+	}
+
+	// Commands wait for the commands they run after,
+	// and don't run if any of those fail.
+	// Those that aren't run are skipped over,
+	// keeping the order of the ones they run after.
+	type status struct {
+		done   chan struct{}
+		failed bool
+	}
+	statuses := make(map[*Command]*status)
+	for _, j := range jobs {
+		statuses[j.cmd] = &status{done: make(chan struct{})}
+	}
+	var wait func(c *Command) (failed *Command)
+	wait = func(c *Command) *Command {
+		for _, dep := range c.after {
+			if s, ok := statuses[dep]; ok {
+				<-s.done
+				if s.failed {
+					return dep
+				}
+			} else if failed := wait(dep); failed != nil {
+				return failed
+			}
+		}
+		return nil
+	}
+
+	results := make([]Result, len(jobs))
+	var g errgroup.Group
+	for i, j := range jobs {
+		g.Go(func() error {
+			s := statuses[j.cmd]
+			defer close(s.done)
+
+			r := &results[i]
+			r.Command = *j.cmd
+			r.Offset, r.End = j.start, j.end
+			r.Old = string(src[j.start:j.end])
+
+			if j.cmd.reject != nil {
+				s.failed = true
+				r.New = r.Old
+				r.ExitCode = -1
+				r.Err = j.cmd.reject
+				return r.Err
+			}
+			if failed := wait(j.cmd); failed != nil {
+				s.failed = true
+				r.New = r.Old
+				r.ExitCode = -1
+				r.Err = fmt.Errorf("%s: not run because %q failed", j.cmd.Pos, failed.Prompt)
+				return r.Err
+			}
+			for _, name := range j.cmd.After {
+				path := filepath.Join(outDir, outputVar(name))
+				if _, err := os.Stat(path); err == nil {
+					j.cmd.Env = append(j.cmd.Env, outputVar(name)+"="+path)
+				}
+			}
+			r.Command.Env = j.cmd.Env
+
+			start := time.Now()
+			backoff := retryBackoff
+			for attempt := 0; ; attempt++ {
+				if opts.Run != nil {
+					r.Output, r.Err = opts.Run(ctx, j.cmd)
+				} else {
+					r.Output, r.Err = j.cmd.Run(ctx)
+				}
+				// A command run with "%!" is expected to fail,
+				// so its exit status alone is no reason to retry it.
+				expected := j.cmd.ExitStatus && exitCode(r.Err) > 0
+				if r.Err == nil || expected || attempt >= j.cmd.Retry || !sleep(ctx, backoff) {
+					break
+				}
+				backoff *= 2
+			}
+			r.Duration = time.Since(start)
+			r.Output = redact(r.Output, j.cmd.Redact)
+			r.ExitCode = exitCode(r.Err)
+			if j.cmd.ExitStatus && r.ExitCode > 0 {
+				// The failure is what the command shows.
+				r.Err = nil
+			}
+			if r.Err == nil && len(j.cmd.Filters) > 0 {
+				if r.Output, r.Err = j.cmd.filter(ctx, r.Output); r.Err != nil {
+					r.ExitCode = -1
+				}
+			}
+			if r.Err != nil && j.cmd.BestEffort {
+				// Keep the previous output, if any.
+				if opts.Warn != nil {
+					opts.Warn(j.cmd.Pos, fmt.Sprintf("command %q failed, keeping its previous output: %v", j.cmd.Prompt, r.Err))
+				}
+				r.New = r.Old
+				r.Err = nil
+				return nil
+			}
+			if r.Err != nil {
+				s.failed = true
+				r.New = r.Old
+				r.Err = newCommandError(src, j.cmd, r.Err)
+				return r.Err
+			}
+			if outDir != "" && j.cmd.Name != "" {
+				if err := os.WriteFile(filepath.Join(outDir, outputVar(j.cmd.Name)), r.Output, 0644); err != nil {
+					return err
+				}
+			}
+			output := r.Output
+			if opts.Trim || j.cmd.Trim {
+				output = trimOutput(output)
+			}
+			if j.cmd.MaxLines > 0 {
+				output = capLines(output, j.cmd.MaxLines)
+			}
+			if j.cmd.Wrap > 0 {
+				output = wrapLines(output, j.cmd.Wrap)
+			}
+			if len(output) == 0 && opts.Empty != "" && j.cmd.Output == "" && j.cmd.Const == "" && !j.cmd.Code && j.cmd.Example == "" {
+				output = []byte(opts.Empty + "\n")
+			}
+			if j.cmd.ExitStatus {
+				output = appendExitStatus(output, r.ExitCode)
+			}
+			if j.cmd.Output != "" {
+				// The file holds the output, as it would appear in the source.
+				r.Output, output = output, nil
+			} else if (opts.Trailer || j.cmd.Trailer) && j.cmd.Const == "" && !j.cmd.Code && j.cmd.Example == "" {
+				// Generated code and constants hold just the output.
+				output = appendTrailer(output, r.ExitCode, r.Duration)
+			}
+			if j.transform != nil {
+				var err error
+				if output, err = j.transform(output); err != nil {
+					s.failed = true
+					r.New = r.Old
+					r.Err = fmt.Errorf("%s: command %q: %v", j.cmd.Pos, j.cmd.Prompt, err)
+					return r.Err
+				}
+			}
+			r.New = j.render(output)
+			return nil
+		})
+	}
+	err := g.Wait()
+	if err != nil && !opts.KeepGoing {
+		return nil, results, err
+	}
+	if err != nil {
+		var errs []error
+		for _, r := range results {
+			if r.Err != nil {
+				errs = append(errs, r.Err)
+			}
+		}
+		err = errors.Join(errs...)
+	}
+
+	var buf bytes.Buffer
+	pos := 0
+	for _, r := range results {
+		buf.Write(src[pos:r.Offset])
+		buf.WriteString(r.New)
+		pos = r.End
+	}
+	buf.Write(src[pos:])
+	return buf.Bytes(), results, err
+}
+
+// resolveAfter adds the commands named by each job's "gosh:after"
+// directive to the commands it runs after. It reports an error
+// if a name is unknown, or if commands depend on each other in a cycle.
+func resolveAfter(jobs []*job) error {
+	named := make(map[string]*Command)
+	for _, j := range jobs {
+		if j.cmd.Name != "" {
+			named[j.cmd.Name] = j.cmd
+		}
+	}
+	for _, j := range jobs {
+		for _, name := range j.cmd.After {
+			dep, ok := named[name]
+			if !ok {
+				return fmt.Errorf("%s: gosh:after: no command named %q", j.cmd.Pos, name)
+			}
+			j.cmd.after = append(j.cmd.after, dep)
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	marks := make(map[*Command]int)
+	var visit func(c *Command) error
+	visit = func(c *Command) error {
+		switch marks[c] {
+		case visiting:
+			return fmt.Errorf("%s: gosh:after: dependency cycle", c.Pos)
+		case visited:
+			return nil
+		}
+		marks[c] = visiting
+		for _, dep := range c.after {
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		marks[c] = visited
+		return nil
+	}
+	for _, j := range jobs {
+		if err := visit(j.cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendTrailer returns output followed by a line
+// recording the command's exit status and running time.
+func appendTrailer(output []byte, code int, d time.Duration) []byte {
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		output = append(output[:len(output):len(output)], '\n')
+	}
+	return fmt.Appendf(output[:len(output):len(output)], "(exit %d, %.1fs)\n", code, d.Seconds())
+}
+
+// appendExitStatus returns output followed by a line
+// recording the command's exit status.
+func appendExitStatus(output []byte, code int) []byte {
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		output = append(output[:len(output):len(output)], '\n')
+	}
+	return fmt.Appendf(output[:len(output):len(output)], "exit status %d\n", code)
+}
+
+// waitDelay is how long to wait for a killed command's output to close,
+// in case processes it started still hold it open.
+const waitDelay = time.Second
+
+// retryBackoff is how long to wait before retrying a failed command
+// the first time. The wait doubles for each later retry.
+// It's a variable for testing.
+var retryBackoff = 500 * time.Millisecond
+
+// sleep waits for d, and reports whether it did so
+// without ctx being canceled.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// outputVar returns the name of the environment variable
+// holding the output file of the command named name.
+func outputVar(name string) string {
+	return "GOSH_OUT_" + strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// exitCode returns the exit status reported by err,
+// the result of running a command.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var ee *exec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitCode()
+	}
+	var se *sessionExitError
+	if errors.As(err, &se) {
+		return se.code
+	}
+	var xe *ExitError
+	if errors.As(err, &xe) {
+		return xe.Code
+	}
+	return -1
+}
+
+// cutDirective splits a directive into its name and argument,
+// which are separated by a space or "=".
+func cutDirective(s string) (name, arg string) {
+	if i := strings.IndexAny(s, " ="); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i+1:])
+	}
+	return s, ""
+}
+
+type stack[T any] []T
+
+func (s *stack[T]) push(t T)  { *s = append(*s, t) }
+func (s *stack[T]) pop()      { *s = (*s)[:len(*s)-1] }
+func (s stack[T]) top() T     { return s[len(s)-1] }
+func (s stack[T]) setTop(t T) { s[len(s)-1] = t }
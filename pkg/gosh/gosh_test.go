@@ -0,0 +1,342 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"context"
+	"go/token"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	defer func(old time.Duration) { retryBackoff = old }(retryBackoff)
+	retryBackoff = 0
+
+	tests := []struct {
+		name  string
+		src   string
+		codes []int // exit status of each attempt, the last repeating
+		runs  int
+		want  string
+	}{
+		{
+			name:  "succeeds",
+			src:   "#gosh:ok\n# gosh:retry=3\n# % run\n",
+			codes: []int{0},
+			runs:  1,
+			want:  "#gosh:ok\n# gosh:retry=3\n# # run\n# | out\n",
+		},
+		{
+			name:  "succeeds on retry",
+			src:   "#gosh:ok\n# gosh:retry=3\n# % run\n",
+			codes: []int{1, 1, 0},
+			runs:  3,
+			want:  "#gosh:ok\n# gosh:retry=3\n# # run\n# | out\n",
+		},
+		{
+			name:  "expected failure",
+			src:   "#gosh:ok\n# gosh:retry=3\n# %! run\n",
+			codes: []int{2, 0},
+			runs:  1,
+			want:  "#gosh:ok\n# gosh:retry=3\n# #! run\n# | out\n# | exit status 2\n",
+		},
+		{
+			name:  "expected success",
+			src:   "#gosh:ok\n# gosh:retry=3\n# %! run\n",
+			codes: []int{0},
+			runs:  1,
+			want:  "#gosh:ok\n# gosh:retry=3\n# #! run\n# | out\n# | exit status 0\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runs := 0
+			out, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename: "run.sh",
+				Run: func(ctx context.Context, c *Command) ([]byte, error) {
+					code := tt.codes[min(runs, len(tt.codes)-1)]
+					runs++
+					if code != 0 {
+						return []byte("out\n"), &ExitError{Code: code}
+					}
+					return []byte("out\n"), nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Err != nil {
+					t.Fatal(r.Err)
+				}
+			}
+			if runs != tt.runs {
+				t.Errorf("ran %d times, want %d", runs, tt.runs)
+			}
+			if string(out) != tt.want {
+				t.Errorf("Process:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestBestEffortWarn(t *testing.T) {
+	defer func(old time.Duration) { retryBackoff = old }(retryBackoff)
+	retryBackoff = 0
+
+	tests := []struct {
+		name string
+		src  string
+		run  func(ctx context.Context, c *Command) ([]byte, error)
+	}{
+		{
+			name: "failed",
+			src:  "#gosh:ok\n# gosh:retry=2\n# %? run\n",
+			run: func(ctx context.Context, c *Command) ([]byte, error) {
+				return nil, &ExitError{Code: 1}
+			},
+		},
+		{
+			name: "filter failed",
+			src:  "#gosh:ok\n# gosh:filter false\n# %? echo a\n",
+			run:  echoRun,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var warnings []string
+			out, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename: "run.sh",
+				Run:      tt.run,
+				Warn: func(pos token.Position, msg string) {
+					warnings = append(warnings, msg)
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Err != nil {
+					t.Fatal(r.Err)
+				}
+			}
+			if out != nil && string(out) != tt.src {
+				t.Errorf("Process changed the file:\n%s", out)
+			}
+			// Once for the command, not once for each attempt.
+			if len(warnings) != 1 {
+				t.Errorf("warnings = %q, want one", warnings)
+			}
+		})
+	}
+}
+
+func TestAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		fail string   // the command that fails, if any
+		ran  []string // the commands that ran, in order
+		err  string   // if set, the error contains it
+	}{
+		{
+			name: "before its dependency",
+			src:  "#gosh:ok\n# gosh:after=setup\n# % echo use\n# gosh:name=setup\n# % echo setup\n",
+			ran:  []string{"echo setup", "echo use"},
+		},
+		{
+			name: "chain",
+			src:  "#gosh:ok\n# gosh:name=c\n# gosh:after=b\n# % echo c\n# gosh:name=b\n# gosh:after=a\n# % echo b\n# gosh:name=a\n# % echo a\n",
+			ran:  []string{"echo a", "echo b", "echo c"},
+		},
+		{
+			name: "several",
+			src:  "#gosh:ok\n# gosh:after=a,b\n# % echo c\n# gosh:name=a\n# % echo a\n# gosh:name=b\n# gosh:after=a\n# % echo b\n",
+			ran:  []string{"echo a", "echo b", "echo c"},
+		},
+		{
+			name: "unknown",
+			src:  "#gosh:ok\n# gosh:after=setup\n# % echo use\n",
+			err:  `no command named "setup"`,
+		},
+		{
+			name: "cycle",
+			src:  "#gosh:ok\n# gosh:name=a\n# gosh:after=b\n# % echo a\n# gosh:name=b\n# gosh:after=a\n# % echo b\n",
+			err:  "dependency cycle",
+		},
+		{
+			name: "self",
+			src:  "#gosh:ok\n# gosh:name=a\n# gosh:after=a\n# % echo a\n",
+			err:  "dependency cycle",
+		},
+		{
+			name: "longer cycle",
+			src:  "#gosh:ok\n# gosh:name=a\n# gosh:after=c\n# % echo a\n# gosh:name=b\n# gosh:after=a\n# % echo b\n# gosh:name=c\n# gosh:after=b\n# % echo c\n",
+			err:  "dependency cycle",
+		},
+		{
+			name: "dependency failed",
+			src:  "#gosh:ok\n# gosh:after=setup\n# % echo use\n# gosh:name=setup\n# % echo setup\n",
+			fail: "echo setup",
+			ran:  []string{"echo setup"},
+			err:  `not run because "echo setup" failed`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var ran []string
+			_, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename:  "run.sh",
+				KeepGoing: true,
+				Run: func(ctx context.Context, c *Command) ([]byte, error) {
+					mu.Lock()
+					ran = append(ran, c.Prompt)
+					mu.Unlock()
+					if c.Prompt == tt.fail {
+						return nil, &ExitError{Code: 1}
+					}
+					return echoRun(ctx, c)
+				},
+			})
+			if err == nil {
+				for _, r := range results {
+					if r.Err != nil && !strings.Contains(r.Err.Error(), "exit status") {
+						err = r.Err
+						break
+					}
+				}
+			}
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("Process: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("Process: got %v, want error containing %q", err, tt.err)
+			}
+			if !reflect.DeepEqual(ran, tt.ran) {
+				t.Errorf("ran %q, want %q", ran, tt.ran)
+			}
+		})
+	}
+}
+
+func TestAfterOutput(t *testing.T) {
+	src := "#gosh:ok\n# gosh:after=gen\n# % cat $GOSH_OUT_gen\n# gosh:name=gen\n# % echo generated\n"
+	var env []string
+	var data []byte
+	_, results, err := Process(context.Background(), []byte(src), Options{
+		Filename: "run.sh",
+		Run: func(ctx context.Context, c *Command) ([]byte, error) {
+			if c.Name == "" {
+				// The dependent command finds the other's output in a file.
+				env = c.Env
+				if len(env) == 1 {
+					data, _ = os.ReadFile(strings.TrimPrefix(env[0], "GOSH_OUT_gen="))
+				}
+			}
+			return echoRun(ctx, c)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			t.Fatal(r.Err)
+		}
+	}
+	if len(env) != 1 || !strings.HasPrefix(env[0], "GOSH_OUT_gen=") {
+		t.Fatalf("env = %q, want GOSH_OUT_gen", env)
+	}
+	if string(data) != "generated\n" {
+		t.Errorf("output file holds %q, want %q", data, "generated\n")
+	}
+	// It's removed once the file is processed.
+	if _, err := os.Stat(strings.TrimPrefix(env[0], "GOSH_OUT_gen=")); err == nil {
+		t.Errorf("output file %s still exists after Process", env[0])
+	}
+}
+
+func TestOptionLikeTargets(t *testing.T) {
+	for _, src := range []string{
+		"#gosh:ok\n# gosh:host=-oProxyCommand=touch${IFS}pwned\n# % echo a\n",
+		"#gosh:ok\n# gosh:image=--privileged\n# % echo a\n",
+	} {
+		_, _, err := Process(context.Background(), []byte(src), Options{
+			Filename: "run.sh",
+			Run: func(ctx context.Context, c *Command) ([]byte, error) {
+				t.Errorf("ran %q on host %q in image %q", c.Prompt, c.Host, c.Image)
+				return echoRun(ctx, c)
+			},
+		})
+		if err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Errorf("Process(%q): got %v, want invalid host or image", src, err)
+		}
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		src    string
+		output string // the file's contents
+		err    string // if set, the error contains it
+	}{
+		{
+			name:   "processed",
+			src:    "#gosh:ok\n# gosh:output=out.txt\n# gosh:trim\n# gosh:lines=1\n# % echo 'a  ' b\n",
+			output: "a\n... (1 more line)\n",
+		},
+		{
+			name:   "exit status",
+			src:    "#gosh:ok\n# gosh:output=out.txt\n# gosh:trailer\n# %! echo a\n",
+			output: "a\nexit status 0\n",
+		},
+		{
+			name: "outside",
+			src:  "#gosh:ok\n# gosh:output=../out.txt\n# % echo a\n",
+			err:  "gosh:output: ../out.txt is outside",
+		},
+		{
+			name: "absolute",
+			src:  "#gosh:ok\n# gosh:output=" + filepath.Join(dir, "out.txt") + "\n# % echo a\n",
+			err:  "is outside",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename: filepath.Join(dir, "run.sh"),
+				Run: func(ctx context.Context, c *Command) ([]byte, error) {
+					out, err := echoRun(ctx, c)
+					return bytes.ReplaceAll(out, []byte(" b"), []byte("\nb")), err
+				},
+			})
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("Process: got %v, want error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(results) != 1 || results[0].Command.Output != filepath.Join(dir, "out.txt") {
+				t.Fatalf("results = %+v, want one for out.txt", results)
+			}
+			if got := string(results[0].Output); got != tt.output {
+				t.Errorf("output = %q, want %q", got, tt.output)
+			}
+		})
+	}
+}
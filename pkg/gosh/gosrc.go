@@ -0,0 +1,606 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// processGo processes Go source code.
+//
+// Commands are comments that start with "// % " or "/* % ".
+// The rest of the comment is replaced with the command's output,
+// and the "%" with "#". With opts.Refresh, comments that
+// start with "/* # " are processed again too.
+// Commands written with "%!" record their exit status, and those
+// written with "%?" only warn if they fail; they become "#!" and "#?".
+// A command line ending in a backslash continues on the next line
+// of the comment, or in the next line comment. Later lines of a block
+// comment that start with "% " are further commands, run in order,
+// each followed by its own output. Such a transcript is rewritten
+// to start with "/*" on a line by itself, which marks it as one
+// when it's processed again; otherwise only the first line of
+// a comment that starts with "/* # " is a command.
+//
+// Directives are comments that start with "//gosh:",
+// and apply to the end of their innermost scope.
+// The "gosh:ok" and "gosh:deny" directives in the comments
+// before the package clause apply to the entire file,
+// including commands earlier in those comments, and the
+// "gosh:ok", "gosh:allow", and "gosh:deny" directives in a function's
+// doc comment apply to the function's body.
+func processGo(ctx context.Context, src []byte, opts *Options) ([]byte, []Result, error) {
+	fset := token.NewFileSet()
+	file := fset.AddFile(opts.Filename, -1, len(src))
+	st := newState(opts)
+
+	// Process the file-level directives first.
+	const prefix = "//gosh:"
+	fileLevel := make(map[token.Pos]bool)
+	var s scanner.Scanner
+	s.Init(file, src, nil, scanner.ScanComments)
+	for {
+		pos, tok, lit := s.Scan()
+		if tok != token.COMMENT {
+			break
+		}
+		text, ok := strings.CutPrefix(lit, prefix)
+		if name, _ := cutDirective(text); !ok || name != "ok" && name != "deny" {
+			continue
+		}
+		fileLevel[pos] = true
+		if err := st.directive(text, fset.Position(pos+token.Pos(len(prefix)))); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Enabling directives in a function's doc comment
+	// apply to its body, once it's entered.
+	type directive struct {
+		text string
+		pos  token.Position
+	}
+	docs := funcDocs(src)
+	bodyDirectives := make(map[int][]directive) // by offset of the body
+
+	s.Init(file, src, nil, scanner.ScanComments)
+	var jobs []*job
+	skip := 0 // offset of the end of generated code to skip over
+Outer:
+	for {
+		pos, tok, lit := s.Scan()
+		if tok != token.EOF && file.Offset(pos) < skip {
+			continue
+		}
+		switch tok {
+		case token.EOF:
+			break Outer
+
+		case token.LBRACE:
+			st.push()
+			for _, d := range bodyDirectives[file.Offset(pos)] {
+				if err := st.directive(d.text, d.pos); err != nil {
+					return nil, nil, err
+				}
+			}
+
+		case token.RBRACE:
+			st.pop()
+
+		case token.COMMENT:
+			// Process directives.
+			if fileLevel[pos] {
+				continue
+			}
+			if text, ok := strings.CutPrefix(lit, prefix); ok {
+				if body, ok := docs[file.Offset(pos)]; ok {
+					bodyDirectives[body] = append(bodyDirectives[body], directive{text, fset.Position(pos + token.Pos(len(prefix)))})
+					continue
+				}
+				pos := pos + token.Pos(len(prefix))
+				if err := st.directive(text, fset.Position(pos)); err != nil {
+					return nil, nil, err
+				}
+				continue
+			}
+
+			// Unit testing logic.
+			if false {
+				want := func(ok bool) {
+					if st.allowed.top() != ok {
+						log.Fatalf("%s: want ok=%v, but allowed=%v", fset.Position(pos), ok, st.allowed)
+					}
+				}
+				switch text := lit; {
+				case strings.Contains(text, "% ok"):
+					want(true)
+				case strings.Contains(text, "% FAIL"):
+					want(false)
+				}
+			}
+
+			text, ok := strings.CutPrefix(lit[2:], " ")
+			transcript := strings.HasPrefix(lit, "/*\n")
+			if transcript {
+				text, ok = lit[3:], true
+			}
+			if !ok {
+				continue
+			}
+			prompt, variant, ok := cutPrompt(text, "%")
+			ran := false // whether the command ran before
+			if !ok && opts.Refresh && strings.HasPrefix(lit, "/*") {
+				prompt, variant, ok = cutPrompt(text, "#")
+				ran = true
+			}
+			if !ok {
+				continue
+			}
+			mark := "#" + variant
+			offset := file.Offset(pos)
+			end := offset + len(lit)
+			var prompts []string // commands in a block comment
+			var starts []int     // and their offsets
+			if strings.HasPrefix(lit, "//") {
+				for continues(prompt) {
+					line, lineEnd, ok := nextLineComment(src, end)
+					if !ok {
+						break
+					}
+					prompt += "\n" + line
+					end = lineEnd
+				}
+				// Don't scan the continuation lines again.
+				skip = max(skip, end)
+			} else {
+				prompts, starts = blockCommands(prompt, end-len(prompt), ran, transcript)
+				prompt = prompts[0]
+			}
+			prompt = strings.TrimSpace(prompt)
+
+			cmd, ok := st.command(prompt, fset.Position(pos), fset.Position(file.Pos(end)))
+			cmd.setVariant(variant)
+			if cmd.Example != "" && variant != "" {
+				// The example would fail, rather than print the exit status.
+				return nil, nil, fmt.Errorf("%s: gosh:example doesn't support %%%s commands", fset.Position(pos), variant)
+			}
+			// The code generated for the command, if any, is skipped.
+			regionEnd := -1
+			switch {
+			case cmd.Code:
+				regionEnd = generatedCode(src, end)
+			case cmd.Example != "":
+				regionEnd = funcDecl(src, end, cmd.Example)
+			}
+			skip = max(skip, regionEnd)
+			if !ok || ran && cmd.Frozen {
+				continue
+			}
+			j := &job{
+				cmd:   cmd,
+				start: offset,
+				end:   end,
+				render: func(output []byte) string {
+					return fmt.Sprintf("/* %s %s\n%s*/", mark, prompt, output)
+				},
+			}
+			if name := cmd.Const; name != "" {
+				if end, ok := constDecl(src, j.end, name); ok {
+					j.end = end
+				}
+				j.render = func(output []byte) string {
+					return fmt.Sprintf("/* %s %s\n*/\nconst %s = %s", mark, prompt, name, stringLit(output))
+				}
+			}
+			if regionEnd >= 0 {
+				j.end = regionEnd
+			}
+			if cmd.Code {
+				j.transform = formatCode
+				j.render = func(output []byte) string {
+					return fmt.Sprintf("/* %s %s\n*/\n%s%s", mark, prompt, output, codeMarker)
+				}
+			}
+			if cmd.Example != "" {
+				j.render = func(output []byte) string {
+					return fmt.Sprintf("/* %s %s\n*/\n%s", mark, prompt, exampleFunc(cmd, output))
+				}
+			}
+			jobs = append(jobs, j)
+
+			if len(prompts) < 2 && !transcript {
+				continue
+			}
+			if cmd.Const != "" || cmd.Code || cmd.Example != "" || cmd.Output != "" {
+				return nil, nil, fmt.Errorf("%s: gosh:const, gosh:code, gosh:example, and gosh:output don't support several commands in one comment", fset.Position(pos))
+			}
+			// Output lines like commands would be taken for them.
+			j.transform = commentOutput
+			if len(prompts) < 2 {
+				j.render = func(output []byte) string {
+					return fmt.Sprintf("/*\n%s %s\n%s*/", mark, prompt, output)
+				}
+				continue
+			}
+			// Each command's output goes before the next command.
+			j.end = starts[1]
+			j.render = func(output []byte) string {
+				return fmt.Sprintf("/*\n%s %s\n%s", mark, prompt, output)
+			}
+			prev := cmd
+			for k := 1; k < len(prompts); k++ {
+				prompt := prompts[k]
+				start, end := starts[k], end
+				last := k == len(prompts)-1
+				if !last {
+					end = starts[k+1]
+				}
+				cmd, ok := st.command(prompt, fset.Position(file.Pos(start)), fset.Position(file.Pos(end)))
+				if !ok {
+					continue
+				}
+				cmd.after = append(cmd.after, prev)
+				prev = cmd
+				jobs = append(jobs, &job{
+					cmd:       cmd,
+					start:     start,
+					end:       end,
+					transform: commentOutput,
+					render: func(output []byte) string {
+						if last {
+							return fmt.Sprintf("%% %s\n%s*/", prompt, output)
+						}
+						return fmt.Sprintf("%% %s\n%s", prompt, output)
+					},
+				})
+			}
+		}
+	}
+
+	st.finish()
+	out, results, err := execute(ctx, src, jobs, opts)
+	if out == nil {
+		return nil, results, err
+	}
+	if len(results) == 0 {
+		// Nothing changed, so don't reformat the file.
+		return src, nil, err
+	}
+	for _, r := range results {
+		if r.Example != "" && r.Err == nil {
+			var ierr error
+			if out, ierr = addImports(out, "os", "os/exec"); ierr != nil {
+				return nil, results, ierr
+			}
+			break
+		}
+	}
+	out, ferr := format.Source(out)
+	if ferr != nil {
+		return nil, results, ferr
+	}
+	// Report each replacement as gofmt leaves it, like the comment's
+	// indentation, so that it's the same as the old text if the
+	// output is unchanged.
+	for i := range results {
+		r := &results[i]
+		if r.New == r.Old {
+			continue
+		}
+		if text, ok := formatEdit(src, r.Offset, r.End, r.New); ok {
+			r.New = text
+		}
+	}
+	return out, results, err
+}
+
+// formatEdit returns text, which replaces src[offset:end],
+// as it is once the file is formatted, and whether it could tell:
+// formatting must leave the rest of the file unchanged.
+func formatEdit(src []byte, offset, end int, text string) (string, bool) {
+	buf := append(append(slices.Clip(src[:offset]), text...), src[end:]...)
+	out, err := format.Source(buf)
+	tail := len(src) - end
+	if err != nil || len(out) < offset+tail || !bytes.Equal(out[:offset], src[:offset]) || !bytes.Equal(out[len(out)-tail:], src[end:]) {
+		return "", false
+	}
+	return string(out[offset : len(out)-tail]), true
+}
+
+func _testdata() {
+	// By default, shell commands should not run.
+	// This is necessary for security.
+	//
+	// % FAIL
+
+	{
+		// Even within a block where commands are later allowed,
+		// we don't allow them before the directive.
+		// This is simpler to implement, and also encourages
+		// keeping the directives near the top.
+		//
+		// % FAIL
+
+		//gosh:ok
+
+		// Within a block marked with "gosh:ok",
+		// shell commands are allowed.
+		//
+		// % echo ok
+
+		{
+			// This includes nested blocks too.
+			//
+			// % echo ok
+		}
+
+		// And multiline comments.
+		//
+		/* % echo ok
+		really, it's fine
+		  foo
+		bar
+		*/
+	}
+
+	// But back to the outer scope,
+	// it should be denied again.
+	//
+	// % FAIL
+}
+
+// funcDocs returns the offsets of the "gosh:ok", "gosh:allow",
+// and "gosh:deny" directives in the doc comments of src's functions,
+// mapped to the offsets of the braces that start the functions' bodies.
+// If src doesn't parse, it returns what it can.
+func funcDocs(src []byte) map[int]int {
+	fset := token.NewFileSet()
+	f, _ := parser.ParseFile(fset, "", src, parser.ParseComments|parser.SkipObjectResolution)
+	if f == nil {
+		return nil
+	}
+	docs := make(map[int]int)
+	for _, decl := range f.Decls {
+		fn, ok := decl.(*ast.FuncDecl)
+		if !ok || fn.Doc == nil || fn.Body == nil {
+			continue
+		}
+		for _, c := range fn.Doc.List {
+			text, ok := strings.CutPrefix(c.Text, "//gosh:")
+			if !ok {
+				continue
+			}
+			switch name, _ := cutDirective(text); name {
+			case "ok", "allow", "deny":
+				docs[fset.Position(c.Pos()).Offset] = fset.Position(fn.Body.Lbrace).Offset
+			}
+		}
+	}
+	return docs
+}
+
+// constDecl reports whether src declares the string constant name
+// right after offset, like "const name = `...`",
+// and returns the offset of the end of the declaration.
+func constDecl(src []byte, offset int, name string) (int, bool) {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", -1, len(src)-offset)
+	var s scanner.Scanner
+	s.Init(file, src[offset:], nil, 0)
+	var end int
+	for _, tok := range []token.Token{token.CONST, token.IDENT, token.ASSIGN, token.STRING} {
+		pos, t, lit := s.Scan()
+		if t != tok || tok == token.IDENT && lit != name {
+			return 0, false
+		}
+		end = offset + file.Offset(pos) + len(lit)
+	}
+	return end, true
+}
+
+// stringLit returns a Go string literal for output,
+// as a raw string literal if possible.
+func stringLit(output []byte) string {
+	s := string(output)
+	if strings.ContainsAny(s, "`\r") || !utf8.ValidString(s) {
+		return strconv.Quote(s)
+	}
+	return "`" + s + "`"
+}
+
+// codeMarker marks the end of the code generated by a "gosh:code" command.
+const codeMarker = "// End of gosh:code output.\n"
+
+// generatedCode returns the offset of the end of the code generated
+// by the "gosh:code" command whose comment ends at offset,
+// or -1 if there isn't any.
+func generatedCode(src []byte, offset int) int {
+	rest := src[offset:]
+	if !bytes.HasPrefix(rest, []byte("\n")) {
+		return -1
+	}
+	i := bytes.Index(rest, []byte("\n"+codeMarker))
+	if i < 0 {
+		return -1
+	}
+	return offset + i + len("\n"+codeMarker)
+}
+
+// formatCode returns output, the output of a "gosh:code" command,
+// formatted as Go declarations or statements, without any package clause.
+func formatCode(output []byte) ([]byte, error) {
+	if f, err := parser.ParseFile(token.NewFileSet(), "", output, parser.PackageClauseOnly); err == nil {
+		// Skip the package clause and any comments before it.
+		output = output[int(f.Name.End())-1:]
+	}
+	code, err := format.Source(output)
+	if err != nil {
+		return nil, fmt.Errorf("output isn't Go code: %v", err)
+	}
+	code = bytes.TrimLeft(code, "\n")
+	if len(code) > 0 && code[len(code)-1] != '\n' {
+		code = append(code, '\n')
+	}
+	return code, nil
+}
+
+// funcDecl returns the offset of the end of the declaration of the
+// function name without parameters, like an Example function,
+// if src declares it right after offset, or -1 if it doesn't.
+func funcDecl(src []byte, offset int, name string) int {
+	fset := token.NewFileSet()
+	file := fset.AddFile("", -1, len(src)-offset)
+	var s scanner.Scanner
+	s.Init(file, src[offset:], nil, 0)
+	for _, tok := range []token.Token{token.FUNC, token.IDENT, token.LPAREN, token.RPAREN, token.LBRACE} {
+		if _, t, lit := s.Scan(); t != tok || tok == token.IDENT && lit != name {
+			return -1
+		}
+	}
+	for depth := 1; ; {
+		pos, tok, _ := s.Scan()
+		switch tok {
+		case token.EOF:
+			return -1
+		case token.LBRACE:
+			depth++
+		case token.RBRACE:
+			if depth--; depth == 0 {
+				return offset + file.Offset(pos) + 1
+			}
+		}
+	}
+}
+
+// blockCommands splits text, the rest of a block comment after its
+// first "% " or "# ", into commands: the first line, and each later line
+// that starts with "% ", after any indentation, along with their
+// continuation lines. If the commands haven't run, as reported by ran,
+// the comment holds nothing but commands, so the first other line
+// ends them. Otherwise, only a transcript, as reported by transcript,
+// has more than one, interleaved with their output, which commentOutput
+// keeps from having lines like commands.
+// It returns the commands, and the offsets where each starts in the source,
+// where text starts at offset.
+func blockCommands(text string, offset int, ran, transcript bool) (prompts []string, starts []int) {
+	lines := strings.SplitAfter(text, "\n")
+	for i := 0; i < len(lines); i++ {
+		start := offset
+		offset += len(lines[i])
+		line := lines[i]
+		if i > 0 {
+			// The last line ends the comment.
+			if i == len(lines)-1 || ran && !transcript {
+				break
+			}
+			rest, ok := strings.CutPrefix(strings.TrimLeft(line, " \t"), "% ")
+			if !ok && !ran {
+				break
+			}
+			if !ok {
+				continue
+			}
+			line = rest
+		}
+		prompt := strings.TrimSpace(line)
+		for continues(prompt) && i+1 < len(lines)-1 {
+			i++
+			offset += len(lines[i])
+			prompt += "\n" + strings.TrimSpace(lines[i])
+		}
+		prompts = append(prompts, prompt)
+		starts = append(starts, start)
+	}
+	return prompts, starts
+}
+
+// commentOutput checks that output, which goes in a transcript
+// after its command, has no lines that would be taken for commands
+// when the comment is processed again, as by blockCommands.
+func commentOutput(output []byte) ([]byte, error) {
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		if bytes.HasPrefix(bytes.TrimLeft(line, " \t"), []byte("% ")) {
+			return nil, fmt.Errorf("output line %q would be taken for a command", bytes.TrimSpace(line))
+		}
+	}
+	return output, nil
+}
+
+// nextLineComment reports whether a line comment follows the newline
+// at offset in src, on a line by itself, and if so returns its text,
+// after the "//", and the offset where it ends.
+func nextLineComment(src []byte, offset int) (string, int, bool) {
+	rest, ok := bytes.CutPrefix(src[offset:], []byte("\n"))
+	if !ok {
+		return "", 0, false
+	}
+	text := bytes.TrimLeft(rest, " \t")
+	text, ok = bytes.CutPrefix(text, []byte("//"))
+	if !ok {
+		return "", 0, false
+	}
+	line, _, _ := bytes.Cut(text, []byte("\n"))
+	end := len(src) - len(text) + len(line)
+	return strings.TrimSpace(string(line)), end, true
+}
+
+// exampleFunc returns an Example function that runs c,
+// and whose expected output is the command's output.
+func exampleFunc(c *Command, output []byte) string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "func %s() {\n", c.Example)
+	fmt.Fprintf(&buf, "\tcmd := exec.Command(%q, \"-c\", %q)\n", c.shell(), c.Prompt)
+	buf.WriteString("\tcmd.Stdout = os.Stdout\n")
+	if c.Stderr {
+		buf.WriteString("\tcmd.Stderr = os.Stdout\n")
+	} else {
+		buf.WriteString("\tcmd.Stderr = os.Stderr\n")
+	}
+	buf.WriteString("\tif err := cmd.Run(); err != nil {\n\t\tpanic(err)\n\t}\n")
+	buf.WriteString("\t// Output:\n")
+	for _, line := range strings.Split(strings.TrimSuffix(string(output), "\n"), "\n") {
+		buf.WriteString(strings.TrimRight("\t// "+line, " \t") + "\n")
+	}
+	buf.WriteString("}")
+	return buf.String()
+}
+
+// addImports returns the Go source src with imports of paths added,
+// if it doesn't already import them.
+func addImports(src []byte, paths ...string) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	added := false
+	for _, path := range paths {
+		if astutil.AddImport(fset, f, path) {
+			added = true
+		}
+	}
+	if !added {
+		return src, nil
+	}
+	var buf bytes.Buffer
+	if err := format.Node(&buf, fset, f); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
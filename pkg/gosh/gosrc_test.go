@@ -0,0 +1,515 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"go/token"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBlockCommands(t *testing.T) {
+	tests := []struct {
+		text            string
+		ran, transcript bool
+		prompts         []string
+		starts          []int
+	}{
+		{"echo a\n*/", false, false, []string{"echo a"}, []int{0}},
+		{"echo a\n% echo b\n*/", false, false, []string{"echo a", "echo b"}, []int{0, 7}},
+		{"echo a\n  % echo b\n*/", false, false, []string{"echo a", "echo b"}, []int{0, 7}},
+		{"echo a \\\n  b\n% echo c\n*/", false, false, []string{"echo a \\\nb", "echo c"}, []int{0, 13}},
+		// Before the commands run, the first other line ends them.
+		{"echo a\nnot a command\n% echo b\n*/", false, false, []string{"echo a"}, []int{0}},
+		// After, their output is between them.
+		{"echo a\na\n% echo b\nb\n*/", true, true, []string{"echo a", "echo b"}, []int{0, 9}},
+		{"echo a\na\n\t% echo b\nb\n*/", true, true, []string{"echo a", "echo b"}, []int{0, 9}},
+		{"echo a\n%not a command\n*/", true, true, []string{"echo a"}, []int{0}},
+		// Other comments that ran hold one command, whatever its output.
+		{"echo a\na\n% echo b\nb\n*/", true, false, []string{"echo a"}, []int{0}},
+		{"echo a \\\n  b\n% echo c\n*/", true, false, []string{"echo a \\\nb"}, []int{0}},
+		{"echo a\n% echo b\n*/", false, true, []string{"echo a", "echo b"}, []int{0, 7}},
+		// The last line ends the comment, even if it continues the command.
+		{"echo a \\\n*/", false, false, []string{"echo a \\"}, []int{0}},
+	}
+	for _, tt := range tests {
+		const offset = 100
+		prompts, starts := blockCommands(tt.text, offset, tt.ran, tt.transcript)
+		for i := range starts {
+			starts[i] -= offset
+		}
+		if !reflect.DeepEqual(prompts, tt.prompts) || !reflect.DeepEqual(starts, tt.starts) {
+			t.Errorf("blockCommands(%q, %v, %v) = %q, %v, want %q, %v", tt.text, tt.ran, tt.transcript, prompts, starts, tt.prompts, tt.starts)
+		}
+	}
+}
+
+func TestCommentOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		ok     bool
+	}{
+		{"", true},
+		{"hello\nworld\n", true},
+		{"100% done\n", true},
+		{"%d\n", true},
+		{"% rm -rf /\n", false},
+		{"ok\n  % echo injected\n", false},
+		{"ok\n\t% echo injected", false},
+	}
+	for _, tt := range tests {
+		out, err := commentOutput([]byte(tt.output))
+		if (err == nil) != tt.ok {
+			t.Errorf("commentOutput(%q): error %v, want ok %v", tt.output, err, tt.ok)
+		}
+		if err == nil && string(out) != tt.output {
+			t.Errorf("commentOutput(%q) = %q, want it unchanged", tt.output, out)
+		}
+	}
+}
+
+// echoRun is an Options.Run that "runs" commands like "echo text"
+// without a shell, returning the text, unquoted, as their output.
+func echoRun(ctx context.Context, c *Command) ([]byte, error) {
+	text, _ := strings.CutPrefix(c.Prompt, "echo ")
+	words, _ := shellWords(text)
+	return []byte(strings.Join(words, " ") + "\n"), nil
+}
+
+func TestProcessGoBlock(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		refresh bool
+		output  string // if set, every command's output
+		want    string // the output, or an error it contains
+	}{
+		{
+			name: "one",
+			src:  "package p\n\n//gosh:ok\n\n/* % echo a\n*/\n",
+			want: "package p\n\n//gosh:ok\n\n/* # echo a\na\n*/\n",
+		},
+		{
+			name: "several",
+			src:  "package p\n\n//gosh:ok\n\n/* % echo a\n% echo b\n*/\n",
+			want: "package p\n\n//gosh:ok\n\n/*\n# echo a\na\n% echo b\nb\n*/\n",
+		},
+		{
+			name:    "rerun",
+			src:     "package p\n\n//gosh:ok\n\n/*\n# echo a\nold\n% echo b\nold\n*/\n",
+			refresh: true,
+			want:    "package p\n\n//gosh:ok\n\n/*\n# echo a\na\n% echo b\nb\n*/\n",
+		},
+		{
+			name: "transcript of one",
+			src:  "package p\n\n//gosh:ok\n\n/*\n% echo a\n*/\n",
+			want: "package p\n\n//gosh:ok\n\n/*\n# echo a\na\n*/\n",
+		},
+		{
+			name:    "rerun one",
+			src:     "package p\n\n//gosh:ok\n\n/* # echo a\nold\n% echo b\nold\n*/\n",
+			refresh: true,
+			want:    "package p\n\n//gosh:ok\n\n/* # echo a\na\n*/\n",
+		},
+		{
+			name:    "output like a command",
+			src:     "package p\n\n//gosh:ok\n\n/* # echo a\n*/\n",
+			refresh: true,
+			output:  "a\n% rm -rf /\n",
+			want:    "package p\n\n//gosh:ok\n\n/* # echo a\na\n% rm -rf /\n*/\n",
+		},
+		{
+			name:   "injected",
+			src:    "package p\n\n//gosh:ok\n\n/* % echo a\n% echo b\n*/\n",
+			output: "a\n% rm -rf /\n",
+			want:   "would be taken for a command",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			run := echoRun
+			if tt.output != "" {
+				run = func(ctx context.Context, c *Command) ([]byte, error) {
+					return []byte(tt.output), nil
+				}
+			}
+			out, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename: "p.go",
+				Refresh:  tt.refresh,
+				Run:      run,
+			})
+			if err == nil {
+				for _, r := range results {
+					if r.Err != nil {
+						err = r.Err
+						break
+					}
+				}
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), tt.want) {
+					t.Fatalf("Process: %v", err)
+				}
+				return
+			}
+			if !strings.HasPrefix(tt.want, "package") {
+				t.Fatalf("Process succeeded, want error %q", tt.want)
+			}
+			if string(out) != tt.want {
+				t.Fatalf("Process:\n%s\nwant:\n%s", out, tt.want)
+			}
+			// Running the commands again leaves the output as it is.
+			again, err := runGo("p.go", string(out), tt.output)
+			if err != nil {
+				t.Fatalf("processing again: %v", err)
+			}
+			if again != string(out) {
+				t.Errorf("processing again:\n%s\nwant it unchanged:\n%s", again, out)
+			}
+		})
+	}
+}
+
+// runGo processes src, the Go file filename, with refresh set,
+// where every command's output is output, or, if it's empty,
+// as given by echoRun. It returns the new source,
+// or the first error, as from a command.
+func runGo(filename, src, output string) (string, error) {
+	run := echoRun
+	if output != "" {
+		run = func(ctx context.Context, c *Command) ([]byte, error) {
+			return []byte(output), nil
+		}
+	}
+	out, results, err := Process(context.Background(), []byte(src), Options{
+		Filename: filename,
+		Refresh:  true,
+		Run:      run,
+	})
+	for _, r := range results {
+		if r.Err != nil && err == nil {
+			err = r.Err
+		}
+	}
+	return string(out), err
+}
+
+func TestProcessConst(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+		want   string // the output, or an error it contains
+	}{
+		{
+			name: "add",
+			src:  "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* % echo hi\n*/\n",
+			want: "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* # echo hi\n */\nconst usage = `hi\n`\n",
+		},
+		{
+			name: "replace",
+			src:  "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* # echo hi\n*/\nconst usage = \"old\"\n\nvar x = 1\n",
+			want: "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* # echo hi\n */\nconst usage = `hi\n`\n\nvar x = 1\n",
+		},
+		{
+			name: "keep other declaration",
+			src:  "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* # echo hi\n*/\nconst other = \"x\"\n",
+			want: "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* # echo hi\n */\nconst usage = `hi\n`\nconst other = \"x\"\n",
+		},
+		{
+			name:   "backquote",
+			src:    "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* % show\n*/\n",
+			output: "a`b\n",
+			want:   "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* # show\n */\nconst usage = \"a`b\\n\"\n",
+		},
+		{
+			name:   "output like a command",
+			src:    "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* % show\n*/\n",
+			output: "% not run\n",
+			want:   "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* # show\n */\nconst usage = `% not run\n`\n",
+		},
+		{
+			name: "trailer",
+			src:  "package p\n\n//gosh:ok\n\n//gosh:trailer\n//gosh:const usage\n/* % echo hi\n*/\n",
+			want: "package p\n\n//gosh:ok\n\n//gosh:trailer\n//gosh:const usage\n/* # echo hi\n */\nconst usage = `hi\n`\n",
+		},
+		{
+			name: "invalid name",
+			src:  "package p\n\n//gosh:ok\n\n//gosh:const 1x\n/* % echo hi\n*/\n",
+			want: `invalid constant name "1x"`,
+		},
+		{
+			name: "several commands",
+			src:  "package p\n\n//gosh:ok\n\n//gosh:const usage\n/* % echo a\n% echo b\n*/\n",
+			want: "don't support several commands",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testProcessGo(t, "p.go", tt.src, tt.output, tt.want)
+		})
+	}
+}
+
+// testProcessGo checks that processing src, as by runGo,
+// gives want, or an error containing it, and that processing
+// the result again leaves it unchanged.
+func testProcessGo(t *testing.T, filename, src, output, want string) {
+	t.Helper()
+	out, err := runGo(filename, src, output)
+	if err != nil {
+		if !strings.Contains(err.Error(), want) {
+			t.Fatalf("Process: %v", err)
+		}
+		return
+	}
+	if out != want {
+		t.Fatalf("Process:\n%s\nwant:\n%s", out, want)
+	}
+	again, err := runGo(filename, out, output)
+	if err != nil {
+		t.Fatalf("processing again: %v", err)
+	}
+	if again != out {
+		t.Errorf("processing again:\n%s\nwant it unchanged:\n%s", again, out)
+	}
+}
+
+func TestProcessCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+		want   string // the output, or an error it contains
+	}{
+		{
+			name:   "add",
+			src:    "package p\n\n//gosh:ok\n\n//gosh:code\n/* % gen\n*/\n",
+			output: "func  F() int { return 1 }\n",
+			want:   "package p\n\n//gosh:ok\n\n//gosh:code\n/* # gen\n */\nfunc F() int { return 1 }\n\n// End of gosh:code output.\n",
+		},
+		{
+			name:   "package clause",
+			src:    "package p\n\n//gosh:ok\n\n//gosh:code\n/* % gen\n*/\n",
+			output: "// Code generated by gen. DO NOT EDIT.\n\npackage q\n\nconst N = 1\n",
+			want:   "package p\n\n//gosh:ok\n\n//gosh:code\n/* # gen\n */\nconst N = 1\n\n// End of gosh:code output.\n",
+		},
+		{
+			name:   "replace",
+			src:    "package p\n\n//gosh:ok\n\n//gosh:code\n/* # gen\n*/\nfunc F() int { return 0 }\n\n// End of gosh:code output.\n\nvar x = 1\n",
+			output: "func F() int { return 2 }\n",
+			want:   "package p\n\n//gosh:ok\n\n//gosh:code\n/* # gen\n */\nfunc F() int { return 2 }\n\n// End of gosh:code output.\n\nvar x = 1\n",
+		},
+		{
+			name:   "no marker",
+			src:    "package p\n\n//gosh:ok\n\n//gosh:code\n/* # gen\n*/\n\nvar x = 1\n",
+			output: "const N = 1\n",
+			want:   "package p\n\n//gosh:ok\n\n//gosh:code\n/* # gen\n */\nconst N = 1\n\n// End of gosh:code output.\n\nvar x = 1\n",
+		},
+		{
+			name:   "trailer",
+			src:    "package p\n\n//gosh:ok\n\n//gosh:trailer\n//gosh:code\n/* % gen\n*/\n",
+			output: "const N = 1\n",
+			want:   "package p\n\n//gosh:ok\n\n//gosh:trailer\n//gosh:code\n/* # gen\n */\nconst N = 1\n\n// End of gosh:code output.\n",
+		},
+		{
+			name:   "not Go",
+			src:    "package p\n\n//gosh:ok\n\n//gosh:code\n/* % gen\n*/\n",
+			output: "not go {\n",
+			want:   "output isn't Go code",
+		},
+		{
+			name:   "not a Go file",
+			src:    "#gosh:ok\n# gosh:code\n# % gen\n",
+			output: "const N = 1\n",
+			want:   "gosh:code is only supported in Go files",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := "p.go"
+			if !strings.HasPrefix(tt.src, "package") {
+				filename = "run.sh"
+			}
+			testProcessGo(t, filename, tt.src, tt.output, tt.want)
+		})
+	}
+}
+
+func TestProcessExample(t *testing.T) {
+	const example = "func Example_usage() {\n" +
+		"\tcmd := exec.Command(\"sh\", \"-c\", \"echo hi\")\n" +
+		"\tcmd.Stdout = os.Stdout\n" +
+		"\tcmd.Stderr = os.Stderr\n" +
+		"\tif err := cmd.Run(); err != nil {\n\t\tpanic(err)\n\t}\n" +
+		"\t// Output:\n"
+	tests := []struct {
+		name     string
+		filename string
+		src      string
+		output   string
+		want     string // the output, or an error it contains
+	}{
+		{
+			name:     "add",
+			filename: "p_test.go",
+			src:      "package p\n\n//gosh:ok\n\n//gosh:example usage\n/* % echo hi\n*/\n",
+			want:     "package p\n\nimport (\n\t\"os\"\n\t\"os/exec\"\n)\n\n//gosh:ok\n\n//gosh:example usage\n/* # echo hi\n */\n" + example + "\t// hi\n}\n",
+		},
+		{
+			name:     "replace",
+			filename: "p_test.go",
+			src:      "package p\n\nimport \"os\"\n\n//gosh:ok\n\n//gosh:example usage\n/* # echo hi\n*/\nfunc Example_usage() {\n\tif true {\n\t}\n}\n\nvar _ = os.Args\n",
+			output:   "a\n\nb  \n",
+			want:     "package p\n\nimport (\n\t\"os\"\n\t\"os/exec\"\n)\n\n//gosh:ok\n\n//gosh:example usage\n/* # echo hi\n */\n" + example + "\t// a\n\t//\n\t// b\n}\n\nvar _ = os.Args\n",
+		},
+		{
+			name:     "exported",
+			filename: "p_test.go",
+			src:      "package p\n\n//gosh:ok\n\n//gosh:example Parse\n/* % echo hi\n*/\n",
+			want:     "package p\n\nimport (\n\t\"os\"\n\t\"os/exec\"\n)\n\n//gosh:ok\n\n//gosh:example Parse\n/* # echo hi\n */\n" + strings.Replace(example, "Example_usage", "ExampleParse", 1) + "\t// hi\n}\n",
+		},
+		{
+			name:     "trailer",
+			filename: "p_test.go",
+			src:      "package p\n\n//gosh:ok\n\n//gosh:trailer\n//gosh:example usage\n/* % echo hi\n*/\n",
+			want:     "package p\n\nimport (\n\t\"os\"\n\t\"os/exec\"\n)\n\n//gosh:ok\n\n//gosh:trailer\n//gosh:example usage\n/* # echo hi\n */\n" + example + "\t// hi\n}\n",
+		},
+		{
+			name:     "exit status",
+			filename: "p_test.go",
+			src:      "package p\n\n//gosh:ok\n\n//gosh:example usage\n/* %! false\n*/\n",
+			want:     "gosh:example doesn't support %! commands",
+		},
+		{
+			name:     "best effort",
+			filename: "p_test.go",
+			src:      "package p\n\n//gosh:ok\n\n//gosh:example usage\n/* %? echo hi\n*/\n",
+			want:     "gosh:example doesn't support %? commands",
+		},
+		{
+			name:     "not a test file",
+			filename: "p.go",
+			src:      "package p\n\n//gosh:ok\n\n//gosh:example usage\n/* % echo hi\n*/\n",
+			want:     "gosh:example is only supported in Go test files",
+		},
+		{
+			name:     "invalid name",
+			filename: "p_test.go",
+			src:      "package p\n\n//gosh:ok\n\n//gosh:example a-b\n/* % echo hi\n*/\n",
+			want:     `invalid example name "a-b"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testProcessGo(t, tt.filename, tt.src, tt.output, tt.want)
+		})
+	}
+}
+
+func TestOkNextScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		src      string
+		ran      []string
+		warnings []string // substrings of the warnings, in order
+	}{
+		{
+			name: "same scope",
+			src:  "package p\n\nfunc f() {\n\t//gosh:ok-next\n\t// % echo a\n}\n",
+			ran:  []string{"echo a"},
+		},
+		{
+			name: "nested",
+			src:  "package p\n\n//gosh:ok-next\n\nfunc f() {\n\t// % echo a\n}\n\n// % echo b\n",
+			ran:  []string{"echo a"},
+			warnings: []string{
+				`command "echo b" not run`,
+			},
+		},
+		{
+			name: "leaked",
+			src:  "package p\n\nfunc f() {\n\t//gosh:ok-next\n}\n\n// % echo leaked\n",
+			warnings: []string{
+				"unused gosh:ok-next",
+				`command "echo leaked" not run`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ran, warnings []string
+			_, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename: "p.go",
+				Run: func(ctx context.Context, c *Command) ([]byte, error) {
+					ran = append(ran, c.Prompt)
+					return echoRun(ctx, c)
+				},
+				Warn: func(pos token.Position, msg string) {
+					warnings = append(warnings, msg)
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Err != nil {
+					t.Fatal(r.Err)
+				}
+			}
+			if !reflect.DeepEqual(ran, tt.ran) {
+				t.Errorf("ran %q, want %q", ran, tt.ran)
+			}
+			if len(warnings) != len(tt.warnings) {
+				t.Fatalf("warnings = %q, want %q", warnings, tt.warnings)
+			}
+			for i, w := range warnings {
+				if !strings.Contains(w, tt.warnings[i]) {
+					t.Errorf("warning %q, want %q", w, tt.warnings[i])
+				}
+			}
+		})
+	}
+}
+
+func TestResultFormatted(t *testing.T) {
+	const fresh = "package p\n\n//gosh:ok\n\nfunc f() {\n\t/* # echo a b\n\ta b\n\t*/\n}\n"
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"fresh", fresh},
+		{"stale", strings.Replace(fresh, "\ta b\n", "\told\n", 1)},
+		{"new", "package p\n\n//gosh:ok\n\nfunc f() {\n\t// % echo a b\n}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename: "p.go",
+				Refresh:  true,
+				Run:      echoRun,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != fresh {
+				t.Fatalf("Process:\n%s\nwant:\n%s", out, fresh)
+			}
+			if len(results) != 1 {
+				t.Fatalf("got %d results, want 1", len(results))
+			}
+			// Splicing in the replacement gives the formatted file.
+			r := results[0]
+			if got := tt.src[:r.Offset] + r.New + tt.src[r.End:]; got != fresh {
+				t.Errorf("with New spliced in:\n%s\nwant:\n%s", got, fresh)
+			}
+			if (r.New == r.Old) != (tt.src == fresh) {
+				t.Errorf("New == Old is %v, want %v", r.New == r.Old, tt.src == fresh)
+			}
+		})
+	}
+}
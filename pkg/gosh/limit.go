@@ -0,0 +1,84 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParseSize parses a memory size, like "512M" or "2G",
+// with an optional K, M, G, or T suffix for powers of 1024,
+// and returns it in bytes.
+func ParseSize(s string) (int64, error) {
+	num, shift := s, 0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K', 'k':
+			num, shift = s[:n-1], 10
+		case 'M', 'm':
+			num, shift = s[:n-1], 20
+		case 'G', 'g':
+			num, shift = s[:n-1], 30
+		case 'T', 't':
+			num, shift = s[:n-1], 40
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > 1<<(63-shift)-1 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// parseLimits parses the argument of a "gosh:limit" directive,
+// a comma-separated list like "cpu=10s,mem=512M",
+// and sets the corresponding limits of c.
+func parseLimits(c *Command, arg string) error {
+	for _, kv := range strings.Split(arg, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		switch key {
+		case "cpu":
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return fmt.Errorf("invalid CPU limit %q", value)
+			}
+			c.CPULimit = d
+		case "mem":
+			n, err := ParseSize(value)
+			if err != nil {
+				return err
+			}
+			c.MemLimit = n
+		case "output":
+			n, err := ParseSize(value)
+			if err != nil {
+				return err
+			}
+			c.OutputLimit = n
+		default:
+			return fmt.Errorf("unknown limit %q", key)
+		}
+	}
+	return nil
+}
+
+// limitScript returns shell commands that apply c's resource limits
+// to the shell running it, and so to every process it starts,
+// or "" if c has no limits.
+func (c *Command) limitScript() string {
+	// Some shells, like dash, set only one limit per ulimit command.
+	var script strings.Builder
+	if c.CPULimit > 0 {
+		secs := (c.CPULimit + time.Second - 1) / time.Second
+		fmt.Fprintf(&script, "ulimit -t %d || exit\n", secs)
+	}
+	if c.MemLimit > 0 {
+		fmt.Fprintf(&script, "ulimit -v %d || exit\n", (c.MemLimit+1023)/1024)
+	}
+	return script.String()
+}
@@ -0,0 +1,159 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// commentLeaders maps language names and file names or extensions
+// to the line comment leader used by that language.
+var commentLeaders = map[string]string{
+	"make":   "#",
+	"sh":     "#",
+	"bash":   "#",
+	"yaml":   "#",
+	"toml":   "#",
+	"python": "#",
+	"proto":  "//",
+
+	".mk":    "#",
+	".sh":    "#",
+	".bash":  "#",
+	".yaml":  "#",
+	".yml":   "#",
+	".toml":  "#",
+	".py":    "#",
+	".proto": "//",
+
+	"Makefile":    "#",
+	"GNUmakefile": "#",
+	"Dockerfile":  "#",
+}
+
+// CommentLeader returns the line comment leader to use for filename,
+// or "" if it's not a supported kind of file.
+// If lang is non-empty, it overrides the choice based on filename;
+// it's either a language name like "sh", or the comment leader itself.
+func CommentLeader(filename, lang string) string {
+	if lang != "" {
+		if leader, ok := commentLeaders[lang]; ok {
+			return leader
+		}
+		return lang
+	}
+	name := filepath.Base(filename)
+	if leader, ok := commentLeaders[name]; ok {
+		return leader
+	}
+	return commentLeaders[filepath.Ext(name)]
+}
+
+// processLines processes a file whose line comments start with leader.
+//
+// Commands are comment lines like "# % date".
+// Each is replaced by "# # date", followed by a comment line like
+// "# | output" for each line of output. With opts.Refresh, the previous
+// output is the contiguous run of such lines following the command,
+// so that other comments, commands, and directives after it are kept,
+// and output can never be taken for a command.
+// Commands written with "%!", like "# %! false", record their exit status,
+// and those written with "%?" only warn if they fail.
+// A command line ending in a backslash continues on the next comment line.
+//
+// Directives are comment lines like "#gosh:ok" or "# gosh:ok".
+// Because there are no nested scopes, they apply to the end of the file.
+func processLines(ctx context.Context, src []byte, opts *Options, leader string) ([]byte, []Result, error) {
+	file := newFile(opts.Filename, src)
+	lines := strings.SplitAfter(string(src), "\n")
+	offsets := lineOffsets(lines)
+
+	st := newState(opts)
+	var jobs []*job
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		comment, ok := strings.CutPrefix(strings.TrimSpace(line), leader)
+		if !ok {
+			continue
+		}
+
+		if text, ok := strings.CutPrefix(strings.TrimLeft(comment, " "), "gosh:"); ok {
+			if err := st.directive(text, position(file, offsets[i])); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		start, end := i, i+1
+		text, ok := strings.CutPrefix(comment, " ")
+		if !ok {
+			continue
+		}
+		prompt, variant, ok := cutPrompt(text, "%")
+		ran := false // whether the command ran before
+		if !ok && opts.Refresh {
+			prompt, variant, ok = cutPrompt(text, "#")
+			ran = true
+		}
+		if !ok {
+			continue
+		}
+		for ; continues(prompt) && end < len(lines); end++ {
+			line, ok := strings.CutPrefix(strings.TrimSpace(lines[end]), leader)
+			if !ok {
+				break
+			}
+			prompt += "\n" + strings.TrimSpace(line)
+		}
+		for ran && end < len(lines) && isOutputLine(lines[end], leader) {
+			end++
+		}
+		prompt = strings.TrimSpace(prompt)
+		i = end - 1
+
+		cmd, ok := st.command(prompt, position(file, offsets[start]), position(file, offsets[end]))
+		if !ok || ran && cmd.Frozen {
+			continue
+		}
+		cmd.setVariant(variant)
+		mark := "#" + variant
+		jobs = append(jobs, &job{
+			cmd:   cmd,
+			start: offsets[start],
+			end:   offsets[end],
+			render: func(output []byte) string {
+				var buf strings.Builder
+				for k, line := range strings.Split(prompt, "\n") {
+					if k == 0 {
+						fmt.Fprintf(&buf, "%s%s %s %s\n", indent, leader, mark, line)
+					} else {
+						fmt.Fprintf(&buf, "%s%s %s\n", indent, leader, line)
+					}
+				}
+				for _, out := range strings.SplitAfter(string(output), "\n") {
+					if out != "" {
+						out = strings.TrimRight(leader+" | "+strings.TrimSuffix(out, "\n"), " ")
+						fmt.Fprintf(&buf, "%s%s\n", indent, out)
+					}
+				}
+				return buf.String()
+			},
+		})
+	}
+
+	st.finish()
+	return execute(ctx, src, jobs, opts)
+}
+
+// isOutputLine reports whether line is a line of command output,
+// like "# | output", in a file whose comments start with leader.
+func isOutputLine(line, leader string) bool {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(line), leader+" |")
+	return ok && (rest == "" || strings.HasPrefix(rest, " "))
+}
@@ -0,0 +1,109 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProcessLines(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		refresh bool
+		want    string
+	}{
+		{
+			name: "run",
+			src:  "#gosh:ok\n# % echo a\necho done\n",
+			want: "#gosh:ok\n# # echo a\n# | a\necho done\n",
+		},
+		{
+			name: "indented",
+			src:  "#gosh:ok\nf() {\n\t# % echo a\n}\n",
+			want: "#gosh:ok\nf() {\n\t# # echo a\n\t# | a\n}\n",
+		},
+		{
+			name: "continued",
+			src:  "#gosh:ok\n# % echo a \\\n#   b\n",
+			want: "#gosh:ok\n# # echo a \\\n# b\n# | a b\n",
+		},
+		{
+			name:    "refresh",
+			src:     "#gosh:ok\n# # echo a\n# | old\n# | older\necho done\n",
+			refresh: true,
+			want:    "#gosh:ok\n# # echo a\n# | a\necho done\n",
+		},
+		{
+			name:    "refresh continued",
+			src:     "#gosh:ok\n# # echo a \\\n# b\n# | old\n",
+			refresh: true,
+			want:    "#gosh:ok\n# # echo a \\\n# b\n# | a b\n",
+		},
+		{
+			name:    "refresh blank output line",
+			src:     "#gosh:ok\n# # echo a\n# | old\n# |\n# | old\n",
+			refresh: true,
+			want:    "#gosh:ok\n# # echo a\n# | a\n",
+		},
+		{
+			name:    "keep later command",
+			src:     "#gosh:ok\n# # echo a\n# | old\n# % echo b\n",
+			refresh: true,
+			want:    "#gosh:ok\n# # echo a\n# | a\n# # echo b\n# | b\n",
+		},
+		{
+			name:    "keep directive",
+			src:     "#gosh:ok\n# # echo a\n# | old\n# gosh:deny\n# % echo b\n",
+			refresh: true,
+			want:    "#gosh:ok\n# # echo a\n# | a\n# gosh:deny\n# % echo b\n",
+		},
+		{
+			name:    "keep comment",
+			src:     "#gosh:ok\n# # echo a\n# | old\n# A comment.\n#\n# More.\n",
+			refresh: true,
+			want:    "#gosh:ok\n# # echo a\n# | a\n# A comment.\n#\n# More.\n",
+		},
+		{
+			name: "not refreshed",
+			src:  "#gosh:ok\n# # echo a\n# | old\n",
+			want: "#gosh:ok\n# # echo a\n# | old\n",
+		},
+		{
+			name: "output like a command",
+			src:  "#gosh:ok\n# % echo '% rm -rf /'\n",
+			want: "#gosh:ok\n# # echo '% rm -rf /'\n# | % rm -rf /\n",
+		},
+		{
+			name: "not ok",
+			src:  "# % echo a\n",
+			want: "# % echo a\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename: "run.sh",
+				Refresh:  tt.refresh,
+				Run:      echoRun,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Err != nil {
+					t.Fatal(r.Err)
+				}
+			}
+			if out == nil {
+				out = []byte(tt.src)
+			}
+			if string(out) != tt.want {
+				t.Errorf("Process:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"go/token"
+	"strings"
+)
+
+// processMarkdown processes a Markdown file.
+//
+// Commands are fenced code blocks with the info string "console"
+// whose first line starts with "% ", or "%! " or "%? " for commands
+// that record their exit status or only warn if they fail.
+// The rest of the block is replaced with the command's output.
+// If the first line ends in a backslash, the command continues
+// on the next line. Unlike in Go source, the prompt is left unchanged,
+// so the command runs again every time. If the output has a run of
+// the fence's characters as long as the fence, the fence is lengthened,
+// so that the output can't close the block.
+//
+// Directives are HTML comments, like "<!-- gosh:ok -->".
+// Because Markdown has no nested scopes,
+// they apply to the end of the file.
+func processMarkdown(ctx context.Context, src []byte, opts *Options) ([]byte, []Result, error) {
+	file := newFile(opts.Filename, src)
+	lines := strings.SplitAfter(string(src), "\n")
+	offsets := lineOffsets(lines)
+
+	st := newState(opts)
+	var jobs []*job
+	for i := 0; i < len(lines); i++ {
+		if text, ok := markdownDirective(lines[i]); ok {
+			if err := st.directive(text, position(file, offsets[i])); err != nil {
+				return nil, nil, err
+			}
+			continue
+		}
+
+		fence, info, ok := openFence(lines[i])
+		if !ok {
+			continue
+		}
+		start := i + 1
+		end := start
+		for end < len(lines) && !closesFence(lines[end], fence) {
+			end++
+		}
+		i = end
+
+		if info != "console" || start == end {
+			continue
+		}
+		prompt, variant, ok := cutPrompt(lines[start], "%")
+		if !ok {
+			continue
+		}
+		prompt = strings.TrimSpace(prompt)
+		out := start + 1 // the first line of output
+		for ; continues(prompt) && out < end; out++ {
+			prompt += "\n" + strings.TrimSpace(lines[out])
+		}
+
+		cmd, ok := st.command(prompt, position(file, offsets[start]), position(file, offsets[end]))
+		if !ok || cmd.Frozen && out < end {
+			// A frozen command's output is already there.
+			continue
+		}
+		cmd.setVariant(variant)
+		// The job replaces the whole block, fences and all,
+		// in case the fence must be longer.
+		openLine, closeLine := lines[start-1], ""
+		jobEnd := offsets[end]
+		if end < len(lines) {
+			closeLine = lines[end]
+			jobEnd = offsets[end+1]
+		}
+		head := strings.Join(lines[start:out], "")
+		jobs = append(jobs, &job{
+			cmd:   cmd,
+			start: offsets[start-1],
+			end:   jobEnd,
+			render: func(output []byte) string {
+				text := string(output)
+				if text != "" && !strings.HasSuffix(text, "\n") {
+					text += "\n"
+				}
+				indent := openLine[:len(openLine)-len(strings.TrimLeft(openLine, " "))]
+				open, close := openLine, closeLine
+				if f := fenceFor(fence, text); f != fence || close == "" {
+					open = indent + f + openLine[len(indent)+len(fence):]
+					close = indent + f + "\n"
+					if closeLine != "" && !strings.HasSuffix(closeLine, "\n") {
+						close = strings.TrimSuffix(close, "\n")
+					}
+				}
+				return open + head + text + close
+			},
+		})
+	}
+
+	st.finish()
+	return execute(ctx, src, jobs, opts)
+}
+
+// markdownDirective reports whether line is a gosh directive
+// like "<!-- gosh:ok -->", and if so returns the text after "gosh:".
+func markdownDirective(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	inner, ok := strings.CutPrefix(line, "<!--")
+	if !ok {
+		return "", false
+	}
+	inner, ok = strings.CutSuffix(inner, "-->")
+	if !ok {
+		return "", false
+	}
+	return strings.CutPrefix(strings.TrimSpace(inner), "gosh:")
+}
+
+// openFence reports whether line opens a fenced code block,
+// and if so returns the fence and the block's info string.
+func openFence(line string) (fence, info string, ok bool) {
+	line = strings.TrimLeft(line, " ")
+	for _, c := range "`~" {
+		n := len(line) - len(strings.TrimLeft(line, string(c)))
+		if n >= 3 {
+			info, _, _ = strings.Cut(strings.TrimSpace(line[n:]), " ")
+			return line[:n], info, true
+		}
+	}
+	return "", "", false
+}
+
+// closesFence reports whether line closes a code block opened with fence.
+func closesFence(line, fence string) bool {
+	line = strings.TrimSpace(line)
+	return strings.HasPrefix(line, fence) && strings.Trim(line, fence[:1]) == ""
+}
+
+// fenceFor returns a fence of fence's character that's longer than
+// any run of that character in text, and at least as long as fence.
+func fenceFor(fence, text string) string {
+	c := fence[0]
+	n, run := len(fence), 0
+	for i := 0; i < len(text); i++ {
+		if text[i] != c {
+			run = 0
+			continue
+		}
+		if run++; run >= n {
+			n = run + 1
+		}
+	}
+	return strings.Repeat(fence[:1], n)
+}
+
+// newFile returns a token.File describing src, for reporting positions.
+func newFile(filename string, src []byte) *token.File {
+	file := token.NewFileSet().AddFile(filename, -1, len(src))
+	file.SetLinesForContent(src)
+	return file
+}
+
+// position returns the position of the byte offset in file.
+func position(file *token.File, offset int) token.Position {
+	return file.Position(file.Pos(offset))
+}
+
+// lineOffsets returns the byte offset of the start of each line,
+// followed by the offset of the end of the last line.
+func lineOffsets(lines []string) []int {
+	offsets := make([]int, len(lines)+1)
+	for i, line := range lines {
+		offsets[i+1] = offsets[i] + len(line)
+	}
+	return offsets
+}
@@ -0,0 +1,106 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"testing"
+)
+
+func TestFenceFor(t *testing.T) {
+	tests := []struct {
+		fence, text, want string
+	}{
+		{"```", "", "```"},
+		{"```", "hello\n", "```"},
+		{"```", "``\n", "```"},
+		{"```", "```\n", "````"},
+		{"```", "a ````` b\n", "``````"},
+		{"````", "```\n", "````"},
+		{"```", "~~~~\n", "```"},
+		{"~~~", "~~~\n", "~~~~"},
+	}
+	for _, tt := range tests {
+		if got := fenceFor(tt.fence, tt.text); got != tt.want {
+			t.Errorf("fenceFor(%q, %q) = %q, want %q", tt.fence, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestProcessMarkdown(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string // every command's output
+		want   string
+	}{
+		{
+			name:   "replace",
+			src:    "<!-- gosh:ok -->\n\n```console\n% echo hi\nold\n```\n\ntext\n",
+			output: "hi\n",
+			want:   "<!-- gosh:ok -->\n\n```console\n% echo hi\nhi\n```\n\ntext\n",
+		},
+		{
+			name:   "no trailing newline",
+			src:    "<!-- gosh:ok -->\n```console\n% echo hi\n```",
+			output: "hi",
+			want:   "<!-- gosh:ok -->\n```console\n% echo hi\nhi\n```",
+		},
+		{
+			name:   "lengthen fence",
+			src:    "<!-- gosh:ok -->\n```console\n% cat x.md\n```\n",
+			output: "```\ncode\n```\n",
+			want:   "<!-- gosh:ok -->\n````console\n% cat x.md\n```\ncode\n```\n````\n",
+		},
+		{
+			name:   "indented fence",
+			src:    "<!-- gosh:ok -->\n  ~~~ console\n% cat x\n  ~~~\n",
+			output: "~~~\n",
+			want:   "<!-- gosh:ok -->\n  ~~~~ console\n% cat x\n~~~\n  ~~~~\n",
+		},
+		{
+			name:   "unclosed",
+			src:    "<!-- gosh:ok -->\n```console\n% echo hi\n",
+			output: "hi\n",
+			want:   "<!-- gosh:ok -->\n```console\n% echo hi\nhi\n```\n",
+		},
+		{
+			name:   "other info",
+			src:    "<!-- gosh:ok -->\n```sh\n% echo hi\n```\n",
+			output: "hi\n",
+			want:   "<!-- gosh:ok -->\n```sh\n% echo hi\n```\n",
+		},
+		{
+			name:   "not ok",
+			src:    "```console\n% echo hi\n```\n",
+			output: "hi\n",
+			want:   "```console\n% echo hi\n```\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename: "README.md",
+				Run: func(ctx context.Context, c *Command) ([]byte, error) {
+					return []byte(tt.output), nil
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Err != nil {
+					t.Fatal(r.Err)
+				}
+			}
+			if out == nil {
+				out = []byte(tt.src)
+			}
+			if string(out) != tt.want {
+				t.Errorf("Process:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// capLines returns the first n lines of output, followed by a line
+// saying how many were left out, if output has more than n lines.
+func capLines(output []byte, n int) []byte {
+	rest := output
+	for i := 0; i < n; i++ {
+		_, after, ok := bytes.Cut(rest, []byte("\n"))
+		if !ok {
+			return output
+		}
+		rest = after
+	}
+	if len(rest) == 0 {
+		return output
+	}
+	more := bytes.Count(rest, []byte("\n"))
+	if !bytes.HasSuffix(rest, []byte("\n")) {
+		more++
+	}
+	kept := output[: len(output)-len(rest) : len(output)-len(rest)]
+	if more == 1 {
+		return append(kept, "... (1 more line)\n"...)
+	}
+	return fmt.Appendf(kept, "... (%d more lines)\n", more)
+}
+
+// wrapLines returns output with lines longer than width characters
+// broken into several lines, each but the last ending in a backslash
+// so that it's at most width characters long.
+func wrapLines(output []byte, width int) []byte {
+	var buf bytes.Buffer
+	for len(output) > 0 {
+		line, rest, _ := bytes.Cut(output, []byte("\n"))
+		for utf8.RuneCount(line) > width {
+			i := 0
+			for n := 0; n < width-1; n++ {
+				_, size := utf8.DecodeRune(line[i:])
+				i += size
+			}
+			buf.Write(line[:i])
+			buf.WriteString("\\\n")
+			line = line[i:]
+		}
+		buf.Write(line)
+		if len(rest) > 0 || bytes.HasSuffix(output, []byte("\n")) {
+			buf.WriteByte('\n')
+		}
+		output = rest
+	}
+	return buf.Bytes()
+}
+
+// trimOutput returns output with trailing white space removed from
+// each line, runs of blank lines collapsed into one, and exactly one
+// newline at the end, unless it's empty.
+func trimOutput(output []byte) []byte {
+	var buf bytes.Buffer
+	blank := false
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		line = bytes.TrimRight(line, " \t\r")
+		if len(line) == 0 {
+			blank = true
+			continue
+		}
+		if blank && buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		blank = false
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
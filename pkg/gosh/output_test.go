@@ -0,0 +1,84 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import "testing"
+
+func TestCapLines(t *testing.T) {
+	tests := []struct {
+		output string
+		n      int
+		want   string
+	}{
+		{"", 2, ""},
+		{"a\n", 2, "a\n"},
+		{"a\nb\n", 2, "a\nb\n"},
+		{"a\nb", 2, "a\nb"},
+		{"a\nb\nc\n", 2, "a\nb\n... (1 more line)\n"},
+		{"a\nb\nc", 2, "a\nb\n... (1 more line)\n"},
+		{"a\nb\nc\nd\n", 2, "a\nb\n... (2 more lines)\n"},
+		{"a\nb\nc\nd", 1, "a\n... (3 more lines)\n"},
+		{"\n\n\n", 1, "\n... (2 more lines)\n"},
+	}
+	for _, tt := range tests {
+		output := []byte(tt.output)
+		if got := capLines(output, tt.n); string(got) != tt.want {
+			t.Errorf("capLines(%q, %d) = %q, want %q", tt.output, tt.n, got, tt.want)
+		}
+		if string(output) != tt.output {
+			t.Errorf("capLines(%q, %d) changed its argument to %q", tt.output, tt.n, output)
+		}
+	}
+}
+
+func TestWrapLines(t *testing.T) {
+	tests := []struct {
+		output string
+		width  int
+		want   string
+	}{
+		{"", 4, ""},
+		{"abcd\n", 4, "abcd\n"},
+		{"abcde\n", 4, "abc\\\nde\n"},
+		{"abcde", 4, "abc\\\nde"},
+		{"abcdefghij\n", 4, "abc\\\ndef\\\nghij\n"},
+		{"ab\nabcdef\n\nab\n", 4, "ab\nabc\\\ndef\n\nab\n"},
+		// Widths count characters, not bytes,
+		// and lines are never broken within one.
+		{"héllo wörld\n", 6, "héllo\\\n wörld\n"},
+		{"日本語の文\n", 3, "日本\\\n語の文\n"},
+		{"ab\n", 2, "ab\n"},
+		{"abc\n", 2, "a\\\nbc\n"},
+	}
+	for _, tt := range tests {
+		if got := wrapLines([]byte(tt.output), tt.width); string(got) != tt.want {
+			t.Errorf("wrapLines(%q, %d) = %q, want %q", tt.output, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestTrimOutput(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"", ""},
+		{"\n", ""},
+		{" \t\r\n\n", ""},
+		{"a", "a\n"},
+		{"a\n", "a\n"},
+		{"a\n\n\n", "a\n"},
+		{"a  \nb\t\r\n", "a\nb\n"},
+		{"a\n\n\n\nb\n", "a\n\nb\n"},
+		{"a\n  \n\t\nb\n", "a\n\nb\n"},
+		{"\n\na\n", "a\n"},
+		{"  a\n", "  a\n"},
+	}
+	for _, tt := range tests {
+		if got := trimOutput([]byte(tt.output)); string(got) != tt.want {
+			t.Errorf("trimOutput(%q) = %q, want %q", tt.output, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A Policy restricts the commands that may run,
+// whatever directives enable them.
+//
+// A policy is read from a file, conventionally named .goshpolicy,
+// in which each line is a rule. Blank lines and lines starting
+// with "#" are ignored. The rules are:
+//
+//	deny regexp
+//		Forbid commands whose text matches the regular expression,
+//		like "deny rm\s+-(rf|fr)" or "deny curl.*\|\s*(ba)?sh".
+//	deny-writes-outside
+//		Forbid commands that redirect output to files outside
+//		the directory containing the policy file, or to files
+//		whose names can't be known before the command runs,
+//		and commands whose redirections can't be parsed.
+type Policy struct {
+	// Root is the directory that commands may write within,
+	// for the deny-writes-outside rule.
+	Root string
+
+	rules []policyRule
+}
+
+// A policyRule is a rule in a Policy.
+type policyRule struct {
+	pos   string         // file:line of the rule
+	text  string         // text of the rule
+	deny  *regexp.Regexp // for deny rules
+	write bool           // for the deny-writes-outside rule
+	root  string         // Root of the rule's policy, if merged into another
+}
+
+// ParsePolicy parses data, the contents of the policy file filename.
+func ParsePolicy(filename string, data []byte) (*Policy, error) {
+	root, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{Root: root}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		r := policyRule{pos: fmt.Sprintf("%s:%d", filename, line), text: text}
+		kind, arg := cutDirective(text)
+		switch kind {
+		case "deny":
+			re, err := regexp.Compile(arg)
+			if err != nil || arg == "" {
+				return nil, fmt.Errorf("%s: invalid deny pattern: %q", r.pos, arg)
+			}
+			r.deny = re
+		case "deny-writes-outside":
+			if arg != "" {
+				return nil, fmt.Errorf("%s: deny-writes-outside takes no argument", r.pos)
+			}
+			r.write = true
+		default:
+			return nil, fmt.Errorf("%s: unknown rule %q", r.pos, kind)
+		}
+		p.rules = append(p.rules, r)
+	}
+	return p, sc.Err()
+}
+
+// Merge returns a policy with the rules of both p and q,
+// each applying as it does in its own policy,
+// so that q can forbid more commands, but not fewer.
+// Either may be nil.
+func (p *Policy) Merge(q *Policy) *Policy {
+	if p == nil {
+		return q
+	}
+	if q == nil {
+		return p
+	}
+	m := &Policy{Root: p.Root}
+	for _, from := range []*Policy{p, q} {
+		for _, r := range from.rules {
+			if r.root == "" {
+				r.root = from.Root
+			}
+			m.rules = append(m.rules, r)
+		}
+	}
+	return m
+}
+
+// Check reports an error if the policy forbids running c,
+// or any of the filters its output is piped through,
+// or writing its output to the file given by "gosh:output".
+func (p *Policy) Check(c *Command) error {
+	if err := p.check(c.Prompt, c.Dir); err != nil {
+		return err
+	}
+	for _, f := range c.Filters {
+		if err := p.check(f, c.Dir); err != nil {
+			return fmt.Errorf("gosh:filter %q: %v", f, err)
+		}
+	}
+	if c.Output != "" {
+		for _, r := range p.rules {
+			if r.write && !within(p.root(r), c.Output, c.Dir) {
+				return fmt.Errorf("gosh:output: writing %s is forbidden by policy rule %q at %s", c.Output, r.text, r.pos)
+			}
+		}
+	}
+	return nil
+}
+
+// root returns the directory that r allows writes within.
+func (p *Policy) root(r policyRule) string {
+	if r.root != "" {
+		return r.root
+	}
+	return p.Root
+}
+
+// check reports an error if the policy forbids running the shell
+// command text in the directory dir.
+func (p *Policy) check(text, dir string) error {
+	for _, r := range p.rules {
+		switch {
+		case r.deny != nil:
+			if r.deny.MatchString(text) {
+				return fmt.Errorf("forbidden by policy rule %q at %s", r.text, r.pos)
+			}
+		case r.write:
+			root := p.root(r)
+			targets, ok := redirectTargets(text)
+			if !ok {
+				return fmt.Errorf("forbidden by policy rule %q at %s: can't tell which files it writes", r.text, r.pos)
+			}
+			for _, target := range targets {
+				if !within(root, target, dir) {
+					return fmt.Errorf("writing %s is forbidden by policy rule %q at %s", target, r.text, r.pos)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// within reports whether the file target, relative to the directory dir,
+// is known to be within root, or is a device that's safe to write.
+func within(root, target, dir string) bool {
+	switch target {
+	case "/dev/null", "/dev/stdout", "/dev/stderr":
+		return true
+	}
+	if strings.ContainsAny(target, "$~*?[`") {
+		return false
+	}
+	if !filepath.IsAbs(target) {
+		if dir == "" {
+			var err error
+			if dir, err = os.Getwd(); err != nil {
+				return false
+			}
+		}
+		target = filepath.Join(dir, target)
+	}
+	rel, err := filepath.Rel(root, target)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// redirectTargets returns the files that the shell command prompt
+// redirects output to. It reports false if it can't tell,
+// such as if a redirection has no target, or prompt has
+// an unterminated quote.
+func redirectTargets(prompt string) ([]string, bool) {
+	words, ok := shellWords(prompt)
+	if !ok {
+		return nil, false
+	}
+	var targets []string
+	for i, w := range words {
+		if !isRedirect(w) {
+			continue
+		}
+		if i+1 == len(words) || isOperator(words[i+1]) {
+			return nil, false // like ">(cmd)"
+		}
+		op, target := strings.TrimLeft(w, "0123456789"), words[i+1]
+		switch {
+		case op == "<" || op == "<&" || strings.HasPrefix(op, "<<"):
+			continue // only reads
+		case strings.HasSuffix(op, "&") && (target == "-" || isDigits(target)):
+			continue // duplicates or closes a file descriptor
+		}
+		targets = append(targets, target)
+	}
+	return targets, true
+}
@@ -0,0 +1,195 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestShellWords(t *testing.T) {
+	tests := []struct {
+		in    string
+		words []string
+		ok    bool
+	}{
+		{"", nil, true},
+		{"echo hi", []string{"echo", "hi"}, true},
+		{"echo 'a b' \"c d\"", []string{"echo", "a b", "c d"}, true},
+		{`echo "a \"b\""`, []string{"echo", `a "b"`}, true},
+		{`echo a\ b`, []string{"echo", "a b"}, true},
+		{"echo a\\\nb", []string{"echo", "ab"}, true},
+		{"echo a # comment", []string{"echo", "a"}, true},
+		{"echo a#b", []string{"echo", "a#b"}, true},
+		{"a;b\nc", []string{"a", ";", "b", "\n", "c"}, true},
+		{"a && b || c | d &", []string{"a", "&&", "b", "||", "c", "|", "d", "&"}, true},
+		{"(cd x)", []string{"(", "cd", "x", ")"}, true},
+		{"echo hi>out", []string{"echo", "hi", ">", "out"}, true},
+		{"echo hi 2>>log", []string{"echo", "hi", "2>>", "log"}, true},
+		{"echo a2>x", []string{"echo", "a2", ">", "x"}, true},
+		{"cmd &>out", []string{"cmd", "&>", "out"}, true},
+		{"cmd &>>out", []string{"cmd", "&>>", "out"}, true},
+		{"cmd 2>&1", []string{"cmd", "2>&", "1"}, true},
+		{"cmd >|out <in", []string{"cmd", ">|", "out", "<", "in"}, true},
+		{"cat <<EOF", []string{"cat", "<<", "EOF"}, true},
+		{"cat <<-EOF <<<word", []string{"cat", "<<-", "EOF", "<<<", "word"}, true},
+		{"cmd <>file", []string{"cmd", "<>", "file"}, true},
+		{"echo '>'out", []string{"echo", ">out"}, true},
+		{"echo 'unterminated", nil, false},
+		{`echo "unterminated`, nil, false},
+	}
+	for _, tt := range tests {
+		words, ok := shellWords(tt.in)
+		if ok != tt.ok || !reflect.DeepEqual(words, tt.words) {
+			t.Errorf("shellWords(%q) = %q, %v, want %q, %v", tt.in, words, ok, tt.words, tt.ok)
+		}
+	}
+}
+
+func TestRedirectTargets(t *testing.T) {
+	tests := []struct {
+		in      string
+		targets []string
+		ok      bool
+	}{
+		{"echo hi", nil, true},
+		{"echo hi > out", []string{"out"}, true},
+		{"echo hi>out", []string{"out"}, true},
+		{"echo hi >>a 2>b", []string{"a", "b"}, true},
+		{"cmd &>out", []string{"out"}, true},
+		{"cmd >|out", []string{"out"}, true},
+		{"cmd <>file", []string{"file"}, true},
+		{"cmd >&out", []string{"out"}, true},
+		{"cmd > 'a b'", []string{"a b"}, true},
+		{"cmd < in", nil, true},
+		{"cat <<EOF", nil, true},
+		{"cat <<<word", nil, true},
+		{"cmd 2>&1", nil, true},
+		{"cmd 3<&0", nil, true},
+		{"cmd >&-", nil, true},
+		{"echo '>' out", []string{"out"}, true}, // quoted, but taken for a redirection, to be safe
+		{"cmd >", nil, false},
+		{"cmd > | x", nil, false},
+		{"cmd >(tee log)", nil, false},
+		{"cmd > ;", nil, false},
+		{"echo 'a > b", nil, false},
+	}
+	for _, tt := range tests {
+		targets, ok := redirectTargets(tt.in)
+		if ok != tt.ok || !reflect.DeepEqual(targets, tt.targets) {
+			t.Errorf("redirectTargets(%q) = %q, %v, want %q, %v", tt.in, targets, ok, tt.targets, tt.ok)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		data  string
+		rules int
+		err   string
+	}{
+		{"", 0, ""},
+		{"# comment\n\n  \n", 0, ""},
+		{"deny rm\\s+-rf\n", 1, ""},
+		{"deny curl\ndeny-writes-outside\n", 2, ""},
+		{"  deny-writes-outside  \n", 1, ""},
+		{"deny\n", 0, "invalid deny pattern"},
+		{"deny (\n", 0, "invalid deny pattern"},
+		{"deny-writes-outside here\n", 0, "takes no argument"},
+		{"allow ls\n", 0, `unknown rule "allow"`},
+		{"\ndeny [\n", 0, ".goshpolicy:2:"},
+	}
+	for _, tt := range tests {
+		p, err := ParsePolicy(".goshpolicy", []byte(tt.data))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("ParsePolicy(%q): error %v, want %q", tt.data, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePolicy(%q): %v", tt.data, err)
+			continue
+		}
+		if len(p.rules) != tt.rules {
+			t.Errorf("ParsePolicy(%q): %d rules, want %d", tt.data, len(p.rules), tt.rules)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	root := t.TempDir()
+	p, err := ParsePolicy(filepath.Join(root, ".goshpolicy"), []byte("deny rm\\s+-rf\ndeny-writes-outside\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cmd Command
+		err string
+	}{
+		{Command{Prompt: "echo hi"}, ""},
+		{Command{Prompt: "echo hi > out", Dir: root}, ""},
+		{Command{Prompt: "echo hi > sub/out", Dir: root}, ""},
+		{Command{Prompt: "echo hi > " + filepath.Join(root, "out")}, ""},
+		{Command{Prompt: "echo hi > /dev/null"}, ""},
+		{Command{Prompt: "echo hi 2>&1", Dir: root}, ""},
+		{Command{Prompt: "rm -rf /"}, "forbidden by policy rule"},
+		{Command{Prompt: "echo hi > ../out", Dir: root}, "writing ../out is forbidden"},
+		{Command{Prompt: "echo hi > /tmp/gosh-out", Dir: root}, "writing /tmp/gosh-out is forbidden"},
+		{Command{Prompt: "echo hi > $HOME/out", Dir: root}, "forbidden"},
+		{Command{Prompt: "echo hi > ~/out", Dir: root}, "forbidden"},
+		{Command{Prompt: "echo hi >", Dir: root}, "can't tell which files it writes"},
+		{Command{Prompt: "echo 'hi > out", Dir: root}, "can't tell which files it writes"},
+		{Command{Prompt: "go doc fmt", Filters: []string{"head"}, Dir: root}, ""},
+		{Command{Prompt: "go doc fmt", Filters: []string{"cat > ../out"}, Dir: root}, `gosh:filter "cat > ../out": writing ../out is forbidden`},
+		{Command{Prompt: "ls", Filters: []string{"rm -rf x"}, Dir: root}, `gosh:filter "rm -rf x": forbidden by policy rule`},
+		{Command{Prompt: "ls", Output: filepath.Join(root, "sub", "out"), Dir: root}, ""},
+		{Command{Prompt: "ls", Output: filepath.Join(root, "..", "out"), Dir: root}, "gosh:output: writing"},
+	}
+	for _, tt := range tests {
+		err := p.Check(&tt.cmd)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("Check(%q | %q): %v", tt.cmd.Prompt, tt.cmd.Filters, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("Check(%q | %q): error %v, want %q", tt.cmd.Prompt, tt.cmd.Filters, err, tt.err)
+		}
+	}
+}
+
+func TestPolicyMerge(t *testing.T) {
+	outer, err := ParsePolicy("/repo/.goshpolicy", []byte("deny-writes-outside\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner, err := ParsePolicy("/repo/sub/.goshpolicy", []byte("deny-writes-outside\ndeny curl\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := outer.Merge(inner)
+	tests := []struct {
+		prompt string
+		ok     bool
+	}{
+		{"echo > /repo/sub/out", true},
+		{"echo > /repo/out", false}, // outside the inner policy's root
+		{"curl example.com", false},
+		{"echo > /elsewhere", false},
+	}
+	for _, tt := range tests {
+		err := m.Check(&Command{Prompt: tt.prompt, Dir: "/repo/sub"})
+		if (err == nil) != tt.ok {
+			t.Errorf("Check(%q) = %v, want ok %v", tt.prompt, err, tt.ok)
+		}
+	}
+	if outer.Merge(nil) != outer || (*Policy)(nil).Merge(inner) != inner {
+		t.Errorf("Merge with nil policy didn't return the other policy")
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package gosh
+
+import "os/exec"
+
+// killGroup only limits how long cmd waits for its output
+// after it's killed, since there are no process groups here.
+func killGroup(cmd *exec.Cmd) {
+	cmd.WaitDelay = waitDelay
+}
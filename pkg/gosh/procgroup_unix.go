@@ -0,0 +1,28 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package gosh
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killGroup makes cmd run in its own process group, and makes
+// canceling its context kill the whole group, so that the processes
+// cmd starts, like those in a pipeline, aren't left behind.
+func killGroup(cmd *exec.Cmd) {
+	attr := new(syscall.SysProcAttr)
+	if cmd.SysProcAttr != nil {
+		*attr = *cmd.SysProcAttr
+	}
+	attr.Setpgid = true
+	cmd.SysProcAttr = attr
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = waitDelay
+}
@@ -0,0 +1,47 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parsePTYSize parses the argument of a "gosh:pty" directive,
+// a terminal size like "120x40", or just a width like "120",
+// and sets c's terminal size.
+func parsePTYSize(c *Command, arg string) error {
+	if arg == "" {
+		return nil
+	}
+	cols, rows, hasRows := strings.Cut(arg, "x")
+	n, err := strconv.Atoi(cols)
+	if err != nil || n <= 0 || n > 0xffff {
+		return fmt.Errorf("invalid terminal size %q", arg)
+	}
+	c.PTYCols = n
+	if hasRows {
+		n, err := strconv.Atoi(rows)
+		if err != nil || n <= 0 || n > 0xffff {
+			return fmt.Errorf("invalid terminal size %q", arg)
+		}
+		c.PTYRows = n
+	}
+	return nil
+}
+
+// ptySize returns the size of c's pseudo-terminal,
+// 80 columns by 24 rows unless c sets it.
+func (c *Command) ptySize() (cols, rows int) {
+	cols, rows = c.PTYCols, c.PTYRows
+	if cols == 0 {
+		cols = 80
+	}
+	if rows == 0 {
+		rows = 24
+	}
+	return cols, rows
+}
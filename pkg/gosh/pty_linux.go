@@ -0,0 +1,89 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// runPTY runs cmd with a new pseudo-terminal of c's size as its
+// controlling terminal, standard input, output, and error,
+// and returns everything written to the terminal.
+func (c *Command) runPTY(cmd *exec.Cmd) ([]byte, error) {
+	master, slave, err := openPTY(c.ptySize())
+	if err != nil {
+		return nil, err
+	}
+	defer master.Close()
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = slave, slave, slave
+	attr := new(syscall.SysProcAttr)
+	if cmd.SysProcAttr != nil {
+		*attr = *cmd.SysProcAttr
+	}
+	// A new session has a new process group too.
+	attr.Setsid, attr.Setctty, attr.Ctty, attr.Setpgid = true, true, 0, false
+	cmd.SysProcAttr = attr
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	out := &spillBuffer{limit: c.outputLimit()}
+	defer out.Close()
+	done := make(chan struct{})
+	go func() {
+		// Reading fails with EIO once every process
+		// with the terminal open has exited.
+		io.Copy(out, master)
+		close(done)
+	}()
+	err = cmd.Wait()
+	<-done
+	output, oerr := out.Bytes()
+	if err == nil {
+		err = oerr
+	}
+	return bytes.ReplaceAll(output, []byte("\r\n"), []byte("\n")), err
+}
+
+// openPTY opens a new pseudo-terminal with the given size,
+// and returns its master and slave sides.
+func openPTY(cols, rows int) (master, slave *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("unlocking pseudo-terminal: %v", err)
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		master.Close()
+		return nil, nil, fmt.Errorf("finding pseudo-terminal: %v", err)
+	}
+	slave, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		master.Close()
+		return nil, nil, err
+	}
+	ws := &unix.Winsize{Col: uint16(cols), Row: uint16(rows)}
+	if err := unix.IoctlSetWinsize(int(slave.Fd()), unix.TIOCSWINSZ, ws); err != nil {
+		master.Close()
+		slave.Close()
+		return nil, nil, fmt.Errorf("setting pseudo-terminal size: %v", err)
+	}
+	return master, slave, nil
+}
@@ -0,0 +1,16 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !linux
+
+package gosh
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func (c *Command) runPTY(cmd *exec.Cmd) ([]byte, error) {
+	return nil, errors.New("gosh:pty is not supported on this system")
+}
@@ -0,0 +1,34 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import "regexp"
+
+// Redacted replaces the text matched by redaction patterns
+// in commands' output.
+const Redacted = "[REDACTED]"
+
+// Secrets matches common formats of credentials,
+// like cloud provider access keys, API tokens, and private keys.
+var Secrets = []*regexp.Regexp{
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),                                              // AWS access key ID
+	regexp.MustCompile(`\bgh[pousr]_[A-Za-z0-9]{36,}\b`),                                             // GitHub token
+	regexp.MustCompile(`\bgithub_pat_[A-Za-z0-9_]{22,}\b`),                                           // GitHub fine-grained token
+	regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}\b`),                                               // GitLab token
+	regexp.MustCompile(`\bxox[abposr]-[A-Za-z0-9-]{10,}\b`),                                          // Slack token
+	regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`),                                                  // Google API key
+	regexp.MustCompile(`\bsk_live_[0-9A-Za-z]{24,}\b`),                                               // Stripe secret key
+	regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.eyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`),         // JSON web token
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----(?s:.*?)-----END [A-Z ]*PRIVATE KEY-----`), // private key
+}
+
+// redact returns output with the text matched by
+// any of patterns replaced by Redacted.
+func redact(output []byte, patterns []*regexp.Regexp) []byte {
+	for _, re := range patterns {
+		output = re.ReplaceAllLiteral(output, []byte(Redacted))
+	}
+	return output
+}
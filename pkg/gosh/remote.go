@@ -0,0 +1,37 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"strings"
+)
+
+// sshArgs returns the arguments to ssh that run script
+// with c's shell on c.Host, in the remote user's home directory.
+// The variables in c.Env are exported to the script first,
+// except for GOSH_OUT variables, which name local files.
+func (c *Command) sshArgs(script string) []string {
+	var remote strings.Builder
+	for _, kv := range c.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, "GOSH_OUT_") {
+			continue
+		}
+		remote.WriteString("export " + name + "=" + shellQuote(value) + "\n")
+	}
+	remote.WriteString(script)
+
+	var args []string
+	if c.SSHConfig != "" {
+		args = append(args, "-F", c.SSHConfig)
+	}
+	// Never prompt for passwords: the command's input isn't the user's terminal.
+	tty := "-T"
+	if c.PTY {
+		tty = "-tt"
+	}
+	args = append(args, tty, "-o", "BatchMode=yes", "--", c.Host)
+	return append(args, c.shell()+" -c "+shellQuote(remote.String()))
+}
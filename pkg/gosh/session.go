@@ -0,0 +1,264 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// outputPoll is how often the output of a command in a session
+// is checked against its limit while the command runs.
+const outputPoll = 100 * time.Millisecond
+
+// A session is a persistent shell that runs a file's commands
+// one after another, as enabled by "gosh:session",
+// so that commands like "cd" and "export" affect later commands.
+type session struct {
+	dir   string   // working directory
+	shell string   // shell to run, or "" for "sh"
+	last  *Command // most recently added command
+
+	sysProcAttr *syscall.SysProcAttr // attributes for the shell process, if any
+	environ     []string             // environment for the shell, or nil for the process's
+
+	mu     sync.Mutex
+	cmd    *exec.Cmd
+	kill   context.CancelFunc // kills the shell and its commands
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+	tmp    string // directory for command output
+	ended  error  // why the session ended early, if it did
+}
+
+// A sessionExitError reports that a command in a session
+// exited unsuccessfully.
+type sessionExitError struct {
+	code   int
+	stderr []byte
+}
+
+func (e *sessionExitError) Error() string { return fmt.Sprintf("exit status %d", e.code) }
+
+// run runs c in the session, starting the shell if needed,
+// and returns the command's standard output.
+// The variables in c.Env are exported to the session first.
+// If ctx is done before c finishes, as when c times out,
+// the shell is killed, and the session ends: its state is lost,
+// so the commands after c can't run. The session also ends
+// if c's output grows longer than its limit.
+func (s *session) run(ctx context.Context, c *Command) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ended != nil {
+		return nil, s.ended
+	}
+	if s.cmd == nil {
+		if err := s.start(); err != nil {
+			return nil, err
+		}
+	}
+	stop := context.AfterFunc(ctx, s.kill)
+	defer func() {
+		if !stop() {
+			s.ended = fmt.Errorf("session: ended when %q was stopped", c.Prompt)
+			s.closeLocked()
+		}
+	}()
+
+	for _, kv := range c.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		if _, err := fmt.Fprintf(s.stdin, "export %s=%s\n", name, shellQuote(value)); err != nil {
+			return nil, fmt.Errorf("session: %v", err)
+		}
+	}
+
+	stdout := filepath.Join(s.tmp, "stdout")
+	stderr := filepath.Join(s.tmp, "stderr")
+	redirect := "2>" + shellQuote(stderr)
+	if c.Stderr {
+		redirect = "2>&1"
+	}
+	// The braces run the command in the shell itself, not a subshell.
+	// A command with limits runs in a subshell instead, so that
+	// they don't apply to the commands after it, which also means
+	// that any changes it makes to the shell's state are lost.
+	script := fmt.Sprintf("{ %s\n}", c.Prompt)
+	if limits := c.limitScript(); limits != "" {
+		script = fmt.Sprintf("( %s%s\n)", limits, c.Prompt)
+	}
+	_, err := fmt.Fprintf(s.stdin, "%s >%s %s </dev/null; echo \"$?\"\n", script, shellQuote(stdout), redirect)
+	if err != nil {
+		return nil, fmt.Errorf("session: %v", err)
+	}
+	over := s.watchOutput(c.outputLimit(), stdout, stderr)
+	line, err := s.stdout.ReadString('\n')
+	if over() {
+		s.ended = fmt.Errorf("session: ended when the output of %q was too long", c.Prompt)
+		s.closeLocked()
+		return nil, fmt.Errorf("output is longer than the limit of %d bytes", c.outputLimit())
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		// As when c is stopped, the commands after it can't run.
+		s.ended = errors.New("session: shell exited")
+		s.closeLocked()
+		return nil, s.ended
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("session: unexpected output %q", line)
+	}
+
+	if fi, err := os.Stat(stdout); err == nil && fi.Size() > c.outputLimit() {
+		return nil, fmt.Errorf("output is longer than the limit of %d bytes", c.outputLimit())
+	}
+	output, err := os.ReadFile(stdout)
+	if err != nil {
+		return nil, err
+	}
+	if code != 0 {
+		var errOutput []byte
+		if !c.Stderr {
+			errOutput, _ = readTail(stderr, maxStderr)
+		}
+		return output, &sessionExitError{code, errOutput}
+	}
+	return output, nil
+}
+
+// watchOutput checks the files in which a command in the session
+// writes its output while it runs, and kills the shell if either is
+// longer than limit. It returns a function to call once the command
+// finishes, which stops checking and reports whether the shell was killed.
+func (s *session) watchOutput(limit int64, files ...string) (over func() bool) {
+	stop := make(chan struct{})
+	killed := make(chan bool, 1)
+	go func() {
+		t := time.NewTicker(outputPoll)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				killed <- false
+				return
+			case <-t.C:
+				for _, file := range files {
+					if fi, err := os.Stat(file); err == nil && fi.Size() > limit {
+						s.kill()
+						killed <- true
+						return
+					}
+				}
+			}
+		}
+	}()
+	return func() bool {
+		close(stop)
+		return <-killed
+	}
+}
+
+// start starts the session's shell.
+func (s *session) start() error {
+	tmp, err := os.MkdirTemp("", "gosh-session")
+	if err != nil {
+		return err
+	}
+	if s.sysProcAttr != nil {
+		// The shell may run as another user,
+		// who must be able to create the output files.
+		if err := os.Chmod(tmp, 0733); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	shell := s.shell
+	if shell == "" {
+		shell = "sh"
+	}
+	// The shell outlives the context of any one command.
+	ctx, kill := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, shell)
+	cmd.Dir = s.dir
+	cmd.SysProcAttr = s.sysProcAttr
+	killGroup(cmd)
+	cmd.Env = s.environ
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		kill()
+		os.RemoveAll(tmp)
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		kill()
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		kill()
+		os.RemoveAll(tmp)
+		return err
+	}
+	s.cmd, s.kill, s.stdin, s.stdout, s.tmp = cmd, kill, stdin, bufio.NewReader(stdout), tmp
+	return nil
+}
+
+// close ends the session's shell, if it was started.
+func (s *session) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeLocked()
+}
+
+// closeLocked is like close, but s.mu must be held.
+func (s *session) closeLocked() {
+	if s.cmd == nil {
+		return
+	}
+	s.stdin.Close()
+	s.cmd.Wait()
+	s.kill()
+	os.RemoveAll(s.tmp)
+	s.cmd = nil
+}
+
+// readTail returns the last n bytes of the named file, or all of it,
+// if it's shorter.
+func readTail(name string, n int64) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(max(0, fi.Size()-n), io.SeekStart); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(f)
+}
+
+// shellQuote quotes s for the shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,196 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSession(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+	dir := t.TempDir()
+	s := &session{dir: dir}
+	defer s.close()
+
+	tests := []struct {
+		cmd  Command
+		want string // the output, or an error it contains
+	}{
+		{Command{Prompt: "pwd"}, dir + "\n"},
+		{Command{Prompt: "mkdir sub && cd sub"}, ""},
+		{Command{Prompt: "pwd"}, filepath.Join(dir, "sub") + "\n"},
+		{Command{Prompt: "export FOO=bar"}, ""},
+		{Command{Prompt: `echo "$FOO"`}, "bar\n"},
+		{Command{Prompt: `echo "$BAZ"`, Env: []string{"BAZ=it's"}}, "it's\n"},
+		{Command{Prompt: `echo "$BAZ"`}, "it's\n"},
+		{Command{Prompt: "f() { echo in f; }"}, ""},
+		{Command{Prompt: "f"}, "in f\n"},
+		{Command{Prompt: "echo out; echo err >&2"}, "out\n"},
+		{Command{Prompt: "echo out; echo err >&2", Stderr: true}, "out\nerr\n"},
+		{Command{Prompt: "echo why >&2; false"}, "exit status 1"},
+		// The shell survives a failing command.
+		{Command{Prompt: `echo "$FOO"`}, "bar\n"},
+		{Command{Prompt: "exit 3"}, "shell exited"},
+		{Command{Prompt: "true"}, "session: shell exited"},
+	}
+	for _, tt := range tests {
+		out, err := s.run(context.Background(), &tt.cmd)
+		if err != nil {
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("%q: %v, want %q", tt.cmd.Prompt, err, tt.want)
+			}
+			if se, ok := err.(*sessionExitError); ok && string(se.stderr) != "why\n" {
+				t.Errorf("%q: stderr %q, want %q", tt.cmd.Prompt, se.stderr, "why\n")
+			}
+			continue
+		}
+		if string(out) != tt.want {
+			t.Errorf("%q = %q, want %q", tt.cmd.Prompt, out, tt.want)
+		}
+	}
+}
+
+func TestSessionTimeout(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+	s := &session{dir: t.TempDir()}
+	defer s.close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := s.run(ctx, &Command{Prompt: "sleep 10"}); err == nil {
+		t.Fatalf("sleep 10 finished within 100ms")
+	}
+	// The shell's state is lost, so the rest of the session can't run.
+	if _, err := s.run(context.Background(), &Command{Prompt: "true"}); err == nil || !strings.Contains(err.Error(), `ended when "sleep 10" was stopped`) {
+		t.Errorf("after the timeout: got %v, want the session ended", err)
+	}
+}
+
+func TestProcessSession(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+	tests := []struct {
+		name string
+		src  string
+		want string // the output, or an error it contains
+	}{
+		{
+			name: "state",
+			src:  "#gosh:ok\n# gosh:session\n# % cd sub\n# % export FOO=bar\n# % basename $(pwd) $FOO\n",
+			want: "#gosh:ok\n# gosh:session\n# # cd sub\n# # export FOO=bar\n# # basename $(pwd) $FOO\n# | sub\n",
+		},
+		{
+			name: "no session",
+			src:  "#gosh:ok\n# % cd sub\n# % basename $(pwd)\n",
+			want: "#gosh:ok\n# # cd sub\n# # basename $(pwd)\n# | DIR\n", // DIR is the test's directory
+		},
+		{
+			name: "failed",
+			src:  "#gosh:ok\n# gosh:session\n# % cd missing\n# % pwd\n",
+			want: `not run because "cd missing" failed`,
+		},
+		{
+			name: "pty",
+			src:  "#gosh:ok\n# gosh:session\n# gosh:pty\n# % tty\n",
+			want: "aren't supported in sessions",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.Mkdir(filepath.Join(dir, "sub"), 0777); err != nil {
+				t.Fatal(err)
+			}
+			want := strings.ReplaceAll(tt.want, "DIR", filepath.Base(dir))
+			out, results, err := Process(context.Background(), []byte(tt.src), Options{
+				Filename:  filepath.Join(dir, "run.sh"),
+				Dir:       dir,
+				KeepGoing: true,
+			})
+			for _, r := range results {
+				if r.Err != nil && err == nil {
+					err = r.Err
+				}
+			}
+			if err != nil {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("Process: %v", err)
+				}
+				return
+			}
+			if string(out) != want {
+				t.Errorf("Process:\n%s\nwant:\n%s", out, want)
+			}
+		})
+	}
+}
+
+func TestSessionLimits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+	s := &session{dir: t.TempDir()}
+	defer s.close()
+
+	tests := []struct {
+		cmd  Command
+		want string // the output, or an error it contains
+	}{
+		{Command{Prompt: "X=1; ulimit -t", CPULimit: 200 * time.Second}, "200\n"},
+		// Neither the limit nor the variable outlives the command,
+		// so a higher limit can still be set.
+		{Command{Prompt: `echo "X=$X"; ulimit -t`}, "X=\nunlimited\n"},
+		{Command{Prompt: "ulimit -t", CPULimit: 300 * time.Second}, "300\n"},
+		{Command{Prompt: "ulimit -t", CPULimit: 100 * time.Second}, "100\n"},
+		{Command{Prompt: "Y=1"}, ""},
+		{Command{Prompt: `echo "Y=$Y"`}, "Y=1\n"},
+	}
+	for _, tt := range tests {
+		out, err := s.run(context.Background(), &tt.cmd)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.cmd.Prompt, err)
+		}
+		if string(out) != tt.want {
+			t.Errorf("%q = %q, want %q", tt.cmd.Prompt, out, tt.want)
+		}
+	}
+}
+
+func TestSessionOutputLimit(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+	s := &session{dir: t.TempDir()}
+	defer s.close()
+
+	// The command never finishes on its own.
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.run(context.Background(), &Command{Prompt: "yes", OutputLimit: 1 << 10})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "longer than the limit") {
+			t.Errorf("yes: got %v, want output limit error", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("yes is still running")
+	}
+	if _, err := s.run(context.Background(), &Command{Prompt: "true"}); err == nil || !strings.Contains(err.Error(), "session: ended") {
+		t.Errorf("after the session ended: got %v, want it ended", err)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// spillSize is how much of a command's output is held in memory
+// before the rest is written to a temporary file instead.
+const spillSize = 1 << 20
+
+// maxOutput is the longest output allowed of a command without
+// an output limit of its own, and the highest limit it may have.
+// Output that's kept ends up in memory, in the rewritten source,
+// so this keeps a runaway command from exhausting it;
+// only the first maxOutput bytes are ever collected.
+const maxOutput = 64 << 20
+
+// maxStderr is how much of the standard error of a command
+// that fails is kept for its error: only the end,
+// where the reason it failed usually is.
+const maxStderr = 64 << 10
+
+// outputLimit returns the limit on the length of c's output.
+func (c *Command) outputLimit() int64 {
+	if c.OutputLimit > 0 {
+		return min(c.OutputLimit, maxOutput)
+	}
+	return maxOutput
+}
+
+// A spillBuffer collects a command's output, in memory while it's small,
+// and in a temporary file once it's larger than spillSize.
+// Output beyond limit, if positive, is counted but discarded.
+type spillBuffer struct {
+	limit int64
+	n     int64 // number of bytes written
+	mem   bytes.Buffer
+	file  *os.File
+	err   error // first error writing to file
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if b.limit > 0 {
+		p = p[:max(0, min(int64(len(p)), b.limit-b.n))]
+	}
+	b.n += int64(n)
+	if b.file == nil && int64(b.mem.Len()+len(p)) > spillSize {
+		b.file, b.err = os.CreateTemp("", "gosh-output")
+		if b.err == nil {
+			_, b.err = b.file.Write(b.mem.Bytes())
+		}
+		b.mem = bytes.Buffer{}
+	}
+	switch {
+	case b.err != nil:
+	case b.file != nil:
+		_, b.err = b.file.Write(p)
+	default:
+		b.mem.Write(p)
+	}
+	return n, nil
+}
+
+// Bytes returns the output written to b,
+// or an error if it's longer than b.limit.
+func (b *spillBuffer) Bytes() ([]byte, error) {
+	if b.limit > 0 && b.n > b.limit {
+		return nil, fmt.Errorf("output is longer than the limit of %d bytes", b.limit)
+	}
+	if b.err != nil {
+		return nil, b.err
+	}
+	if b.file == nil {
+		return b.mem.Bytes(), nil
+	}
+	// The buffer is the right size, so it's only allocated once.
+	buf := bytes.NewBuffer(make([]byte, 0, b.n))
+	if _, err := b.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteTo writes the output written to b to w,
+// streaming it from the temporary file, if any.
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	if b.err != nil {
+		return 0, b.err
+	}
+	if b.file == nil {
+		return b.mem.WriteTo(w)
+	}
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, b.file)
+}
+
+// Close removes b's temporary file, if any.
+func (b *spillBuffer) Close() {
+	if b.file != nil {
+		b.file.Close()
+		os.Remove(b.file.Name())
+	}
+}
+
+// A tailBuffer keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > b.limit {
+		p = p[len(p)-b.limit:]
+	}
+	if over := len(b.buf) + len(p) - b.limit; over > 0 {
+		b.buf = append(b.buf[:0], b.buf[over:]...)
+	}
+	b.buf = append(b.buf, p...)
+	return n, nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"errors"
+	"os/exec"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSpillBuffer(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int64
+		writes []int // lengths of the writes
+		spills bool
+		err    bool
+	}{
+		{"empty", 0, nil, false, false},
+		{"small", 0, []int{10, 20}, false, false},
+		{"exactly spillSize", 0, []int{spillSize}, false, false},
+		{"spilled", 0, []int{spillSize - 1, 2}, true, false},
+		{"spilled at once", 0, []int{spillSize + 1}, true, false},
+		{"spilled more", 0, []int{spillSize, 1, 100}, true, false},
+		{"within limit", 30, []int{10, 20}, false, false},
+		{"over limit", 30, []int{10, 21}, false, true},
+		{"spilled over limit", spillSize + 10, []int{spillSize, spillSize}, true, true},
+	}
+	for _, tt := range tests {
+		b := &spillBuffer{limit: tt.limit}
+		var want bytes.Buffer
+		for i, n := range tt.writes {
+			p := bytes.Repeat([]byte{'a' + byte(i)}, n)
+			if m, err := b.Write(p); m != n || err != nil {
+				t.Fatalf("%s: Write = %d, %v, want %d, nil", tt.name, m, err, n)
+			}
+			want.Write(p)
+		}
+		if spilled := b.file != nil; spilled != tt.spills {
+			t.Errorf("%s: spilled = %v, want %v", tt.name, spilled, tt.spills)
+		}
+		got, err := b.Bytes()
+		switch {
+		case tt.err:
+			if err == nil {
+				t.Errorf("%s: Bytes succeeded, want error", tt.name)
+			}
+		case err != nil:
+			t.Errorf("%s: Bytes: %v", tt.name, err)
+		case !bytes.Equal(got, want.Bytes()):
+			t.Errorf("%s: Bytes returned %d bytes, not the %d written", tt.name, len(got), want.Len())
+		}
+		b.Close()
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	tests := []struct {
+		limit, want int64
+	}{
+		{0, maxOutput},
+		{-1, maxOutput},
+		{1 << 10, 1 << 10},
+		{maxOutput, maxOutput},
+		{maxOutput + 1, maxOutput},
+		{1 << 40, maxOutput},
+	}
+	for _, tt := range tests {
+		c := &Command{OutputLimit: tt.limit}
+		if got := c.outputLimit(); got != tt.want {
+			t.Errorf("outputLimit with OutputLimit %d = %d, want %d", tt.limit, got, tt.want)
+		}
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"abc"}, "abc"},
+		{[]string{"abcde"}, "abcde"},
+		{[]string{"abcdefg"}, "cdefg"},
+		{[]string{"abc", "de"}, "abcde"},
+		{[]string{"abc", "def"}, "bcdef"},
+		{[]string{"abc", "defghij"}, "fghij"},
+		{[]string{"a", "b", "c", "d", "e", "f"}, "bcdef"},
+	}
+	for _, tt := range tests {
+		b := &tailBuffer{limit: 5}
+		for _, w := range tt.writes {
+			if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+				t.Fatalf("Write(%q) = %d, %v", w, n, err)
+			}
+		}
+		if string(b.buf) != tt.want {
+			t.Errorf("writing %q kept %q, want %q", tt.writes, b.buf, tt.want)
+		}
+	}
+}
+
+func TestRunSpillStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no sh")
+	}
+	// The command writes more than maxStderr to its standard error,
+	// but only the end, with the reason it failed, is kept.
+	c := &Command{Prompt: "yes | head -c 1000000 >&2; echo failed >&2; exit 1"}
+	_, err := c.runSpill(exec.Command("sh", "-c", c.Prompt))
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		t.Fatalf("runSpill: got %v, want exit error", err)
+	}
+	if len(ee.Stderr) != maxStderr || !strings.HasSuffix(string(ee.Stderr), "failed\n") {
+		t.Errorf("runSpill kept %d bytes of stderr ending %q, want %d ending in %q", len(ee.Stderr), ee.Stderr[max(0, len(ee.Stderr)-10):], maxStderr, "failed\n")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path"
+
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/tools/txtar"
+)
+
+// processTxtar processes the Go and Markdown files within a txtar archive.
+// Each file is processed independently, as if it were on its own,
+// and its results are adjusted to refer to offsets within the archive.
+func processTxtar(ctx context.Context, src []byte, opts *Options) ([]byte, []Result, error) {
+	ar := txtar.Parse(src)
+
+	// Find where each file's data starts in src.
+	offsets := make([]int, len(ar.Files))
+	pos := 0
+	for i, f := range ar.Files {
+		marker := []byte("-- " + f.Name + " --\n")
+		if j := bytes.Index(src[pos:], marker); j >= 0 {
+			pos += j + len(marker)
+		}
+		offsets[i] = pos
+	}
+
+	var g errgroup.Group
+	results := make([][]Result, len(ar.Files))
+	errs := make([]error, len(ar.Files))
+	for i := range ar.Files {
+		f := &ar.Files[i]
+		switch path.Ext(f.Name) {
+		case ".go", ".md":
+		default:
+			continue
+		}
+		g.Go(func() error {
+			fopts := *opts
+			fopts.Filename = opts.Filename + "/" + f.Name
+			fopts.archive = opts.Filename
+			out, res, err := Process(ctx, f.Data, fopts)
+			for j := range res {
+				res[j].Offset += offsets[i]
+				res[j].End += offsets[i]
+			}
+			results[i] = res
+			if out != nil {
+				f.Data = out
+			}
+			errs[i] = err
+			return err
+		})
+	}
+	err := g.Wait()
+
+	var all []Result
+	for _, res := range results {
+		all = append(all, res...)
+	}
+	if err != nil && !opts.KeepGoing {
+		return nil, all, err
+	}
+	if err != nil {
+		err = errors.Join(errs...)
+	}
+	return txtar.Format(ar), all, err
+}
@@ -0,0 +1,99 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gosh
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestProcessTxtar(t *testing.T) {
+	tests := []struct {
+		name    string
+		src     string
+		refresh bool
+		want    string
+	}{
+		{
+			name: "go",
+			src:  "comment\n-- a.go --\npackage a\n\n//gosh:ok\n\n/* % echo a\n*/\n",
+			want: "comment\n-- a.go --\npackage a\n\n//gosh:ok\n\n/* # echo a\na\n*/\n",
+		},
+		{
+			name: "markdown",
+			src:  "-- README.md --\n<!-- gosh:ok -->\n```console\n% echo hi\n```\n",
+			want: "-- README.md --\n<!-- gosh:ok -->\n```console\n% echo hi\nhi\n```\n",
+		},
+		{
+			name: "other files unchanged",
+			src:  "-- run.sh --\n#gosh:ok\n# % echo a\n-- a.go --\npackage a\n\n//gosh:ok\n\n/* % echo b\n*/\n-- data.txt --\n% echo c\n",
+			want: "-- run.sh --\n#gosh:ok\n# % echo a\n-- a.go --\npackage a\n\n//gosh:ok\n\n/* # echo b\nb\n*/\n-- data.txt --\n% echo c\n",
+		},
+		{
+			name:    "refresh several",
+			src:     "-- a.go --\npackage a\n\n//gosh:ok\n\n/* # echo a\nold\n*/\n-- README.md --\n<!-- gosh:ok -->\n```console\n% echo b\nold\n```\n",
+			refresh: true,
+			want:    "-- a.go --\npackage a\n\n//gosh:ok\n\n/* # echo a\na\n*/\n-- README.md --\n<!-- gosh:ok -->\n```console\n% echo b\nb\n```\n",
+		},
+		{
+			name: "directives stay in their file",
+			src:  "-- a.go --\npackage a\n\n//gosh:ok\n-- b.go --\npackage b\n\n/* % echo b\n*/\n",
+			want: "-- a.go --\npackage a\n\n//gosh:ok\n-- b.go --\npackage b\n\n/* % echo b\n*/\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := []byte(tt.src)
+			out, results, err := Process(context.Background(), src, Options{
+				Filename: "testdata/a.txtar",
+				Refresh:  tt.refresh,
+				Run:      echoRun,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range results {
+				if r.Err != nil {
+					t.Fatal(r.Err)
+				}
+				// Results refer to the archive, not the file within it.
+				if got := string(src[r.Offset:r.End]); got != r.Old {
+					t.Errorf("result for %q: archive has %q at its offsets, want %q", r.Prompt, got, r.Old)
+				}
+			}
+			if out == nil {
+				out = src
+			}
+			if string(out) != tt.want {
+				t.Errorf("Process:\n%s\nwant:\n%s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestTxtarPaths(t *testing.T) {
+	src := "-- a.go --\npackage a\n\n//gosh:ok\n\n//gosh:output=out.txt\n//gosh:deps=in.txt,sub/in.txt\n/* % echo a\n*/\n"
+	_, results, err := Process(context.Background(), []byte(src), Options{
+		Filename: filepath.Join("testdata", "a.txtar"),
+		Run:      echoRun,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	// Paths are relative to the archive's directory,
+	// since the files within it don't have one.
+	c := results[0].Command
+	if want := filepath.Join("testdata", "out.txt"); c.Output != want {
+		t.Errorf("gosh:output file is %q, want %q", c.Output, want)
+	}
+	if want := []string{filepath.Join("testdata", "in.txt"), filepath.Join("testdata", "sub", "in.txt")}; !reflect.DeepEqual(c.Deps, want) {
+		t.Errorf("gosh:deps files are %q, want %q", c.Deps, want)
+	}
+}
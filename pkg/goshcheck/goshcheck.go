@@ -0,0 +1,164 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package goshcheck defines an Analyzer that reports
+// shell command comments whose output is missing or stale.
+//
+// The analyzer doesn't run commands itself: it lacks the trust store,
+// repository policy, and environment that guard them in gosh itself.
+// Instead, it asks the gosh command for the edits it would make,
+// so that only the commands the user trusts ever run.
+package goshcheck
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+	"golang.org/x/tools/go/analysis"
+)
+
+const Doc = `report gosh commands with missing or stale output
+
+The goshcheck analyzer reports each shell command embedded in a comment
+whose output was never generated or no longer matches, with a suggested
+fix that replaces the comment with fresh output. To find the output,
+it runs "gosh -json -refresh" on the file, so commands only run if
+the user trusts them, as with "gosh allow". For files gosh can't
+process, like those with untrusted commands, it only reports the
+commands that have never run, and why gosh failed.`
+
+var Analyzer = &analysis.Analyzer{
+	Name: "goshcheck",
+	Doc:  Doc,
+	URL:  "https://pkg.go.dev/github.com/mdempsky/gosh/pkg/goshcheck",
+	Run:  run,
+}
+
+// goshProgram is the gosh command that the analyzer runs.
+var goshProgram = "gosh"
+
+func init() {
+	Analyzer.Flags.StringVar(&goshProgram, "gosh", goshProgram, "the gosh `command` to run")
+}
+
+// A goshFile and goshEdit are the edits of a file in the gosh -json format.
+type goshFile struct {
+	File  string
+	Edits []goshEdit
+	Error string
+}
+
+type goshEdit struct {
+	Offset, End int
+	Old, New    string
+}
+
+// goshEdits returns the edits that gosh would make to the file filename,
+// and the reason it can't make any others, like a command failing
+// or not being trusted. It's a variable for testing.
+var goshEdits = func(ctx context.Context, filename string) ([]goshEdit, error) {
+	cmd := exec.CommandContext(ctx, goshProgram, "-json", "-format=", "-refresh", "-keep-going", "-w=false", "-q", filepath.Base(filename))
+	// From the file's directory, gosh finds the same configuration
+	// and policy as when it runs there.
+	cmd.Dir = filepath.Dir(filename)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if len(out) == 0 && err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.New(msg)
+		}
+		return nil, err
+	}
+	var edits []goshEdit
+	var fileErr error
+	dec := json.NewDecoder(bytes.NewReader(out))
+	for dec.More() {
+		var f goshFile
+		if err := dec.Decode(&f); err != nil {
+			return nil, fmt.Errorf("reading gosh output: %v", err)
+		}
+		if f.Error != "" {
+			fileErr = errors.New(f.Error)
+		}
+		edits = append(edits, f.Edits...)
+	}
+	return edits, fileErr
+}
+
+func run(pass *analysis.Pass) (any, error) {
+	for _, f := range pass.Files {
+		tf := pass.Fset.File(f.Pos())
+		src, err := os.ReadFile(tf.Name())
+		if err != nil || len(src) != tf.Size() {
+			continue // e.g., cgo-generated file, or changed since parsing
+		}
+		if !mayHaveCommands(src) {
+			continue
+		}
+
+		edits, err := goshEdits(context.Background(), tf.Name())
+		if err != nil {
+			if len(edits) == 0 {
+				reportUnrun(pass, tf, src)
+			}
+			pass.Reportf(f.Package, "gosh can't check the commands in this file: %v", err)
+		}
+		for _, e := range edits {
+			// gosh reports New as gofmt formats it in place,
+			// so it's Old if the output is up to date.
+			if e.New == e.Old || e.Offset < 0 || e.End > len(src) || e.Offset > e.End {
+				continue
+			}
+			pos, end := tf.Pos(e.Offset), tf.Pos(e.End)
+			msg := "gosh command output is stale"
+			if !strings.HasPrefix(e.Old, "/* #") {
+				msg = "gosh command has not been run"
+			}
+			pass.Report(analysis.Diagnostic{
+				Pos:     pos,
+				End:     end,
+				Message: msg,
+				SuggestedFixes: []analysis.SuggestedFix{{
+					Message:   "Update command output",
+					TextEdits: []analysis.TextEdit{{Pos: pos, End: end, NewText: []byte(e.New)}},
+				}},
+			})
+		}
+	}
+	return nil, nil
+}
+
+// mayHaveCommands reports whether src may have commands,
+// so that gosh needn't run for files that can't.
+func mayHaveCommands(src []byte) bool {
+	return bytes.Contains(src, []byte("% ")) || bytes.Contains(src, []byte("/* #"))
+}
+
+// reportUnrun reports the commands in src, the contents of tf,
+// that gosh would run but that have never run, without running them.
+func reportUnrun(pass *analysis.Pass, tf *token.File, src []byte) {
+	// Without Refresh, only the commands that have never run
+	// are selected. None of them run.
+	gosh.Process(context.Background(), src, gosh.Options{
+		Filename: tf.Name(),
+		Select: func(c *gosh.Command) bool {
+			pass.Report(analysis.Diagnostic{
+				Pos:     tf.Pos(c.Pos.Offset),
+				End:     tf.Pos(c.End.Offset),
+				Message: "gosh command has not been run",
+			})
+			return false
+		},
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package goshcheck
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+	"golang.org/x/tools/go/analysis/analysistest"
+)
+
+// fakeGoshEdits stands in for running gosh, which would check that
+// the commands are trusted. It pretends that those in package b aren't,
+// and runs the others like echo, without a shell.
+func fakeGoshEdits(ctx context.Context, filename string) ([]goshEdit, error) {
+	if filepath.Base(filepath.Dir(filename)) == "b" {
+		return nil, errors.New("commands not trusted; run \"gosh allow\" to trust them")
+	}
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	_, results, err := gosh.Process(ctx, src, gosh.Options{
+		Filename: filename,
+		Refresh:  true,
+		Run: func(ctx context.Context, c *gosh.Command) ([]byte, error) {
+			return []byte(strings.TrimPrefix(c.Prompt, "echo ") + "\n"), nil
+		},
+	})
+	var edits []goshEdit
+	for _, r := range results {
+		edits = append(edits, goshEdit{Offset: r.Offset, End: r.End, Old: r.Old, New: r.New})
+	}
+	return edits, err
+}
+
+func TestAnalyzer(t *testing.T) {
+	defer func(old func(context.Context, string) ([]goshEdit, error)) { goshEdits = old }(goshEdits)
+	goshEdits = fakeGoshEdits
+
+	analysistest.RunWithSuggestedFixes(t, analysistest.TestData(), Analyzer, "a", "b")
+}
@@ -0,0 +1,30 @@
+package a
+
+//gosh:ok
+
+// want +1 "gosh command has not been run"
+// % echo hello
+
+// want +1 "gosh command output is stale"
+/* # echo fresh
+stale
+*/
+
+/* # echo same
+same
+*/
+
+func f() {
+	/* # echo indented
+	indented
+	*/
+
+	// want +1 "gosh command output is stale"
+	/* # echo body
+	stale
+	*/
+}
+
+//gosh:deny
+
+// % echo denied
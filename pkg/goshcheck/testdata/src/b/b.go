@@ -0,0 +1,10 @@
+package b // want "gosh can't check the commands in this file: commands not trusted"
+
+//gosh:ok
+
+// want +1 "gosh command has not been run"
+// % echo hello
+
+/* # echo old
+old
+*/
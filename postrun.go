@@ -0,0 +1,81 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// The summary of the run, for -post-run.
+var (
+	summaryMu      sync.Mutex
+	summaryFiles   int      // files processed
+	summaryChanged []string // files whose output changed
+	summaryFailed  int      // commands that failed
+)
+
+// recordRun records the results of processing filePath,
+// whose contents src became out, for -post-run.
+func recordRun(filePath string, src, out []byte, results []gosh.Result) {
+	if *flagPostRun == "" {
+		return
+	}
+	summaryMu.Lock()
+	defer summaryMu.Unlock()
+	summaryFiles++
+	if out != nil && len(results) > 0 && !bytes.Equal(src, out) {
+		summaryChanged = append(summaryChanged, filePath)
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			summaryFailed++
+		}
+	}
+}
+
+// postRun runs the -post-run command, if any, after a run
+// that will exit with status code. The command inherits gosh's
+// environment, with a summary of the run in these variables:
+//
+//	GOSH_STATUS   gosh's exit status
+//	GOSH_FILES    the number of files processed
+//	GOSH_CHANGED  the files whose output changed, one per line
+//	GOSH_FAILED   the number of commands that failed
+func postRun(code int) error {
+	if *flagPostRun == "" {
+		return nil
+	}
+	summaryMu.Lock()
+	changed := slices.Clone(summaryChanged)
+	slices.Sort(changed)
+	env := append(os.Environ(),
+		fmt.Sprintf("GOSH_STATUS=%d", code),
+		fmt.Sprintf("GOSH_FILES=%d", summaryFiles),
+		"GOSH_CHANGED="+strings.Join(changed, "\n"),
+		fmt.Sprintf("GOSH_FAILED=%d", summaryFailed),
+	)
+	summaryMu.Unlock()
+
+	shell := *flagShell
+	if shell == "" {
+		shell = "sh"
+	}
+	cmd := exec.Command(shell, "-c", *flagPostRun)
+	cmd.Env = env
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("-post-run: %v", err)
+	}
+	return nil
+}
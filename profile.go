@@ -0,0 +1,82 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	rtrace "runtime/trace"
+)
+
+// The files that -cpuprofile and -trace write, while they're running.
+var cpuProfile, traceFile *os.File
+
+// startProfiling starts the CPU profile and execution trace
+// requested by -cpuprofile and -trace.
+func startProfiling() error {
+	if *flagCPUProf != "" {
+		f, err := os.Create(*flagCPUProf)
+		if err != nil {
+			return err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			f.Close()
+			return err
+		}
+		cpuProfile = f
+	}
+	if *flagTrace != "" {
+		f, err := os.Create(*flagTrace)
+		if err != nil {
+			return err
+		}
+		if err := rtrace.Start(f); err != nil {
+			f.Close()
+			return err
+		}
+		traceFile = f
+	}
+	return nil
+}
+
+// stopProfiling stops the CPU profile and execution trace, if running,
+// and writes the heap profile requested by -memprofile.
+func stopProfiling() {
+	if cpuProfile != nil {
+		pprof.StopCPUProfile()
+		if err := cpuProfile.Close(); err != nil {
+			slog.Error(err.Error())
+		}
+		cpuProfile = nil
+	}
+	if traceFile != nil {
+		rtrace.Stop()
+		if err := traceFile.Close(); err != nil {
+			slog.Error(err.Error())
+		}
+		traceFile = nil
+	}
+	if *flagMemProf != "" {
+		if err := writeHeapProfile(*flagMemProf); err != nil {
+			slog.Error(err.Error())
+		}
+	}
+}
+
+// writeHeapProfile writes a heap profile to the file at path.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	runtime.GC() // get up-to-date statistics
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
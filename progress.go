@@ -0,0 +1,123 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// A progress tracks the files and commands processed during a run,
+// and reports them on standard error.
+// A nil *progress tracks nothing.
+type progress struct {
+	start time.Time
+	files int // total number of files
+
+	filesDone atomic.Int64
+	running   atomic.Int64
+	completed atomic.Int64
+	failed    atomic.Int64
+	cmdTime   atomic.Int64 // combined command running time, in nanoseconds
+
+	// If standard error is a terminal, a status line
+	// is redrawn until done is closed.
+	done   chan struct{}
+	wg     sync.WaitGroup
+	paused atomic.Bool
+}
+
+// startProgress starts tracking a run that processes files files.
+func startProgress(files int) *progress {
+	p := &progress{start: time.Now(), files: files, done: make(chan struct{})}
+	if isTerminal(os.Stderr) {
+		p.wg.Add(1)
+		go p.live()
+	}
+	return p
+}
+
+func (p *progress) fileDone() {
+	if p != nil {
+		p.filesDone.Add(1)
+	}
+}
+
+// command records that a command started running.
+// The returned function records that it finished.
+func (p *progress) command() func(err error) {
+	if p == nil {
+		return func(error) {}
+	}
+	p.running.Add(1)
+	start := time.Now()
+	return func(err error) {
+		p.cmdTime.Add(int64(time.Since(start)))
+		p.running.Add(-1)
+		if err != nil {
+			p.failed.Add(1)
+		} else {
+			p.completed.Add(1)
+		}
+	}
+}
+
+func (p *progress) live() {
+	defer p.wg.Done()
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			fmt.Fprint(os.Stderr, "\r\033[K")
+			return
+		case <-t.C:
+			if p.paused.Load() {
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "\r\033[Kgosh: %d/%d files, %d commands running, %d completed, %d failed",
+				p.filesDone.Load(), p.files, p.running.Load(), p.completed.Load(), p.failed.Load())
+		}
+	}
+}
+
+// pause stops redrawing the status line, and clears it,
+// so that gosh can ask the user a question.
+// The returned function resumes redrawing it.
+func (p *progress) pause() func() {
+	if p == nil {
+		return func() {}
+	}
+	p.paused.Store(true)
+	fmt.Fprint(os.Stderr, "\r\033[K")
+	return func() { p.paused.Store(false) }
+}
+
+// finish stops the status line and prints a summary of the run.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "files processed\t%d\n", p.filesDone.Load())
+	fmt.Fprintf(w, "commands completed\t%d\n", p.completed.Load())
+	fmt.Fprintf(w, "commands failed\t%d\n", p.failed.Load())
+	fmt.Fprintf(w, "command time\t%v\n", time.Duration(p.cmdTime.Load()).Round(time.Millisecond))
+	fmt.Fprintf(w, "total time\t%v\n", time.Since(p.start).Round(time.Millisecond))
+	w.Flush()
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProgress(t *testing.T) {
+	// Standard error isn't a terminal, so only the summary is printed.
+	defer func(old *os.File) { os.Stderr = old }(os.Stderr)
+	f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Stderr = f
+
+	p := startProgress(2)
+	p.command()(nil)
+	p.command()(errors.New("exit status 1"))
+	p.command()(nil)
+	p.fileDone()
+	p.finish()
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	summary := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if i := strings.LastIndex(line, "  "); i >= 0 {
+			summary[strings.TrimSpace(line[:i])] = strings.TrimSpace(line[i:])
+		}
+	}
+	for name, want := range map[string]string{
+		"files processed":    "1",
+		"commands completed": "2",
+		"commands failed":    "1",
+	} {
+		if got := summary[name]; got != want {
+			t.Errorf("summary has %s %q, want %q:\n%s", name, got, want, data)
+		}
+	}
+	for _, name := range []string{"command time", "total time"} {
+		if _, ok := summary[name]; !ok {
+			t.Errorf("summary has no %s:\n%s", name, data)
+		}
+	}
+
+	// A nil *progress tracks nothing.
+	p = nil
+	p.command()(nil)
+	p.fileDone()
+	p.finish()
+}
@@ -0,0 +1,71 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// writeQuickfix writes a report of files to w in the
+// "file:line:col: message" form understood by editors,
+// with a line for each command that failed or, with -check,
+// has stale output, and for each file that couldn't be processed.
+func writeQuickfix(w io.Writer, files []reportFile) error {
+	for _, f := range files {
+		name := relPath(f.name)
+		for _, r := range f.results {
+			var msg string
+			switch {
+			case r.Err != nil:
+				msg = quickfixMessage(&r)
+			case *flagCheck && isStale(&f, &r):
+				msg = fmt.Sprintf("command %q output is stale", r.Prompt)
+			default:
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "%s:%d:%d: %s\n", name, r.Pos.Line, r.Pos.Column, msg); err != nil {
+				return err
+			}
+		}
+		if f.err != nil {
+			msg := firstLine(f.err.Error())
+			if !strings.HasPrefix(msg, f.name+":") {
+				msg = fmt.Sprintf("%s:1:1: %s", name, msg)
+			} else {
+				msg = name + strings.TrimPrefix(msg, f.name)
+			}
+			if _, err := fmt.Fprintln(w, msg); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// quickfixMessage returns a one-line description
+// of why the command of r failed.
+func quickfixMessage(r *gosh.Result) string {
+	var ce *gosh.CommandError
+	if !errors.As(r.Err, &ce) {
+		// Other errors start with the command's position.
+		return firstLine(strings.TrimPrefix(r.Err.Error(), r.Pos.String()+": "))
+	}
+	msg := fmt.Sprintf("command %q failed: %v", r.Prompt, ce.Err)
+	if stderr := firstLine(strings.TrimSpace(string(ce.Stderr))); stderr != "" {
+		msg += ": " + stderr
+	}
+	return msg
+}
+
+// firstLine returns the first line of s.
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// A reportFile records the results of processing a file,
+// for the report selected by -format.
+type reportFile struct {
+	name    string
+	results []gosh.Result
+	changed bool  // whether processing changed the file
+	err     error // error processing the file, if not from a command
+}
+
+var (
+	reportMu    sync.Mutex
+	reportFiles []reportFile
+)
+
+// addReport records the results of processing filePath,
+// and whether they changed it. err is the error returned
+// by processing it, if any.
+func addReport(filePath string, results []gosh.Result, changed bool, err error) {
+	for _, r := range results {
+		if r.Err != nil && errors.Is(err, r.Err) {
+			err = nil // reported with the command
+			break
+		}
+	}
+	if len(results) == 0 && err == nil {
+		return
+	}
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	reportFiles = append(reportFiles, reportFile{filePath, results, changed, err})
+}
+
+// validFormat reports whether format is a known -format report format.
+func validFormat(format string) bool {
+	switch format {
+	case "junit", "sarif", "quickfix":
+		return true
+	}
+	return false
+}
+
+// writeReport prints the report selected by -format
+// for the files recorded by addReport.
+func writeReport() error {
+	reportMu.Lock()
+	defer reportMu.Unlock()
+	sort.Slice(reportFiles, func(i, j int) bool {
+		return reportFiles[i].name < reportFiles[j].name
+	})
+	switch *flagFormat {
+	case "junit":
+		return writeJUnit(os.Stdout, reportFiles)
+	case "sarif":
+		return writeSARIF(os.Stdout, reportFiles)
+	case "quickfix":
+		return writeQuickfix(os.Stderr, reportFiles)
+	}
+	return fmt.Errorf("unknown report format %q", *flagFormat)
+}
+
+// isStale reports whether r, a result in f, has stale output:
+// it changed the source text, and so the file, once formatted.
+func isStale(f *reportFile, r *gosh.Result) bool {
+	return f.changed && r.Err == nil && r.New != r.Old
+}
+
+// failureText returns a description of why the command of r failed,
+// including its output and any error output.
+func failureText(r *gosh.Result) string {
+	text := string(r.Output)
+	var ce *gosh.CommandError
+	if errors.As(r.Err, &ce) {
+		text += string(ce.Stderr)
+	}
+	return text
+}
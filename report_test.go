@@ -0,0 +1,97 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// A fresh file has a command in a function body, which gofmt indents.
+const freshGo = "package p\n\n//gosh:ok\n\nfunc f() {\n\t/* # echo one\n\tone\n\t*/\n}\n"
+
+func TestCheckFormats(t *testing.T) {
+	defer func(check, refresh bool, format string) {
+		*flagCheck, *flagRefresh, *flagFormat = check, refresh, format
+		stale.Store(false)
+		reportFiles = nil
+	}(*flagCheck, *flagRefresh, *flagFormat)
+	defer func(old *os.File) { os.Stdout = old }(os.Stdout)
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer devNull.Close()
+	os.Stdout = devNull // for the diffs
+	*flagCheck, *flagRefresh = true, true
+
+	dir := t.TempDir()
+	for _, wantStale := range []bool{false, true} {
+		src := freshGo
+		if wantStale {
+			src = strings.Replace(src, "\tone\n", "\ttwo\n", 1)
+		}
+		file := filepath.Join(dir, "e.go")
+		if err := os.WriteFile(file, []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+		for _, format := range []string{"", "quickfix", "junit", "sarif"} {
+			*flagFormat = format
+			stale.Store(false)
+			reportFiles = nil
+			if err := processFile(file); err != nil {
+				t.Fatalf("-format=%q: %v", format, err)
+			}
+			if got := stale.Load(); got != wantStale {
+				t.Errorf("stale file %v, -format=%q: -check found it stale: %v", wantStale, format, got)
+			}
+
+			var buf bytes.Buffer
+			var mark string // in the report of a stale command
+			switch format {
+			case "":
+				continue
+			case "quickfix":
+				err, mark = writeQuickfix(&buf, reportFiles), `command "echo one" output is stale`
+			case "junit":
+				err, mark = writeJUnit(&buf, reportFiles), `message="command output is stale"`
+			case "sarif":
+				err, mark = writeSARIF(&buf, reportFiles), `"ruleId": "gosh-stale"`
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(buf.String(), mark); got != wantStale {
+				t.Errorf("stale file %v, -format=%q: reported stale output: %v\n%s", wantStale, format, got, buf.String())
+			}
+		}
+	}
+}
+
+func TestSARIFStale(t *testing.T) {
+	defer func(old bool) { *flagCheck = old }(*flagCheck)
+
+	files := []reportFile{{
+		name:    "e.go",
+		results: []gosh.Result{{Command: gosh.Command{Prompt: "echo one"}, Old: "/* # echo one\n*/", New: "/* # echo one\none\n*/"}},
+		changed: true,
+	}}
+	for _, check := range []bool{false, true} {
+		*flagCheck = check
+		var buf bytes.Buffer
+		if err := writeSARIF(&buf, files); err != nil {
+			t.Fatal(err)
+		}
+		// Stale output is only a problem with -check.
+		if got := strings.Contains(buf.String(), `"ruleId": "gosh-stale"`); got != check {
+			t.Errorf("-check=%v: reported stale output: %v", check, got)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// A runnerRequest is the JSON given on standard input
+// to the -runner program, describing the command to run.
+type runnerRequest struct {
+	Command string   // the command's text
+	File    string   // the file containing the command
+	Line    int      // the line of the command in File
+	Name    string   `json:",omitempty"` // as given by "gosh:name"
+	Dir     string   // the working directory
+	Shell   string   // the shell the command is written for, like "sh"
+	Env     []string // the command's entire environment, without gosh's own
+	Stderr  bool     `json:",omitempty"` // whether to merge standard error into the output
+	Timeout float64  `json:",omitempty"` // how long the command may run, in seconds
+	Image   string   `json:",omitempty"` // as given by "gosh:image"
+	Host    string   `json:",omitempty"` // as given by "gosh:host"
+
+	// The limits for each process the command starts, if any,
+	// as set by -cpu-limit and -mem-limit or "gosh:limit".
+	CPULimit float64 `json:",omitempty"` // CPU time, in seconds
+	MemLimit int64   `json:",omitempty"` // virtual memory, in bytes
+
+	// OutputLimit is the longest output gosh accepts, in bytes, if set.
+	OutputLimit int64 `json:",omitempty"`
+}
+
+// A runnerResponse is the JSON printed on standard output
+// by the -runner program, describing the command's result.
+type runnerResponse struct {
+	Output     string // the command's output
+	Stderr     string // the command's standard error
+	ExitStatus int    // the command's exit status
+	Error      string // why the command couldn't be run, if it wasn't
+}
+
+// checkRunner reports an error if -runner is given and c can't be run
+// by it: a session's shell, a filter, or a terminal would run locally.
+func checkRunner(c *gosh.Command) error {
+	if *flagRunner == "" {
+		return nil
+	}
+	switch {
+	case c.Session:
+		return errors.New("-runner can't run commands in a gosh:session")
+	case len(c.Filters) > 0:
+		return errors.New("-runner can't run commands with a gosh:filter")
+	case c.PTY:
+		return errors.New("-runner can't run commands with gosh:pty")
+	}
+	return nil
+}
+
+// runCommand runs c, with the -runner program if given.
+func runCommand(ctx context.Context, c *gosh.Command) ([]byte, error) {
+	if *flagRunner == "" {
+		return c.Run(ctx)
+	}
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	dir := c.Dir
+	if dir == "" {
+		var err error
+		if dir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	env := c.Environ
+	if env == nil {
+		env = os.Environ()
+	}
+	shell := c.Shell
+	if shell == "" {
+		shell = "sh"
+	}
+	req, err := json.Marshal(runnerRequest{
+		Command: c.Prompt,
+		File:    c.Pos.Filename,
+		Line:    c.Pos.Line,
+		Name:    c.Name,
+		Dir:     dir,
+		Shell:   shell,
+		Env:     append(env[:len(env):len(env)], c.Env...),
+		Stderr:  c.Stderr,
+		Timeout: c.Timeout.Seconds(),
+		Image:   c.Image,
+		Host:    c.Host,
+
+		CPULimit:    c.CPULimit.Seconds(),
+		MemLimit:    c.MemLimit,
+		OutputLimit: c.OutputLimit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, *flagRunner)
+	cmd.Stdin = bytes.NewReader(req)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if c.Timeout > 0 && ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("timed out after %v", c.Timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			err = fmt.Errorf("%v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("-runner: %v", err)
+	}
+	var resp runnerResponse
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("-runner: invalid response: %v", err)
+	}
+	switch {
+	case resp.Error != "":
+		return nil, errors.New(resp.Error)
+	case c.OutputLimit > 0 && int64(len(resp.Output)) > c.OutputLimit:
+		return nil, fmt.Errorf("output is longer than the limit of %d bytes", c.OutputLimit)
+	case resp.ExitStatus != 0:
+		return []byte(resp.Output), &gosh.ExitError{Code: resp.ExitStatus, Stderr: []byte(resp.Stderr)}
+	}
+	return []byte(resp.Output), nil
+}
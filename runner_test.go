@@ -0,0 +1,36 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+func TestCheckRunner(t *testing.T) {
+	defer func(old string) { *flagRunner = old }(*flagRunner)
+
+	tests := []struct {
+		name string
+		cmd  gosh.Command
+		ok   bool
+	}{
+		{"plain", gosh.Command{Prompt: "date"}, true},
+		{"session", gosh.Command{Prompt: "date", Session: true}, false},
+		{"filter", gosh.Command{Prompt: "date", Filters: []string{"sort"}}, false},
+		{"pty", gosh.Command{Prompt: "date", PTY: true}, false},
+	}
+	for _, tt := range tests {
+		*flagRunner = ""
+		if err := checkRunner(&tt.cmd); err != nil {
+			t.Errorf("%s: without -runner: %v", tt.name, err)
+		}
+		*flagRunner = "runner"
+		if err := checkRunner(&tt.cmd); (err == nil) != tt.ok {
+			t.Errorf("%s: checkRunner = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// The -format=sarif report follows the Static Analysis Results
+// Interchange Format, version 2.1.0, as accepted by GitHub code scanning.
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name           string      `json:"name"`
+		InformationURI string      `json:"informationUri"`
+		Rules          []sarifRule `json:"rules"`
+	} `json:"driver"`
+}
+
+type sarifRule struct {
+	ID               string       `json:"id"`
+	ShortDescription sarifMessage `json:"shortDescription"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region *sarifRegion `json:"region,omitempty"`
+	} `json:"physicalLocation"`
+}
+
+type sarifRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+	EndLine     int `json:"endLine,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+// SARIF rule IDs.
+const (
+	sarifFailed = "gosh-failed"
+	sarifStale  = "gosh-stale"
+	sarifError  = "gosh-error"
+)
+
+// writeSARIF writes a SARIF report of files to w,
+// with a result for each command that failed or, with -check,
+// has stale output, and for each file that couldn't be processed.
+func writeSARIF(w io.Writer, files []reportFile) error {
+	var run sarifRun
+	run.Tool.Driver.Name = "gosh"
+	run.Tool.Driver.InformationURI = "https://github.com/mdempsky/gosh"
+	run.Tool.Driver.Rules = []sarifRule{
+		{sarifFailed, sarifMessage{"gosh command failed"}},
+		{sarifStale, sarifMessage{"gosh command output is stale"}},
+		{sarifError, sarifMessage{"gosh could not process the file"}},
+	}
+	run.Results = []sarifResult{}
+
+	for _, f := range files {
+		uri := sarifURI(f.name)
+		for _, r := range f.results {
+			res := sarifResult{Level: "error"}
+			switch {
+			case r.Err != nil:
+				res.RuleID = sarifFailed
+				res.Message.Text = fmt.Sprintf("gosh command %q failed: %v", r.Prompt, r.Err)
+			case *flagCheck && isStale(&f, &r):
+				res.RuleID = sarifStale
+				res.Level = "warning"
+				res.Message.Text = fmt.Sprintf("gosh command %q output is stale", r.Prompt)
+			default:
+				continue
+			}
+			var loc sarifLocation
+			loc.PhysicalLocation.ArtifactLocation.URI = uri
+			loc.PhysicalLocation.Region = &sarifRegion{
+				StartLine:   r.Pos.Line,
+				StartColumn: r.Pos.Column,
+				EndLine:     r.Command.End.Line,
+				EndColumn:   r.Command.End.Column,
+			}
+			res.Locations = []sarifLocation{loc}
+			run.Results = append(run.Results, res)
+		}
+		if f.err != nil {
+			var loc sarifLocation
+			loc.PhysicalLocation.ArtifactLocation.URI = uri
+			run.Results = append(run.Results, sarifResult{
+				RuleID:    sarifError,
+				Level:     "error",
+				Message:   sarifMessage{f.err.Error()},
+				Locations: []sarifLocation{loc},
+			})
+		}
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(sarifLog{
+		Schema:  sarifSchema,
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
+
+// sarifURI returns the artifact URI for the file name,
+// relative to the current directory if it's within it.
+func sarifURI(name string) string {
+	return filepath.ToSlash(relPath(name))
+}
+
+// relPath returns the file name relative to the current directory,
+// if it's within it, or name itself otherwise.
+func relPath(name string) string {
+	if wd, err := filepath.Abs("."); err == nil {
+		if rel, err := filepath.Rel(wd, name); err == nil && !strings.HasPrefix(rel, "..") {
+			return rel
+		}
+	}
+	return name
+}
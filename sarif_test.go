@@ -0,0 +1,54 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+)
+
+func TestSARIF(t *testing.T) {
+	defer func(old bool) { *flagCheck = old }(*flagCheck)
+	*flagCheck = true
+	var buf bytes.Buffer
+	if err := writeSARIF(&buf, testReportFiles()); err != nil {
+		t.Fatal(err)
+	}
+	var log sarifLog
+	if err := json.Unmarshal(buf.Bytes(), &log); err != nil {
+		t.Fatalf("%v\n%s", err, buf.Bytes())
+	}
+	if log.Version != "2.1.0" || len(log.Runs) != 1 {
+		t.Fatalf("version %q with %d runs, want 2.1.0 with 1:\n%s", log.Version, len(log.Runs), buf.Bytes())
+	}
+
+	// The fresh command isn't reported.
+	type result struct {
+		rule, level, uri string
+		line             int
+	}
+	want := []result{
+		{sarifStale, "warning", "a.go", 7},
+		{sarifFailed, "error", "a.go", 9},
+		{sarifError, "error", "b.txt", 0},
+	}
+	var got []result
+	for _, r := range log.Runs[0].Results {
+		res := result{rule: r.RuleID, level: r.Level}
+		if len(r.Locations) == 1 {
+			loc := r.Locations[0].PhysicalLocation
+			res.uri = loc.ArtifactLocation.URI
+			if loc.Region != nil {
+				res.line = loc.Region.StartLine
+			}
+		}
+		got = append(got, res)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("results %+v, want %+v:\n%s", got, want, buf.Bytes())
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// saveHook processes source from standard input for -save-hook,
+// as if it were the file at path, and prints the result.
+// It never runs a command, or a filter: it only fills in output saved
+// by -cache, refreshing trusted commands whose output is cached
+// and leaving the rest alone.
+// On any problem, or if that takes longer than -save-budget,
+// it prints the source unchanged.
+// Either way, it exits successfully, so as not to get in an editor's way.
+func saveHook(path string) {
+	src, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		slog.Debug("save hook: " + err.Error())
+		exit(0)
+	}
+
+	type result struct {
+		out []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		out, err := cachedOnly(path, src)
+		done <- result{out, err}
+	}()
+	out := src
+	select {
+	case r := <-done:
+		if r.err != nil {
+			slog.Debug("save hook: " + r.err.Error())
+		} else {
+			out = r.out
+		}
+	case <-time.After(*flagSaveBudget):
+		slog.Debug("save hook: over budget", "budget", *flagSaveBudget)
+	}
+	os.Stdout.Write(out)
+	exit(0)
+}
+
+// errNotCached reports that a command's output isn't in the cache.
+var errNotCached = errors.New("output not cached")
+
+// cachedOnly processes src, the contents of the file at path,
+// using only the output of the commands in the cache.
+func cachedOnly(path string, src []byte) ([]byte, error) {
+	filePath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(filePath); err == nil && fi.IsDir() {
+		filePath = filepath.Join(filePath, "stdin.go")
+	}
+	if !*flagTrustAll {
+		// As when they run, the commands must be trusted: their
+		// cached output may be from running them for another file.
+		// The store is read here, so that problems with it
+		// leave the source unchanged.
+		t, err := openTrust()
+		if err != nil {
+			return nil, err
+		}
+		if err := t.check(filePath, src); err != nil {
+			return nil, err
+		}
+	}
+	if outputCache == nil {
+		if outputCache, err = openCache(); err != nil {
+			return nil, err
+		}
+	}
+
+	lookup := func(c *gosh.Command) ([]byte, error) {
+		key, err := cacheKey(c)
+		if err != nil {
+			return nil, err
+		}
+		output, ok := outputCache.get(key)
+		if !ok {
+			return nil, errNotCached
+		}
+		return output, nil
+	}
+	opts, err := options(filePath)
+	if err != nil {
+		return nil, err
+	}
+	opts.Refresh = true
+	selected := selector()
+	opts.Select = func(c *gosh.Command) bool {
+		if selected != nil && !selected(c) {
+			return false
+		}
+		// The output of commands in sessions, or that read
+		// other commands' output, depends on more than the cache key.
+		// And the output is piped through filters after it's cached,
+		// which would have to run.
+		if c.Session || len(c.After) > 0 || len(c.Filters) > 0 {
+			return false
+		}
+		_, err := lookup(c)
+		return err == nil
+	}
+	opts.Run = func(ctx context.Context, c *gosh.Command) ([]byte, error) {
+		return lookup(c)
+	}
+	out, _, err := gosh.Process(mainCtx, src, opts)
+	if err != nil {
+		return nil, err
+	}
+	if out == nil {
+		return src, nil
+	}
+	return out, nil
+}
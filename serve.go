@@ -0,0 +1,206 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// A serveRequest is a request to the -serve daemon.
+// Requests and responses are JSON objects, one per line.
+type serveRequest struct {
+	Files    []string // files to process
+	Packages []string // package patterns, like "./...", whose files to process
+	Src      *string  // with a single file, its contents, if not as saved
+}
+
+// A serveResponse reports the edits for each file of a request,
+// in the -json format, or why the request failed.
+type serveResponse struct {
+	Files []jsonFile
+	Error string `json:",omitempty"`
+}
+
+// serving records whether gosh is running as a daemon,
+// and so mustn't ask the user anything.
+var serving bool
+
+// A server is the -serve daemon. It keeps the files of the packages
+// it has loaded, reloading them when their directories change.
+type server struct {
+	mu       sync.Mutex // serializes requests
+	packages map[string]*loadedPackages
+}
+
+// loadedPackages records the files loaded for package patterns,
+// and the modification times of their directories then.
+type loadedPackages struct {
+	files []string
+	dirs  map[string]time.Time
+}
+
+// serve runs the -serve daemon, listening on the unix socket path,
+// until gosh is interrupted.
+func serve(path string) error {
+	serving = true
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		// Left behind by an earlier daemon.
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return errors.New("-serve: " + path + " is in use")
+		}
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	go func() {
+		<-mainCtx.Done()
+		l.Close()
+	}()
+	slog.Info("serving", "socket", path)
+
+	s := &server{packages: make(map[string]*loadedPackages)}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if mainCtx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+// handle answers the requests made on conn until it's closed.
+func (s *server) handle(conn net.Conn) {
+	defer conn.Close()
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(nil, 64<<20)
+	enc := json.NewEncoder(conn)
+	for sc.Scan() {
+		var req serveRequest
+		var resp serveResponse
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			resp.Error = "invalid request: " + err.Error()
+		} else if resp.Files, err = s.do(&req); err != nil {
+			resp.Error = err.Error()
+		}
+		if resp.Files == nil {
+			resp.Files = []jsonFile{}
+		}
+		if err := enc.Encode(resp); err != nil {
+			slog.Debug("serve: " + err.Error())
+			return
+		}
+	}
+}
+
+// do processes the files of req, returning their edits.
+func (s *server) do(req *serveRequest) ([]jsonFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Src != nil && (len(req.Files) != 1 || len(req.Packages) > 0) {
+		return nil, errors.New("Src requires exactly one file")
+	}
+	files, err := s.files(req)
+	if err != nil {
+		return nil, err
+	}
+	if !*flagTrustAll {
+		// The trusted commands may have changed since the last request.
+		if trust, err = openTrust(); err != nil {
+			return nil, err
+		}
+	}
+
+	results := make([]jsonFile, len(files))
+	var g errgroup.Group
+	if *flagFileJobs > 0 {
+		g.SetLimit(*flagFileJobs)
+	}
+	for i, filePath := range files {
+		g.Go(func() error {
+			var data []byte
+			var err error
+			if req.Src != nil {
+				data = []byte(*req.Src)
+			} else if data, err = readFile(filePath); err != nil {
+				results[i] = jsonFile{File: filePath, Edits: []jsonEdit{}, Error: err.Error()}
+				return nil
+			}
+			_, res, err := process(filePath, data)
+			results[i] = jsonFileOf(filePath, res, err)
+			return nil
+		})
+	}
+	g.Wait()
+	return slices.DeleteFunc(results, func(f jsonFile) bool {
+		return len(f.Edits) == 0 && f.Error == ""
+	}), nil
+}
+
+// files returns the files named by req, loading its packages
+// unless they were loaded before and their directories haven't changed.
+func (s *server) files(req *serveRequest) ([]string, error) {
+	var files []string
+	for _, file := range req.Files {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, abs)
+	}
+	if len(req.Packages) == 0 {
+		return files, nil
+	}
+
+	key := strings.Join(req.Packages, "\x00")
+	if p := s.packages[key]; p != nil && !p.changed() {
+		return append(files, p.files...), nil
+	}
+	loaded, err := loadFiles(req.Packages)
+	if err != nil {
+		return nil, err
+	}
+	p := &loadedPackages{files: loaded, dirs: make(map[string]time.Time)}
+	for _, file := range loaded {
+		dir := filepath.Dir(file)
+		if fi, err := os.Stat(dir); err == nil {
+			p.dirs[dir] = fi.ModTime()
+		}
+	}
+	s.packages[key] = p
+	return append(files, loaded...), nil
+}
+
+// changed reports whether files may have been added to or removed from
+// the directories of p since it was loaded.
+func (p *loadedPackages) changed() bool {
+	for dir, mtime := range p.dirs {
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.ModTime().Equal(mtime) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServe(t *testing.T) {
+	defer func(old bool) { *flagTrustAll = old }(*flagTrustAll)
+	*flagTrustAll = true
+
+	client, conn := net.Pipe()
+	defer client.Close()
+	s := &server{packages: make(map[string]*loadedPackages)}
+	go s.handle(conn)
+	dec := json.NewDecoder(client)
+	do := func(req string) serveResponse {
+		t.Helper()
+		if _, err := io.WriteString(client, req+"\n"); err != nil {
+			t.Fatal(err)
+		}
+		var resp serveResponse
+		if err := dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	request := func(req serveRequest) serveResponse {
+		t.Helper()
+		data, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return do(string(data))
+	}
+
+	if resp := do("{"); !strings.HasPrefix(resp.Error, "invalid request") {
+		t.Errorf("invalid request: got error %q", resp.Error)
+	}
+	src := "#gosh:ok\n# % echo hi\n"
+	if resp := request(serveRequest{Files: []string{"a.sh", "b.sh"}, Src: &src}); resp.Error != "Src requires exactly one file" {
+		t.Errorf("Src with two files: got error %q", resp.Error)
+	}
+
+	// The file's contents come from the request, not the file system.
+	file := filepath.Join(t.TempDir(), "run.sh")
+	resp := request(serveRequest{Files: []string{file}, Src: &src})
+	if resp.Error != "" || len(resp.Files) != 1 {
+		t.Fatalf("request with Src: got %+v, want the edits for %s", resp, file)
+	}
+	if f := resp.Files[0]; f.File != file || f.Error != "" || len(f.Edits) != 1 || f.Edits[0].Command != "echo hi" || !strings.Contains(f.Edits[0].New, "hi\n") {
+		t.Errorf("request with Src: got %+v, want the output of echo hi", f)
+	}
+	resp = request(serveRequest{Files: []string{file}})
+	if len(resp.Files) != 1 || resp.Files[0].Error == "" {
+		t.Errorf("request for a missing file: got %+v, want an error for it", resp)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// A commandStat records how long a command took, for -slowest and -stats.
+type commandStat struct {
+	File     string
+	Line     int
+	Command  string
+	Name     string  `json:",omitempty"`
+	Duration float64 // in seconds
+	Error    string  `json:",omitempty"`
+}
+
+var (
+	statsMu sync.Mutex
+	stats   []commandStat
+)
+
+// recordStat records that c finished running after d, with the error err,
+// if -slowest or -stats is given.
+func recordStat(c *gosh.Command, d time.Duration, err error) {
+	if *flagSlowest == 0 && *flagStats == "" {
+		return
+	}
+	s := commandStat{
+		File:     c.Pos.Filename,
+		Line:     c.Pos.Line,
+		Command:  c.Prompt,
+		Name:     c.Name,
+		Duration: d.Seconds(),
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	stats = append(stats, s)
+}
+
+// reportStats prints the slowest commands for -slowest,
+// and writes every command's statistics for -stats,
+// both slowest first.
+func reportStats() error {
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	slices.SortStableFunc(stats, func(a, b commandStat) int { return cmp.Compare(b.Duration, a.Duration) })
+
+	if n := min(*flagSlowest, len(stats)); n > 0 {
+		w := tabwriter.NewWriter(os.Stderr, 0, 8, 2, ' ', 0)
+		fmt.Fprintf(w, "slowest commands:\n")
+		for _, s := range stats[:n] {
+			d := time.Duration(s.Duration * float64(time.Second)).Round(time.Millisecond)
+			fmt.Fprintf(w, "  %v\t%s:%d\t%q\n", d, s.File, s.Line, s.Command)
+		}
+		w.Flush()
+	}
+
+	if *flagStats != "" {
+		if stats == nil {
+			stats = []commandStat{}
+		}
+		data, err := json.MarshalIndent(stats, "", "\t")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(*flagStats, append(data, '\n'), 0666)
+	}
+	return nil
+}
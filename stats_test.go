@@ -0,0 +1,72 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+func TestStats(t *testing.T) {
+	defer func(slowest int, file string) { *flagSlowest, *flagStats = slowest, file }(*flagSlowest, *flagStats)
+	defer func(old *os.File) { os.Stderr = old }(os.Stderr)
+	defer func() { stats = nil }()
+	dir := t.TempDir()
+	*flagSlowest, *flagStats = 1, filepath.Join(dir, "stats.json")
+	stderr, err := os.Create(filepath.Join(dir, "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stderr.Close()
+	os.Stderr = stderr
+
+	at := func(line int) token.Position { return token.Position{Filename: "a.go", Line: line} }
+	recordStat(&gosh.Command{Prompt: "echo fast", Pos: at(3)}, time.Second, nil)
+	recordStat(&gosh.Command{Prompt: "sleep 2", Pos: at(7), Name: "slow"}, 2*time.Second, nil)
+	recordStat(&gosh.Command{Prompt: "false", Pos: at(9)}, time.Millisecond, errors.New("exit status 1"))
+	if err := reportStats(); err != nil {
+		t.Fatal(err)
+	}
+
+	// -stats lists every command, slowest first.
+	data, err := os.ReadFile(*flagStats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []commandStat
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []commandStat{
+		{File: "a.go", Line: 7, Command: "sleep 2", Name: "slow", Duration: 2},
+		{File: "a.go", Line: 3, Command: "echo fast", Duration: 1},
+		{File: "a.go", Line: 9, Command: "false", Duration: 0.001, Error: "exit status 1"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("-stats has %d commands, want %d:\n%s", len(got), len(want), data)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("-stats command %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// -slowest prints just the slowest.
+	data, err = os.ReadFile(stderr.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := string(data); !strings.Contains(out, `2s  a.go:7  "sleep 2"`) || strings.Contains(out, "echo fast") {
+		t.Errorf("-slowest 1 printed:\n%s", out)
+	}
+}
@@ -0,0 +1,41 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// processStdin processes source read from standard input, for -srcdir,
+// as if it were the file at path, and prints the result.
+// If path is a directory, the source is taken to be a Go file in it,
+// as for goimports.
+func processStdin(path string) error {
+	filePath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(filePath); err == nil && fi.IsDir() {
+		filePath = filepath.Join(filePath, "stdin.go")
+	}
+	src, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	out, results, err := process(filePath, src)
+	if out == nil {
+		// Write the source back unchanged, as filters must.
+		out = src
+	}
+	if _, werr := os.Stdout.Write(out); werr != nil {
+		return werr
+	}
+	if err != nil {
+		return err
+	}
+	return emitOutputs(results)
+}
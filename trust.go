@@ -0,0 +1,318 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+// A trustStore records the commands that the user trusts to run,
+// as approved by "gosh allow" or when asked. It maps the absolute
+// name of each file to the set of hashes of its trusted commands.
+type trustStore struct {
+	path string
+
+	mu    sync.Mutex
+	files map[string]map[string]bool
+}
+
+// trust is the user's trust store, unless -trust-all is given.
+var trust *trustStore
+
+// openTrust reads the user's trust store,
+// in the user's configuration directory.
+func openTrust() (*trustStore, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	t := &trustStore{
+		path:  filepath.Join(dir, "gosh", "trusted"),
+		files: make(map[string]map[string]bool),
+	}
+	data, err := os.ReadFile(t.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return t, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		hash, name, ok := strings.Cut(sc.Text(), " ")
+		if ok {
+			t.add(name, hash)
+		}
+	}
+	return t, sc.Err()
+}
+
+// add records that the command with the given hash
+// in the file name is trusted. t.mu must be held, if needed.
+func (t *trustStore) add(name, hash string) {
+	if t.files[name] == nil {
+		t.files[name] = make(map[string]bool)
+	}
+	t.files[name][hash] = true
+}
+
+// save writes t back to the user's configuration directory.
+func (t *trustStore) save() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	names := make([]string, 0, len(t.files))
+	for name := range t.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		hashes := make([]string, 0, len(t.files[name]))
+		for hash := range t.files[name] {
+			hashes = append(hashes, hash)
+		}
+		sort.Strings(hashes)
+		for _, hash := range hashes {
+			fmt.Fprintf(&buf, "%s %s\n", hash, name)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(t.path), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(t.path), "trusted.*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), t.path)
+}
+
+// fileCommands returns the commands in src, the contents of filePath,
+// that are allowed to run, including those that have run before.
+func fileCommands(filePath string, src []byte) ([]*gosh.Command, error) {
+	// The options are those the commands run with,
+	// so that their settings are part of their hashes.
+	opts, err := options(filePath)
+	if err != nil {
+		return nil, err
+	}
+	opts.Refresh = true
+	// Processing the file reports its directives' problems.
+	opts.Trace = nil
+	opts.Warn = nil
+	var cmds []*gosh.Command
+	opts.Select = func(c *gosh.Command) bool {
+		cmds = append(cmds, c)
+		return false
+	}
+	_, _, err = gosh.Process(context.Background(), src, opts)
+	return cmds, err
+}
+
+// commandHash returns the hash of c recorded in the trust store.
+// It covers everything that changes what c runs and how: its filters,
+// which run too, and its settings, as given by commandSettings.
+// Settings left unset don't change the hash, so that trust in commands
+// without them lasts when such settings are added to gosh.
+func commandHash(c *gosh.Command) string {
+	var b strings.Builder
+	b.WriteString(c.Prompt)
+	for _, f := range c.Filters {
+		b.WriteString("\n| " + f)
+	}
+	for _, s := range commandSettings(c) {
+		b.WriteString("\n" + s)
+	}
+	h := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(h[:])
+}
+
+// commandSettings returns the settings of c that are set,
+// like "shell bash", that change what c runs and how:
+// its shell, environment, limits, and so on,
+// whether set by directives or by the configuration.
+func commandSettings(c *gosh.Command) []string {
+	var settings []string
+	setting := func(name string, value any) {
+		if !reflect.ValueOf(value).IsZero() {
+			settings = append(settings, fmt.Sprintf("%s %v", name, value))
+		}
+	}
+	setting("dir", c.Dir)
+	setting("shell", c.Shell)
+	setting("user", *flagUser)
+	setting("session", c.Session)
+	setting("host", c.Host)
+	setting("image", c.Image)
+	setting("output", c.Output)
+	setting("pty", c.PTY)
+	setting("cols", c.PTYCols)
+	setting("rows", c.PTYRows)
+	setting("timeout", c.Timeout)
+	setting("cpu", c.CPULimit)
+	setting("mem", c.MemLimit)
+	setting("output-limit", c.OutputLimit)
+	for _, kv := range c.Env {
+		// The -no-network proxy settings only take access away.
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(netEnv, kv) && !slices.Contains(c.Passthrough, name) {
+			setting("env", kv)
+		}
+	}
+	// The values of variables passed through from the user's
+	// environment, like tokens, aren't the file's to show.
+	for _, name := range c.Passthrough {
+		setting("env", name)
+	}
+	return settings
+}
+
+// check reports an error if src, the contents of filePath,
+// has commands that the user hasn't trusted.
+// If it can, it first shows the user the new or changed commands,
+// and asks whether to trust them.
+func (t *trustStore) check(filePath string, src []byte) error {
+	cmds, err := fileCommands(filePath, src)
+	if err != nil || len(cmds) == 0 {
+		return err
+	}
+	abs, err := filepath.Abs(filePath)
+	if err != nil {
+		return err
+	}
+	var untrusted []*gosh.Command
+	t.mu.Lock()
+	for _, c := range cmds {
+		if !t.files[abs][commandHash(c)] {
+			untrusted = append(untrusted, c)
+		}
+	}
+	t.mu.Unlock()
+	if len(untrusted) == 0 {
+		return nil
+	}
+	if serving || !isTerminal(os.Stdin) || !isTerminal(os.Stderr) {
+		return fmt.Errorf("%s: %d new or changed commands not trusted; run \"gosh allow %s\" to trust them", filePath, len(untrusted), filePath)
+	}
+	if !askTrust(filePath, untrusted) {
+		return fmt.Errorf("%s: commands not trusted", filePath)
+	}
+	t.mu.Lock()
+	for _, c := range untrusted {
+		t.add(abs, commandHash(c))
+	}
+	t.mu.Unlock()
+	return t.save()
+}
+
+// askMu serializes questions to the user.
+var askMu sync.Mutex
+
+// askTrust shows the user cmds, the new or changed commands in filePath,
+// and reports whether the user answers that they trust them.
+func askTrust(filePath string, cmds []*gosh.Command) bool {
+	askMu.Lock()
+	defer askMu.Unlock()
+	defer prog.pause()()
+
+	showCommands(os.Stderr, filePath, cmds)
+	fmt.Fprintf(os.Stderr, "Trust them? [y/N] ")
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "y", "yes":
+		return true
+	}
+	return false
+}
+
+// showCommands writes cmds, the new or changed commands in filePath,
+// to w, with everything their hashes cover, so that the user can see
+// what changed even if the command text didn't.
+func showCommands(w io.Writer, filePath string, cmds []*gosh.Command) {
+	fmt.Fprintf(w, "%s has new or changed commands:\n", filePath)
+	for _, c := range cmds {
+		fmt.Fprintf(w, "\t%d: %s\n", c.Pos.Line, c.Prompt)
+		for _, f := range c.Filters {
+			fmt.Fprintf(w, "\t\t| %s\n", f)
+		}
+		for _, s := range commandSettings(c) {
+			fmt.Fprintf(w, "\t\t%s\n", s)
+		}
+	}
+}
+
+// allow implements the "gosh allow" subcommand.
+// It trusts the commands in the named files, and in the files of
+// the packages within the named directories, to run.
+// Commands that are no longer in the files are no longer trusted.
+func allow(args []string) error {
+	if len(args) == 0 {
+		return usagef("usage: gosh allow file|dir...")
+	}
+	var patterns []string
+	for _, arg := range args {
+		if fi, err := os.Stat(arg); err == nil && fi.IsDir() {
+			arg = filepath.ToSlash(filepath.Join(arg, "..."))
+			if !filepath.IsAbs(arg) {
+				arg = "./" + arg
+			}
+		}
+		patterns = append(patterns, arg)
+	}
+	files, err := loadFiles(patterns)
+	if err != nil {
+		return err
+	}
+
+	t, err := openTrust()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		src, err := readFile(file)
+		if err != nil {
+			return err
+		}
+		cmds, err := fileCommands(file, src)
+		if err != nil {
+			return err
+		}
+		delete(t.files, file)
+		if len(cmds) == 0 {
+			continue
+		}
+		for _, c := range cmds {
+			t.add(file, commandHash(c))
+		}
+		fmt.Printf("allowed %d commands in %s\n", len(cmds), file)
+	}
+	return t.save()
+}
@@ -0,0 +1,170 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"go/token"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mdempsky/gosh/pkg/gosh"
+)
+
+func TestCommandHash(t *testing.T) {
+	base := gosh.Command{Prompt: "go doc fmt"}
+	// The hash of a command with no settings is that of its text,
+	// as it was before the settings were hashed,
+	// so that commands stay trusted.
+	const baseHash = "5093cf3462eb1ac1c23820c949a085412096005acc63b28bd872b1b335899b7d"
+
+	tests := []struct {
+		name   string
+		change func(c *gosh.Command)
+	}{
+		{"prompt", func(c *gosh.Command) { c.Prompt = "go doc os" }},
+		{"filter", func(c *gosh.Command) { c.Filters = []string{"head"} }},
+		{"dir", func(c *gosh.Command) { c.Dir = "/tmp" }},
+		{"shell", func(c *gosh.Command) { c.Shell = "bash" }},
+		{"session", func(c *gosh.Command) { c.Session = true }},
+		{"host", func(c *gosh.Command) { c.Host = "example.com" }},
+		{"image", func(c *gosh.Command) { c.Image = "alpine" }},
+		{"output", func(c *gosh.Command) { c.Output = "out.txt" }},
+		{"pty", func(c *gosh.Command) { c.PTY = true }},
+		{"cols", func(c *gosh.Command) { c.PTYCols = 120 }},
+		{"timeout", func(c *gosh.Command) { c.Timeout = time.Minute }},
+		{"cpu", func(c *gosh.Command) { c.CPULimit = time.Second }},
+		{"mem", func(c *gosh.Command) { c.MemLimit = 1 << 30 }},
+		{"output limit", func(c *gosh.Command) { c.OutputLimit = 1 << 20 }},
+		{"env", func(c *gosh.Command) { c.Env = []string{"GOFLAGS=-toolexec=evil"} }},
+	}
+	seen := map[string]string{commandHash(&base): "base"}
+	for _, tt := range tests {
+		c := base
+		tt.change(&c)
+		h := commandHash(&c)
+		if prev, ok := seen[h]; ok {
+			t.Errorf("changing the %s gives the same hash as %s", tt.name, prev)
+		}
+		seen[h] = tt.name
+	}
+
+	if h := commandHash(&base); h != baseHash {
+		t.Errorf("commandHash(%q) = %s, want %s", base.Prompt, h, baseHash)
+	}
+
+	// The -no-network proxy settings only take access away.
+	defer func(old []string) { netEnv = old }(netEnv)
+	netEnv = []string{"HTTP_PROXY=http://127.0.0.1:9"}
+	c := base
+	c.Env = netEnv
+	if commandHash(&c) != commandHash(&base) {
+		t.Errorf("-no-network settings changed the hash")
+	}
+
+	// Variables passed through from the user's environment
+	// are hashed by name, not value.
+	c, c2 := base, base
+	c.Env, c.Passthrough = []string{"TOKEN=one"}, []string{"TOKEN"}
+	c2.Env, c2.Passthrough = []string{"TOKEN=two"}, []string{"TOKEN"}
+	if commandHash(&c) != commandHash(&c2) {
+		t.Errorf("the value of a passed-through variable changed the hash")
+	}
+	if commandHash(&c) == commandHash(&base) {
+		t.Errorf("passing a variable through didn't change the hash")
+	}
+
+	defer func(old string) { *flagUser = old }(*flagUser)
+	*flagUser = "nobody"
+	if commandHash(&base) == baseHash {
+		t.Errorf("-user didn't change the hash")
+	}
+}
+
+func TestShowCommands(t *testing.T) {
+	cmds := []*gosh.Command{
+		{Prompt: "go doc fmt", Pos: token.Position{Line: 3}},
+		{
+			Prompt:      "go version",
+			Pos:         token.Position{Line: 7},
+			Filters:     []string{"head"},
+			Shell:       "bash",
+			Host:        "example.com",
+			Env:         []string{"PATH=./bin", "TOKEN=secret"},
+			Passthrough: []string{"TOKEN"},
+		},
+	}
+	var buf bytes.Buffer
+	showCommands(&buf, "p.go", cmds)
+	const want = "p.go has new or changed commands:\n" +
+		"\t3: go doc fmt\n" +
+		"\t7: go version\n" +
+		"\t\t| head\n" +
+		"\t\tshell bash\n" +
+		"\t\thost example.com\n" +
+		"\t\tenv PATH=./bin\n" +
+		"\t\tenv TOKEN\n"
+	if got := buf.String(); got != want {
+		t.Errorf("showCommands:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPassthroughSettings(t *testing.T) {
+	t.Setenv("GOSH_TEST_TOKEN", "secret")
+	tests := []struct {
+		env  string
+		want []string
+	}{
+		{"GOSH_TEST_TOKEN", []string{"env GOSH_TEST_TOKEN"}},
+		{"GOSH_TEST_TOKEN=file", []string{"env GOSH_TEST_TOKEN=file"}},
+		{"GOSH_TEST_TOKEN,GOSH_TEST_TOKEN=file", []string{"env GOSH_TEST_TOKEN=file"}},
+		{"GOSH_TEST_TOKEN=file,GOSH_TEST_TOKEN", []string{"env GOSH_TEST_TOKEN"}},
+		{"GOSH_TEST_UNSET", []string{"env GOSH_TEST_UNSET"}},
+	}
+	for _, tt := range tests {
+		src := []byte("#gosh:ok\n#gosh:env " + tt.env + "\n# % true\n")
+		cmds, err := fileCommands("run.sh", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cmds) != 1 {
+			t.Fatalf("gosh:env %s: got %d commands, want 1", tt.env, len(cmds))
+		}
+		if got := commandSettings(cmds[0]); !slices.Equal(got, tt.want) {
+			t.Errorf("gosh:env %s: settings %q, want %q", tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestTrustWarnOnce(t *testing.T) {
+	defer func(old *trustStore) { trust = old }(trust)
+	defer func(old *slog.Logger) { slog.SetDefault(old) }(slog.Default())
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "run.sh")
+	src := []byte("#gosh:ok\n#gosh:ok\n# % true\n")
+	cmds, err := fileCommands(file, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trust = &trustStore{path: filepath.Join(dir, "trusted"), files: make(map[string]map[string]bool)}
+	for _, c := range cmds {
+		trust.add(file, commandHash(c))
+	}
+
+	// Unused directives are only reported with -v.
+	var buf bytes.Buffer
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})))
+	if _, _, err := process(file, src); err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(buf.String(), "redundant gosh:ok"); n != 1 {
+		t.Errorf("warned %d times, want once:\n%s", n, buf.String())
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !unix
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+func userProcAttr(spec string) (*syscall.SysProcAttr, error) {
+	return nil, errors.New("not supported on this system")
+}
+
+func userContainerArgs(attr *syscall.SysProcAttr) []string {
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// userProcAttr returns the process attributes to run commands
+// as the user given by spec, a user name or ID, optionally followed
+// by ":" and a group name or ID, like "nobody" or "65534:65534".
+// Without a group, commands run with the user's primary group.
+// Commands have no supplementary groups.
+func userProcAttr(spec string) (*syscall.SysProcAttr, error) {
+	userSpec, groupSpec, hasGroup := strings.Cut(spec, ":")
+	uid, err := lookupID(userSpec, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var gid uint32
+	if hasGroup {
+		gid, err = lookupID(groupSpec, func(name string) (string, error) {
+			g, err := user.LookupGroup(name)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+		if err != nil {
+			return nil, fmt.Errorf("%v; give a group, like %s:group", err, spec)
+		}
+		gid, err = parseID(u.Gid)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: uid, Gid: gid},
+	}, nil
+}
+
+// userContainerArgs returns the container runtime arguments
+// that run containers as the user and group of attr.
+func userContainerArgs(attr *syscall.SysProcAttr) []string {
+	return []string{fmt.Sprintf("--user=%d:%d", attr.Credential.Uid, attr.Credential.Gid)}
+}
+
+// lookupID returns the numeric ID given by s,
+// or if s isn't numeric, the ID that lookup returns for it.
+func lookupID(s string, lookup func(name string) (string, error)) (uint32, error) {
+	if id, err := parseID(s); err == nil {
+		return id, nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return 0, err
+	}
+	return parseID(id)
+}
+
+func parseID(s string) (uint32, error) {
+	id, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ID %q", s)
+	}
+	return uint32(id), nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// walkFiles returns the Go files in the directories named by patterns,
+// for -files. A pattern ending in "/..." names a directory tree.
+// Like the go command, it skips testdata directories and those
+// whose names start with "." or "_", as well as vendor directories
+// unless -include-vendor is given. Build constraints are ignored.
+func walkFiles(patterns []string) ([]string, error) {
+	var files []string
+	for _, pattern := range patterns {
+		dir, recursive := strings.CutSuffix(pattern, "/...")
+		if pattern == "..." {
+			dir, recursive = ".", true
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if path == dir {
+					return nil
+				}
+				name := d.Name()
+				if !recursive || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") ||
+					name == "vendor" && !*flagVendor {
+					return filepath.SkipDir
+				}
+				if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+					return filepath.SkipDir // another module
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() || !strings.HasSuffix(path, ".go") {
+				return nil
+			}
+			if !*flagTests && strings.HasSuffix(path, "_test.go") {
+				return nil
+			}
+			files = append(files, path)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
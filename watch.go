@@ -0,0 +1,148 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// settleTime is how long a file must go without further changes
+// before watch processes it. Editors often save a file
+// with several writes in quick succession.
+const settleTime = 100 * time.Millisecond
+
+// pkgDirs records the directories of the packages that loadFiles
+// loaded, which watch loads again when files are added to them.
+var pkgDirs = make(map[string]bool)
+
+// watch processes files, and then processes each of them again
+// whenever it changes. It only returns if watching fails,
+// or gosh is interrupted.
+// New files in package directories are processed too,
+// unless they match excludes.
+func watch(files, excludes []string) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	// Watch directories rather than files, so that we keep
+	// seeing changes after an editor saves by renaming
+	// a new file over the old one.
+	watched := make(map[string]bool)
+	for _, file := range files {
+		watched[file] = true
+		if err := w.Add(filepath.Dir(file)); err != nil {
+			return err
+		}
+	}
+
+	var mu sync.Mutex
+	written := make(map[string][]byte) // contents last written by gosh
+	timers := make(map[string]*time.Timer)
+
+	update := func(file string) {
+		src, err := readFile(file)
+		if err != nil {
+			slog.Error(err.Error())
+			return
+		}
+
+		// Ignore the change if it's just our own write.
+		mu.Lock()
+		ours := bytes.Equal(src, written[file])
+		mu.Unlock()
+		if ours {
+			return
+		}
+
+		out, _, err := process(file, src)
+		if err == nil {
+			err = emit(file, src, out)
+		}
+		if err != nil {
+			slog.Error(err.Error(), "file", file)
+			return
+		}
+		slog.Info("processed", "file", file)
+		if *flagWrite {
+			mu.Lock()
+			written[file] = out
+			mu.Unlock()
+		}
+	}
+
+	// reload loads the files in dir again, after a Go file was added to it,
+	// and starts watching the new ones. The files loaded earlier
+	// for other directories are still valid.
+	reload := func(dir string) {
+		// loadFiles records pkgDirs, which the loop below reads.
+		mu.Lock()
+		files, err := loadFiles([]string{dir})
+		mu.Unlock()
+		if err != nil {
+			slog.Error(err.Error(), "dir", dir)
+			return
+		}
+		for _, file := range excludeFiles(files, excludes) {
+			mu.Lock()
+			added := !watched[file]
+			watched[file] = true
+			mu.Unlock()
+			if added {
+				slog.Debug("watching new file", "file", file)
+				go update(file)
+			}
+		}
+	}
+
+	for _, file := range files {
+		go update(file)
+	}
+
+	for {
+		select {
+		case ev, ok := <-w.Events:
+			if !ok {
+				return nil
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+				continue
+			}
+			mu.Lock()
+			key, f := ev.Name, func() { update(ev.Name) }
+			if !watched[ev.Name] {
+				dir := filepath.Dir(ev.Name)
+				if !pkgDirs[dir] || filepath.Ext(ev.Name) != ".go" || ev.Op&fsnotify.Create == 0 {
+					mu.Unlock()
+					continue
+				}
+				key, f = dir, func() { reload(dir) }
+			}
+			if t, ok := timers[key]; ok {
+				t.Reset(settleTime)
+			} else {
+				timers[key] = time.AfterFunc(settleTime, f)
+			}
+			mu.Unlock()
+
+		case err, ok := <-w.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+
+		case <-mainCtx.Done():
+			return mainCtx.Err()
+		}
+	}
+}
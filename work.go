@@ -0,0 +1,69 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// fileModules records the path of the module containing each file
+// loaded from a package, by file name.
+var fileModules = make(map[string]string)
+
+// workspacePatterns returns patterns with "./..." replaced by a pattern
+// for each module in the go.work workspace, if the current directory is
+// the root of a workspace but not itself a module. Otherwise, the go
+// command would report that "./..." matches no modules.
+func workspacePatterns(patterns []string) ([]string, error) {
+	out, err := exec.Command("go", "env", "GOWORK").Output()
+	if err != nil {
+		return patterns, nil // not a workspace, as far as we can tell
+	}
+	gowork := strings.TrimSpace(string(out))
+	if gowork == "" || gowork == "off" {
+		return patterns, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Dir(gowork) != wd {
+		return patterns, nil
+	}
+	if _, err := os.Stat("go.mod"); err == nil {
+		return patterns, nil
+	}
+
+	out, err = exec.Command("go", "work", "edit", "-json").Output()
+	if err != nil {
+		return nil, err
+	}
+	var work struct {
+		Use []struct{ DiskPath string }
+	}
+	if err := json.Unmarshal(out, &work); err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for _, p := range patterns {
+		if p != "./..." {
+			res = append(res, p)
+			continue
+		}
+		for _, u := range work.Use {
+			dir := filepath.ToSlash(filepath.Clean(u.DiskPath))
+			if filepath.IsAbs(u.DiskPath) || strings.HasPrefix(dir, "../") {
+				continue // not within the workspace directory
+			}
+			res = append(res, "./"+strings.TrimPrefix(dir, "./")+"/...")
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,129 @@
+// Copyright 2024 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// writeFile writes out, the processed form of filePath's contents src,
+// back to filePath for -w, first backing up src if -backup is given.
+// It leaves the file alone if out is the same as src.
+func writeFile(filePath string, src, out []byte) error {
+	if bytes.Equal(src, out) && !inOverlay(filePath) {
+		// Keep its modification time, so build systems don't see a change.
+		return nil
+	}
+	if *flagBackup != "" {
+		if err := backup(filePath, src); err != nil {
+			return err
+		}
+	}
+	if *flagSymlinks == "follow" {
+		if target, err := filepath.EvalSymlinks(filePath); err == nil {
+			filePath = target
+		}
+	}
+	return writeAtomic(filePath, out)
+}
+
+// validSymlinks reports whether mode is a known -symlinks mode.
+func validSymlinks(mode string) bool {
+	switch mode {
+	case "follow", "replace", "skip":
+		return true
+	}
+	return false
+}
+
+// skipSymlinks returns files without the symbolic links,
+// warning about each one it skips, for -symlinks=skip.
+func skipSymlinks(files []string) []string {
+	var res []string
+	for _, file := range files {
+		if fi, err := os.Lstat(file); err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			slog.Warn("skipping symbolic link", "file", file)
+			continue
+		}
+		res = append(res, file)
+	}
+	return res
+}
+
+// writeAtomic replaces the contents of the file at path with data.
+// It writes a temporary file in the same directory and renames it
+// into place, so that the file is never left partially written.
+// The new file keeps the original's permissions and ownership.
+// Read-only files are only replaced with -force.
+func writeAtomic(path string, data []byte) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0222 == 0 && !*flagForce {
+		return fmt.Errorf("%s: file is read-only (use -force to overwrite)", path)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(fi.Mode().Perm())
+	}
+	if err == nil {
+		err = chown(tmp, fi)
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// backup saves src, the original contents of filePath,
+// to the backup file named by -backup and -backup-dir.
+// The backup has the same permissions as the original,
+// which may keep others from reading it.
+func backup(filePath string, src []byte) error {
+	fi, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	perm := fi.Mode().Perm()
+	name := filePath + *flagBackup
+	if *flagBkDir != "" {
+		rel := filePath
+		if wd, err := os.Getwd(); err == nil {
+			if r, err := filepath.Rel(wd, filePath); err == nil && !strings.HasPrefix(r, "..") {
+				rel = r
+			}
+		}
+		name = filepath.Join(*flagBkDir, rel+*flagBackup)
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			return err
+		}
+	}
+	// An earlier backup may be read-only, like its original.
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.WriteFile(name, src, perm); err != nil {
+		return err
+	}
+	return os.Chmod(name, perm) // regardless of the umask
+}